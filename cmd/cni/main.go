@@ -0,0 +1,85 @@
+// Command cni is a CNI plugin, which connects each pod using a veth pair and routes a single address to it.
+// Addresses get allocated from the pod CIDR of the node, which the agent writes into the network configuration.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/cni"
+)
+
+func init() {
+	// Netlink handles are bound to the thread they got created on. Keep everything on the main thread.
+	runtime.LockOSThread()
+}
+
+func main() {
+	if err := run(); err != nil {
+		cniErr := &cni.Error{}
+		if !errors.As(err, &cniErr) {
+			cniErr = cni.NewError(cni.ErrCodeInternal, err.Error(), nil)
+		}
+
+		_ = json.NewEncoder(os.Stdout).Encode(cniErr)
+
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	args, err := cni.ArgsFromEnv()
+	if err != nil {
+		return cni.NewError(cni.ErrCodeInvalidEnvironment, "invalid environment", err)
+	}
+
+	if args.Command == "VERSION" {
+		return json.NewEncoder(os.Stdout).Encode(cni.VersionResult{
+			CNIVersion:        cni.SupportedVersions[len(cni.SupportedVersions)-1],
+			SupportedVersions: cni.SupportedVersions,
+		})
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return cni.NewError(cni.ErrCodeIOFailure, "unable to read the network configuration", err)
+	}
+
+	conf, err := cni.ParseNetConf(stdin)
+	if err != nil {
+		return cni.NewError(cni.ErrCodeInvalidNetConfig, "invalid network configuration", err)
+	}
+
+	if !supportsVersion(conf.CNIVersion) {
+		return cni.NewError(cni.ErrCodeIncompatibleVersion, "unsupported CNI version "+conf.CNIVersion, nil)
+	}
+
+	switch args.Command {
+	case "ADD":
+		result, err := cni.Add(args, conf)
+		if err != nil {
+			return err
+		}
+
+		return json.NewEncoder(os.Stdout).Encode(result)
+	case "DEL":
+		return cni.Del(args, conf)
+	case "CHECK":
+		return cni.Check(args, conf)
+	default:
+		return cni.NewError(cni.ErrCodeInvalidEnvironment, "unknown CNI_COMMAND "+args.Command, nil)
+	}
+}
+
+func supportsVersion(version string) bool {
+	for _, supported := range cni.SupportedVersions {
+		if supported == version {
+			return true
+		}
+	}
+
+	return false
+}
@@ -3,32 +3,85 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/go-logr/zapr"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	ctrl "sigs.k8s.io/controller-runtime"
 	ctrlzap "sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	"github.com/mrincompetent/wireguard-controller/pkg/cni"
 	cniconfig "github.com/mrincompetent/wireguard-controller/pkg/controller/cni-config"
+	"github.com/mrincompetent/wireguard-controller/pkg/controller/ipam"
 	"github.com/mrincompetent/wireguard-controller/pkg/controller/key"
+	"github.com/mrincompetent/wireguard-controller/pkg/controller/masquerade"
+	"github.com/mrincompetent/wireguard-controller/pkg/controller/networkpolicy"
 	"github.com/mrincompetent/wireguard-controller/pkg/controller/node"
+	podcidr "github.com/mrincompetent/wireguard-controller/pkg/controller/pod-cidr"
 	"github.com/mrincompetent/wireguard-controller/pkg/controller/route"
 	"github.com/mrincompetent/wireguard-controller/pkg/controller/telemetry"
+	"github.com/mrincompetent/wireguard-controller/pkg/controller/vxlan"
 	wireguard_interface "github.com/mrincompetent/wireguard-controller/pkg/controller/wireguard-interface"
+	"github.com/mrincompetent/wireguard-controller/pkg/mesh"
+	"github.com/mrincompetent/wireguard-controller/pkg/podnet"
+	"github.com/mrincompetent/wireguard-controller/pkg/readiness"
 	keyhelper "github.com/mrincompetent/wireguard-controller/pkg/wireguard/key"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/namespace"
 )
 
 var (
 	interfaceName          = flag.String("interface", "wg-kube", "Name of the WireGuard interface to use")
+	meshConfigPath         = flag.String("mesh-config", "", "Path to a YAML file which configures multiple meshes. Overrides -interface, -wireguard-port and -private-key")
+	netnsPath              = flag.String("netns", "", "Path to a network namespace (e.g. /var/run/netns/wg-kube) the WireGuard interface gets moved into after creation. Empty means the host namespace")
 	nodeName               = flag.String("node-name", "", "Name of the node this pod is running on")
 	privateKeyPath         = flag.String("private-key", "/etc/wireguard/wg-kube-key", "Path to the private key for WireGuard")
 	cniTargetDir           = flag.String("cni-config-path", "/etc/cni/net.d/", "Path where the CNI configs should be written to")
-	cniSourceDir           = flag.String("cni-tpl-path", "/cni-tpl/", "Path where the CNI config templates are stored")
-	podCIDR                = flag.String("pod-cidr", "", "Pod CIDR")
+	cniSourceDir           = flag.String("cni-tpl-path", "/cni-tpl/", "Path where the CNI config templates are stored. Only used if -cni-tpl-selector is empty")
+	cniTemplateNamespace   = flag.String("cni-tpl-namespace", "kube-system", "Namespace of the ConfigMaps containing the CNI config templates")
+	cniTemplateSelector    = flag.String("cni-tpl-selector", "", "Label selector for the ConfigMaps containing the CNI config templates. ConfigMaps can be restricted to a set of nodes using the wireguard/node-selector annotation. Empty reads the templates from -cni-tpl-path")
+	cniPluginBinary        = flag.String("cni-plugin-binary", "", "Path to the bundled CNI plugin binary, which gets installed into -cni-bin-dir. Empty disables the installation")
+	cniBinDir              = flag.String("cni-bin-dir", "/opt/cni/bin", "Directory the CNI plugin binaries are stored in. Rendered network configurations referencing plugins, which are missing in it, are not written. Empty disables the check")
+	cniReadinessGate       = flag.Bool("cni-readiness-gate", true, "Only write the CNI config once the public key is published, all initialized nodes are configured as peers and their routes are in place. Afterwards it's only removed again if -cni-remove-on-degraded is set")
+	cniInitialThreshold    = flag.Float64("cni-initial-threshold", readiness.DefaultInitialThreshold, "Fraction of peers or routes, which may be missing when the mesh becomes ready for the first time or after degrading")
+	cniDegradedThreshold   = flag.Float64("cni-degraded-threshold", readiness.DefaultDegradedThreshold, "Fraction of missing peers or routes after which a ready mesh counts as degraded. The node gets tainted as not ready again or, see -cni-remove-on-degraded, the CNI config gets removed")
+	cniRemoveOnDegraded    = flag.Bool("cni-remove-on-degraded", false, "Remove the CNI config once the mesh degrades, so no pods can get started on the node. Always done if -not-ready-taint is disabled, as nothing else would keep pods away")
+	notReadyTaint          = flag.Bool("not-ready-taint", true, "Taint the node with wireguard/agent-not-ready:NoSchedule on startup until the key, interface, peers, routes and CNI config got reconciled, and again while the mesh is degraded")
+	podCIDR                = flag.String("pod-cidr", "", "Cluster pod CIDR. Empty discovers it from -pod-cidr-configmap or, with -pod-cidr-from-nodes, the pod CIDRs of the nodes")
+	podCIDRConfigMap       = flag.String("pod-cidr-configmap", "kube-system/kubeadm-config", "ConfigMap (namespace/name) the cluster pod CIDR gets discovered from if -pod-cidr is empty. Either the podCIDR key or the pod subnet of kubeadm's ClusterConfiguration is used")
+	podCIDRFromNodes       = flag.Bool("pod-cidr-from-nodes", false, "Infer the cluster pod CIDR from the pod CIDRs of the nodes if -pod-cidr is empty and -pod-cidr-configmap contains none. The inferred network only ever gets widened")
+	serviceCIDR            = flag.String("service-cidr", "", "Service CIDR. Only used to render the CNI config templates")
 	wireGuardPort          = flag.Int("wireguard-port", 51820, "WireGuard listening port")
+	firewallMark           = flag.Int("fwmark", 0, "Firewall mark set on the packets sent by the WireGuard interface. 0 disables it")
+	mtu                    = flag.Int("mtu", 0, "MTU of the WireGuard interface. 0 keeps the kernel default")
+	persistentKeepalive    = flag.Duration("persistent-keepalive", 0, "Persistent keepalive interval for all peers. Nodes can override it using the wireguard/persistent_keepalive annotation. 0 disables it")
+	natKeepalive           = flag.Duration("nat-persistent-keepalive", 25*time.Second, "Persistent keepalive interval for peers which got detected as being behind a NAT. Their observed endpoint is kept as long as the handshakes succeed. 0 disables the NAT detection")
+	unmanagedPeers         = flag.String("unmanaged-peers", "", "Comma separated list of public keys of WireGuard peers which must never be touched by the controller")
+	removeUnknownPeers     = flag.Bool("remove-unknown-peers", true, "Remove WireGuard peers for which no node exists")
+	routeProtocol          = flag.Int("route-protocol", route.DefaultProtocol, "Route protocol number used to tag the routes the controller owns. Owned routes which do not match a node anymore get removed")
+	routeTable             = flag.Int("route-table", route.DefaultTable, "Routing table for the pod routes. If it's not the main table, a rule selecting it for traffic to the pod CIDR gets managed. Installed rules are recorded in -route-rule-state-file and removed once they don't match anymore, including after switching back to the main table")
+	routeRulePriority      = flag.Int("route-rule-priority", route.DefaultRulePriority, "Priority of the rule selecting the routing table for traffic to the pod CIDR")
+	routeRuleStateFile     = flag.String("route-rule-state-file", "/etc/wireguard/wireguard-controller-rules", "Path to the file recording the installed rules, so they get removed after -route-table, -route-rule-priority or the pod CIDR changed. Must persist across restarts. Empty only considers rules matching the current -route-rule-priority and -route-table as owned")
+	routeSource            = flag.String("route-source", route.SourceTunnel, "Preferred source address of the pod routes. One of tunnel, gateway or none. gateway requires the gateway address to be assigned on the host (e.g. by the bridge plugin) and falls back to tunnel otherwise")
+	directRouting          = flag.Bool("direct-routing", false, "Route the pod CIDR of nodes sharing a network segment with this node via their node address instead of WireGuard. Nodes labeled with wireguard/force-encryption=true always use WireGuard")
+	vxlanEnabled           = flag.Bool("vxlan", false, "Reach nodes in the same trusted zone (wireguard/trusted-zone label) through an unencrypted VXLAN interface instead of WireGuard")
+	vxlanInterfaceName     = flag.String("vxlan-interface", vxlan.DefaultInterfaceName, "Name of the VXLAN interface")
+	vxlanID                = flag.Int("vxlan-id", vxlan.DefaultVNI, "VXLAN network identifier")
+	vxlanPort              = flag.Int("vxlan-port", vxlan.DefaultPort, "UDP port used for VXLAN")
+	vxlanMTU               = flag.Int("vxlan-mtu", vxlan.DefaultMTU, "MTU of the VXLAN interface")
+	masqueradeEnabled      = flag.Bool("masquerade", false, "Masquerade traffic from the pod CIDR to destinations outside of the pod CIDR, the advertised routes and -no-masquerade-cidrs using an nftables table owned by the agent")
+	noMasqueradeCIDRs      = flag.String("no-masquerade-cidrs", "", "Comma separated list of CIDRs traffic from pods must not get masqueraded to")
+	networkPolicy          = flag.Bool("network-policy", false, "Enforce Kubernetes NetworkPolicies for the pods running on the node using nftables")
+	ipamEnabled            = flag.Bool("ipam", false, "Allocate pod CIDRs out of -pod-cidr for nodes, which got none assigned by Kubernetes (e.g. kube-controller-manager running with --allocate-node-cidrs=false). Allocations are stored in the wireguard/pod_cidr node annotation. Only the agent holding the leader lock allocates")
+	ipamMaskSize           = flag.Int("ipam-mask-size", 24, "Mask size of the pod CIDRs allocated by -ipam")
+	uninstall              = flag.Bool("uninstall", false, "Remove the nftables rules of the agent and exit")
+	resyncInterval         = flag.Duration("resync-interval", 5*time.Second, "Interval in which the WireGuard interface & the routes get reconciled. Changes to the link, its addresses & the routes trigger a reconcile right away")
 	telemetryListenAddress = flag.String("telemetry-listen-address", "127.0.0.1:8080", "Listen address for the telemetry http server")
 	development            = flag.Bool("development", false, "enable development logging")
 )
@@ -48,16 +101,87 @@ func main() {
 	log := ctrlzap.NewRaw(enableDevelopment(*development))
 	ctrl.SetLogger(zapr.NewLogger(log))
 
+	if *uninstall {
+		if err := masquerade.Uninstall(ctx); err != nil {
+			log.Panic("Unable to remove the masquerade rules", zap.Error(err))
+		}
+
+		if err := networkpolicy.Uninstall(ctx); err != nil {
+			log.Panic("Unable to remove the network policy rules", zap.Error(err))
+		}
+
+		log.Info("Removed the nftables rules")
+
+		return
+	}
+
 	promRegistry := prometheus.NewRegistry()
 	metricFactory := promauto.With(promRegistry)
 
-	if *podCIDR == "" {
-		log.Panic("pod-cidr must be set")
+	podNetStore := podnet.New()
+
+	if *podCIDR != "" {
+		_, podCidrNet, err := net.ParseCIDR(*podCIDR)
+		if err != nil {
+			log.Panic("unable to parse pod cidr", zap.Error(err))
+		}
+
+		podNetStore.Set(podCidrNet)
 	}
 
-	_, podCidrNet, err := net.ParseCIDR(*podCIDR)
+	if *ipamEnabled && *podCIDR == "" {
+		log.Panic("ipam requires pod-cidr to be set, as allocations must not move with a discovered network")
+	}
+
+	if *podCIDR == "" && *podCIDRConfigMap == "" && !*podCIDRFromNodes {
+		log.Panic("pod-cidr, pod-cidr-configmap or pod-cidr-from-nodes must be set to know the cluster pod CIDR")
+	}
+
+	if *directRouting && *netnsPath != "" {
+		log.Panic("direct-routing cannot be combined with netns, as the node addresses live in the host namespace")
+	}
+
+	if *vxlanEnabled && *netnsPath != "" {
+		log.Panic("vxlan cannot be combined with netns, as the node addresses live in the host namespace")
+	}
+
+	if *cniPluginBinary != "" && *netnsPath != "" {
+		log.Panic("cni-plugin-binary cannot be combined with netns, as the bundled plugin attaches pods to the host namespace instead of the WireGuard namespace")
+	}
+
+	if *serviceCIDR != "" {
+		if _, _, err := net.ParseCIDR(*serviceCIDR); err != nil {
+			log.Panic("unable to parse service cidr", zap.Error(err))
+		}
+	}
+
+	if *cniDegradedThreshold < 0 || *cniDegradedThreshold > 1 {
+		log.Panic("cni-degraded-threshold must be between 0 and 1")
+	}
+
+	if *cniInitialThreshold < 0 || *cniInitialThreshold > *cniDegradedThreshold {
+		log.Panic("cni-initial-threshold must be between 0 and cni-degraded-threshold")
+	}
+
+	noMasqueradeNets, err := parseNetworks(*noMasqueradeCIDRs)
 	if err != nil {
-		log.Panic("unable to parse pod cidr", zap.Error(err))
+		log.Panic("unable to parse the no-masquerade cidrs", zap.Error(err))
+	}
+
+	unmanagedPeerKeys, err := kubernetes.ParsePublicKeys(*unmanagedPeers)
+	if err != nil {
+		log.Panic("unable to parse the unmanaged peers", zap.Error(err))
+	}
+
+	if *cniPluginBinary != "" {
+		installed, err := cni.InstallBinary(*cniPluginBinary, *cniBinDir)
+		if err != nil {
+			log.Panic("Unable to install the CNI plugin", zap.Error(err))
+		}
+
+		if installed {
+			log.Info("Installed the CNI plugin", zap.String("bin_dir", *cniBinDir))
+		}
 	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
@@ -69,79 +193,306 @@ func main() {
 		log.Panic("Unable to start manager", zap.Error(err))
 	}
 
-	keyStore := keyhelper.New()
+	meshes, err := loadMeshes()
+	if err != nil {
+		log.Panic("Unable to load the mesh configuration", zap.Error(err))
+	}
 
-	if err := wireguard_interface.Add(
-		ctx,
-		mgr,
-		log,
-		*interfaceName,
-		*wireGuardPort,
-		*nodeName,
-		keyStore,
-		metricFactory,
-	); err != nil {
-		log.Panic("Unable to add the WireGuard interface controller to the controller manager", zap.Error(err))
+	ns := namespace.New(*netnsPath)
+	readinessStore := readiness.New(*cniInitialThreshold, *cniDegradedThreshold)
+
+	for _, wgMesh := range meshes {
+		meshLog := log.With(zap.String("interface", wgMesh.InterfaceName))
+		// All meshes share the same registry. The interface label keeps their metrics apart.
+		meshMetricFactory := promauto.With(prometheus.WrapRegistererWith(prometheus.Labels{"interface": wgMesh.InterfaceName}, promRegistry))
+
+		if err := addMeshControllers(ctx, mgr, meshLog, wgMesh, ns, podNetStore, unmanagedPeerKeys, readinessStore, meshMetricFactory); err != nil {
+			meshLog.Panic("Unable to add the mesh controllers to the controller manager", zap.Error(err))
+		}
 	}
 
+	// The CNI config is shared by all meshes. It's managed by the primary mesh.
 	if err := cniconfig.Add(
 		mgr,
 		log,
 		*cniSourceDir,
+		*cniTemplateNamespace,
+		*cniTemplateSelector,
 		*cniTargetDir,
-		*interfaceName,
-		podCidrNet,
+		*cniBinDir,
+		meshes[0].InterfaceName,
+		vxlanInterface(),
+		ns,
+		podNetStore,
+		*serviceCIDR,
 		*nodeName,
+		readinessStore,
+		*cniReadinessGate,
+		*cniRemoveOnDegraded || !*notReadyTaint,
 		metricFactory,
 	); err != nil {
 		log.Panic("Unable to add the cni config controller to the controller manager", zap.Error(err))
 	}
 
-	if err := route.Add(
+	if *podCIDR == "" {
+		configMapNamespace, configMapName, err := parseConfigMapName(*podCIDRConfigMap)
+		if err != nil {
+			log.Panic("unable to parse the pod cidr configmap", zap.Error(err))
+		}
+
+		if err := podcidr.Add(
+			mgr,
+			log,
+			podNetStore,
+			configMapNamespace,
+			configMapName,
+			*podCIDRFromNodes,
+			*nodeName,
+			*resyncInterval,
+			metricFactory,
+		); err != nil {
+			log.Panic("Unable to add the pod CIDR discovery controller to the controller manager", zap.Error(err))
+		}
+	}
+
+	if *vxlanEnabled {
+		if err := vxlan.Add(
+			mgr,
+			log,
+			*vxlanInterfaceName,
+			*vxlanID,
+			*vxlanPort,
+			*vxlanMTU,
+			ns,
+			*nodeName,
+			podNetStore,
+			*directRouting,
+			*resyncInterval,
+			metricFactory,
+		); err != nil {
+			log.Panic("Unable to add the VXLAN controller to the controller manager", zap.Error(err))
+		}
+	}
+
+	if *masqueradeEnabled {
+		if err := masquerade.Add(
+			mgr,
+			log,
+			podNetStore,
+			noMasqueradeNets,
+			*resyncInterval,
+			metricFactory,
+		); err != nil {
+			log.Panic("Unable to add the masquerade controller to the controller manager", zap.Error(err))
+		}
+	}
+
+	if *networkPolicy {
+		if err := networkpolicy.Add(
+			mgr,
+			log,
+			*nodeName,
+			*resyncInterval,
+			metricFactory,
+		); err != nil {
+			log.Panic("Unable to add the network policy controller to the controller manager", zap.Error(err))
+		}
+	}
+
+	if *ipamEnabled {
+		// Only one agent may allocate at a time. The other controllers must keep running on every node,
+		// so the IPAM controller gets its own manager, which only starts it while holding the leader lock.
+		ipamMgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+			MetricsBindAddress: "0",
+			LeaderElection:     true,
+			LeaderElectionID:   "wireguard-controller-ipam",
+		})
+		if err != nil {
+			log.Panic("Unable to start the IPAM manager", zap.Error(err))
+		}
+
+		if err := ipam.Add(
+			ipamMgr,
+			log,
+			podNetStore.Get(),
+			*ipamMaskSize,
+			*resyncInterval,
+			metricFactory,
+		); err != nil {
+			log.Panic("Unable to add the IPAM controller to the controller manager", zap.Error(err))
+		}
+
+		go func() {
+			if err := ipamMgr.Start(ctx.Done()); err != nil {
+				log.Panic("problem running the IPAM manager", zap.Error(err))
+			}
+		}()
+	}
+
+	if err := telemetry.Add(
 		mgr,
 		log,
-		*interfaceName,
+		promRegistry,
+		*telemetryListenAddress,
+	); err != nil {
+		log.Panic("Unable to add the telemetry server to the controller manager", zap.Error(err))
+	}
+
+	log.Info("Starting manager")
+
+	if err := mgr.Start(ctx.Done()); err != nil {
+		log.Panic("problem running manager", zap.Error(err))
+	}
+}
+
+// loadMeshes returns the meshes from the mesh config file.
+// Without a config file a single mesh gets configured using the flags.
+func loadMeshes() ([]*mesh.Mesh, error) {
+	if *meshConfigPath != "" {
+		return mesh.Load(*meshConfigPath)
+	}
+
+	meshes := []*mesh.Mesh{
+		{
+			InterfaceName:  *interfaceName,
+			ListenPort:     *wireGuardPort,
+			PrivateKeyPath: *privateKeyPath,
+		},
+	}
+
+	return meshes, mesh.Complete(meshes)
+}
+
+func addMeshControllers(
+	ctx context.Context,
+	mgr ctrl.Manager,
+	log *zap.Logger,
+	wgMesh *mesh.Mesh,
+	ns *namespace.Namespace,
+	podNetStore *podnet.Store,
+	unmanagedPeerKeys []wgtypes.Key,
+	readinessStore *readiness.Store,
+	metricFactory promauto.Factory,
+) error {
+	keyStore := keyhelper.New()
+
+	if err := wireguard_interface.Add(
+		ctx,
+		mgr,
+		log,
+		wgMesh,
+		ns,
+		podNetStore,
+		*firewallMark,
+		*mtu,
 		*nodeName,
+		keyStore,
+		readinessStore,
+		kubernetes.PeerOptions{
+			PersistentKeepalive: *persistentKeepalive,
+			NATKeepalive:        *natKeepalive,
+		},
+		unmanagedPeerKeys,
+		*removeUnknownPeers,
+		*directRouting,
+		*vxlanEnabled,
+		*resyncInterval,
 		metricFactory,
 	); err != nil {
-		log.Panic("Unable to add the route controller to the controller manager", zap.Error(err))
+		return fmt.Errorf("unable to add the WireGuard interface controller: %w", err)
 	}
 
-	if err := node.Add(
+	if err := route.Add(
 		mgr,
 		log,
+		wgMesh,
+		ns,
 		*nodeName,
-		*wireGuardPort,
-		keyStore,
+		podNetStore,
+		*routeProtocol,
+		*routeTable,
+		*routeRulePriority,
+		*routeRuleStateFile,
+		*routeSource,
+		*directRouting,
+		vxlanInterface(),
+		readinessStore,
+		*resyncInterval,
 		metricFactory,
 	); err != nil {
-		log.Panic("Unable to add the node controller to the controller manager", zap.Error(err))
+		return fmt.Errorf("unable to add the route controller: %w", err)
 	}
 
-	if err := telemetry.Add(
+	if err := node.Add(
 		mgr,
 		log,
-		promRegistry,
-		*telemetryListenAddress,
+		wgMesh,
+		ns,
+		*nodeName,
+		keyStore,
+		readinessStore,
+		*notReadyTaint,
+		*directRouting,
+		metricFactory,
 	); err != nil {
-		log.Panic("Unable to add the telemetry server to the controller manager", zap.Error(err))
+		return fmt.Errorf("unable to add the node controller: %w", err)
 	}
 
 	if err := key.Add(
 		mgr,
 		log,
-		*privateKeyPath,
+		wgMesh,
 		keyStore,
 		metricFactory,
 	); err != nil {
-		log.Panic("Unable to add the key controller to the controller manager", zap.Error(err))
+		return fmt.Errorf("unable to add the key controller: %w", err)
 	}
 
-	log.Info("Starting manager")
+	return nil
+}
 
-	if err := mgr.Start(ctx.Done()); err != nil {
-		log.Panic("problem running manager", zap.Error(err))
+// vxlanInterface returns the name of the VXLAN interface or an empty string if VXLAN is disabled.
+func vxlanInterface() string {
+	if !*vxlanEnabled {
+		return ""
 	}
+
+	return *vxlanInterfaceName
+}
+
+// parseNetworks parses a comma separated list of CIDRs.
+func parseNetworks(cidrs string) ([]net.IPNet, error) {
+	var networks []net.IPNet
+
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %w", cidr, err)
+		}
+
+		networks = append(networks, *network)
+	}
+
+	return networks, nil
+}
+
+// parseConfigMapName parses a namespace/name reference. An empty reference returns empty names.
+func parseConfigMapName(ref string) (string, string, error) {
+	if ref == "" {
+		return "", "", nil
+	}
+
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid ConfigMap '%s', expected namespace/name", ref)
+	}
+
+	return parts[0], parts[1], nil
 }
 
 func enableDevelopment(b bool) func(o *ctrlzap.Options) {
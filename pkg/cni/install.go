@@ -0,0 +1,59 @@
+package cni
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// BinaryName is the file name of the plugin inside the CNI binary directory. It must match PluginType.
+const BinaryName = PluginType
+
+// InstallBinary copies the plugin binary into the CNI binary directory, if it differs from the installed one.
+// The binary gets written to a temporary file first, so the runtime never executes a partially written binary.
+// The bool return value is true if the binary got installed.
+func InstallBinary(sourcePath, binDir string) (bool, error) {
+	content, err := ioutil.ReadFile(sourcePath)
+	if err != nil {
+		return false, fmt.Errorf("unable to read the plugin binary '%s': %w", sourcePath, err)
+	}
+
+	target := filepath.Join(binDir, BinaryName)
+
+	current, err := ioutil.ReadFile(target)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("unable to read the installed plugin binary '%s': %w", target, err)
+	}
+
+	if bytes.Equal(current, content) {
+		return false, nil
+	}
+
+	tmp, err := ioutil.TempFile(binDir, "."+BinaryName)
+	if err != nil {
+		return false, fmt.Errorf("unable to create a temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+
+		return false, fmt.Errorf("unable to write the plugin binary: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("unable to write the plugin binary: %w", err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return false, fmt.Errorf("unable to make the plugin binary executable: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return false, fmt.Errorf("unable to move the plugin binary into place: %w", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,191 @@
+package cni
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	lockFile         = "lock"
+	lastReservedFile = "last_reserved_ip"
+
+	// reservedAddresses is the number of addresses at the start of the subnet, which never get allocated.
+	// The first one is the tunnel address, the second one the gateway address.
+	reservedAddresses = 2
+)
+
+var ErrSubnetExhausted = errors.New("no free address left in the subnet")
+
+// Store keeps track of the allocated pod addresses using one file per address.
+// Multiple plugin invocations run in parallel, so all operations are serialized using a file lock.
+type Store struct {
+	dir    string
+	subnet *net.IPNet
+	lock   *os.File
+}
+
+// OpenStore opens & locks the store for the network. Close must be called to release the lock.
+func OpenStore(dataDir, network string, subnet *net.IPNet) (*Store, error) {
+	dir := filepath.Join(dataDir, network)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create the data directory '%s': %w", dir, err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the lock file: %w", err)
+	}
+
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		lock.Close()
+
+		return nil, fmt.Errorf("unable to lock the store: %w", err)
+	}
+
+	return &Store{
+		dir:    dir,
+		subnet: subnet,
+		lock:   lock,
+	}, nil
+}
+
+// Close releases the lock.
+func (s *Store) Close() error {
+	return s.lock.Close()
+}
+
+func owner(containerID, ifName string) string {
+	return containerID + "\n" + ifName
+}
+
+// Allocate returns an address for the container interface.
+// Allocating twice for the same container interface returns the same address.
+func (s *Store) Allocate(containerID, ifName string) (net.IP, error) {
+	if ip, err := s.Lookup(containerID, ifName); err != nil || ip != nil {
+		return ip, err
+	}
+
+	first, last := s.allocatableRange()
+	if first > last {
+		return nil, ErrSubnetExhausted
+	}
+
+	// Continue after the last allocated address, so addresses do not get reused right away
+	start := first
+
+	if content, err := ioutil.ReadFile(filepath.Join(s.dir, lastReservedFile)); err == nil {
+		if lastIP := net.ParseIP(strings.TrimSpace(string(content))).To4(); lastIP != nil {
+			if lastReserved := ipToUint32(lastIP); lastReserved >= first && lastReserved <= last {
+				start = lastReserved + 1
+			}
+		}
+	}
+
+	size := last - first + 1
+
+	for i := uint32(0); i < size; i++ {
+		candidate := first + (start-first+i)%size
+		ip := uint32ToIP(candidate)
+
+		file, err := os.OpenFile(filepath.Join(s.dir, ip.String()), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("unable to reserve address %s: %w", ip, err)
+		}
+
+		_, writeErr := file.WriteString(owner(containerID, ifName))
+		closeErr := file.Close()
+
+		if writeErr != nil || closeErr != nil {
+			os.Remove(file.Name())
+
+			return nil, fmt.Errorf("unable to reserve address %s: write: %v, close: %v", ip, writeErr, closeErr)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(s.dir, lastReservedFile), []byte(ip.String()), 0o600); err != nil {
+			return nil, fmt.Errorf("unable to store the last reserved address: %w", err)
+		}
+
+		return ip, nil
+	}
+
+	return nil, ErrSubnetExhausted
+}
+
+// Lookup returns the address allocated for the container interface. Nil gets returned if there is none.
+func (s *Store) Lookup(containerID, ifName string) (net.IP, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the allocations: %w", err)
+	}
+
+	for _, file := range files {
+		ip := net.ParseIP(file.Name()).To4()
+		if ip == nil {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the allocation of %s: %w", ip, err)
+		}
+
+		if strings.TrimSpace(string(content)) == owner(containerID, ifName) {
+			return ip, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Release frees the address of the container interface. Releasing an unknown container interface is no error.
+func (s *Store) Release(containerID, ifName string) error {
+	ip, err := s.Lookup(containerID, ifName)
+	if err != nil || ip == nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(s.dir, ip.String())); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to release address %s: %w", ip, err)
+	}
+
+	return nil
+}
+
+// allocatableRange returns the first & last allocatable address of the subnet.
+func (s *Store) allocatableRange() (uint32, uint32) {
+	return ipToUint32(s.subnet.IP.To4()) + reservedAddresses, ipToUint32(s.broadcast()) - 1
+}
+
+func (s *Store) broadcast() net.IP {
+	network := s.subnet.IP.To4()
+	broadcast := make(net.IP, len(network))
+
+	for i := range network {
+		broadcast[i] = network[i] | ^s.subnet.Mask[len(s.subnet.Mask)-len(network)+i]
+	}
+
+	return broadcast
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(i uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, i)
+
+	return ip
+}
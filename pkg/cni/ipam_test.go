@@ -0,0 +1,105 @@
+package cni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func openTestStore(t *testing.T, cidr string) *Store {
+	dir, err := ioutil.TempDir("", "cni-ipam")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", cidr, err)
+	}
+
+	store, err := OpenStore(dir, "test", subnet)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	t.Cleanup(func() {
+		store.Close()
+	})
+
+	return store
+}
+
+func allocate(t *testing.T, store *Store, containerID string) string {
+	ip, err := store.Allocate(containerID, "eth0")
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+
+	return ip.String()
+}
+
+func TestStoreAllocate(t *testing.T) {
+	store := openTestStore(t, "10.244.1.0/29")
+
+	// .0 & .1 are reserved, .7 is the broadcast address
+	testhelper.CompareStrings(t, "10.244.1.2", allocate(t, store, "a"))
+	testhelper.CompareStrings(t, "10.244.1.3", allocate(t, store, "b"))
+	// Allocating again returns the existing address
+	testhelper.CompareStrings(t, "10.244.1.2", allocate(t, store, "a"))
+	testhelper.CompareStrings(t, "10.244.1.4", allocate(t, store, "c"))
+	testhelper.CompareStrings(t, "10.244.1.5", allocate(t, store, "d"))
+	testhelper.CompareStrings(t, "10.244.1.6", allocate(t, store, "e"))
+	testhelper.CompareStrings(t, ErrSubnetExhausted.Error(), allocate(t, store, "f"))
+
+	if err := store.Release("b", "eth0"); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+
+	// Releasing twice is no error
+	if err := store.Release("b", "eth0"); err != nil {
+		t.Fatalf("failed to release twice: %v", err)
+	}
+
+	testhelper.CompareStrings(t, "10.244.1.3", allocate(t, store, "f"))
+}
+
+func TestStoreAllocateContinuesAfterLastReserved(t *testing.T) {
+	store := openTestStore(t, "10.244.1.0/24")
+
+	testhelper.CompareStrings(t, "10.244.1.2", allocate(t, store, "a"))
+
+	if err := store.Release("a", "eth0"); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+
+	// The released address does not get reused right away
+	testhelper.CompareStrings(t, "10.244.1.3", allocate(t, store, "b"))
+}
+
+func TestStoreLookup(t *testing.T) {
+	store := openTestStore(t, "10.244.1.0/24")
+
+	allocate(t, store, "a")
+
+	ip, err := store.Lookup("a", "eth1")
+	if err != nil {
+		t.Fatalf("failed to look up: %v", err)
+	}
+
+	testhelper.CompareStrings(t, "<nil>", fmt.Sprint(ip))
+
+	ip, err = store.Lookup("a", "eth0")
+	if err != nil {
+		t.Fatalf("failed to look up: %v", err)
+	}
+
+	testhelper.CompareStrings(t, "10.244.1.2", ip.String())
+}
@@ -0,0 +1,328 @@
+package cni
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// hostGateway is the gateway of the pods. It's never assigned to an interface.
+// A static neighbor entry inside the pod resolves it to the host side of the veth pair, which then routes the traffic.
+var hostGateway = net.IPv4(169, 254, 1, 1).To4()
+
+// Args are the runtime parameters passed to the plugin using environment variables.
+type Args struct {
+	Command     string
+	ContainerID string
+	NetNS       string
+	IfName      string
+}
+
+// ArgsFromEnv reads the runtime parameters from the environment.
+func ArgsFromEnv() (*Args, error) {
+	args := &Args{
+		Command:     os.Getenv("CNI_COMMAND"),
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		NetNS:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+	}
+
+	if args.Command == "" {
+		return nil, fmt.Errorf("CNI_COMMAND must be set")
+	}
+
+	if args.Command == "VERSION" {
+		return args, nil
+	}
+
+	if args.ContainerID == "" {
+		return nil, fmt.Errorf("CNI_CONTAINERID must be set")
+	}
+
+	if args.IfName == "" {
+		return nil, fmt.Errorf("CNI_IFNAME must be set")
+	}
+
+	if args.NetNS == "" && args.Command != "DEL" {
+		return nil, fmt.Errorf("CNI_NETNS must be set")
+	}
+
+	return args, nil
+}
+
+// HostInterfaceName returns the name of the host side of the veth pair. It's derived from the container, so DEL can find it.
+func HostInterfaceName(containerID, ifName string) string {
+	sum := sha1.Sum([]byte(containerID + ifName))
+
+	return "wgk" + hex.EncodeToString(sum[:])[:11]
+}
+
+// Add creates the pod interface, assigns an address & sets up the routes.
+func Add(args *Args, conf *NetConf) (*Result, error) {
+	store, err := OpenStore(conf.DataDir, conf.Name, conf.subnet)
+	if err != nil {
+		return nil, NewError(ErrCodeIOFailure, "unable to open the IPAM store", err)
+	}
+	defer store.Close()
+
+	ip, err := store.Allocate(args.ContainerID, args.IfName)
+	if err != nil {
+		return nil, NewError(ErrCodeTryAgainLater, "unable to allocate an address", err)
+	}
+
+	result, err := setupInterfaces(args, conf, ip)
+	if err != nil {
+		// Leave nothing behind, the runtime will retry
+		_ = deleteHostInterface(args)
+		_ = store.Release(args.ContainerID, args.IfName)
+
+		return nil, NewError(ErrCodeInternal, "unable to setup the pod interface", err)
+	}
+
+	return result, nil
+}
+
+func setupInterfaces(args *Args, conf *NetConf, ip net.IP) (*Result, error) {
+	containerNS, err := netns.GetFromPath(args.NetNS)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the network namespace '%s': %w", args.NetNS, err)
+	}
+	defer containerNS.Close()
+
+	containerHandle, err := netlink.NewHandleAt(containerNS)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get a netlink handle for the container: %w", err)
+	}
+	defer containerHandle.Delete()
+
+	hostName := HostInterfaceName(args.ContainerID, args.IfName)
+	// The peer gets created in the host namespace first. A temporary name prevents collisions with the container's interface name.
+	peerName := "tmp" + hostName[3:]
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: hostName,
+			MTU:  conf.MTU,
+		},
+		PeerName: peerName,
+	}
+
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, fmt.Errorf("unable to create the veth pair: %w", err)
+	}
+
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the container side of the veth pair: %w", err)
+	}
+
+	if err := netlink.LinkSetNsFd(peer, int(containerNS)); err != nil {
+		return nil, fmt.Errorf("unable to move the veth into the container: %w", err)
+	}
+
+	hostLink, err := netlink.LinkByName(hostName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the host side of the veth pair: %w", err)
+	}
+
+	containerLink, err := setupContainerInterface(containerHandle, peerName, args.IfName, ip, hostLink.Attrs().HardwareAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setupHostInterface(hostLink, ip); err != nil {
+		return nil, err
+	}
+
+	containerIndex := 1
+
+	return &Result{
+		CNIVersion: conf.CNIVersion,
+		Interfaces: []Interface{
+			{Name: hostName, Mac: hostLink.Attrs().HardwareAddr.String()},
+			{Name: args.IfName, Mac: containerLink.Attrs().HardwareAddr.String(), Sandbox: args.NetNS},
+		},
+		IPs: []IPConfig{
+			{Version: "4", Interface: &containerIndex, Address: hostAddress(ip).String(), Gateway: hostGateway.String()},
+		},
+		Routes: []Route{
+			{Dst: "0.0.0.0/0", GW: hostGateway.String()},
+		},
+	}, nil
+}
+
+func hostAddress(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+}
+
+// setupContainerInterface configures the pod side: the /32 address, a default route via the host gateway & a static neighbor entry for it.
+func setupContainerInterface(handle *netlink.Handle, peerName, ifName string, ip net.IP, hostMAC net.HardwareAddr) (netlink.Link, error) {
+	link, err := handle.LinkByName(peerName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the container interface: %w", err)
+	}
+
+	if err := handle.LinkSetName(link, ifName); err != nil {
+		return nil, fmt.Errorf("unable to rename the container interface to %s: %w", ifName, err)
+	}
+
+	if err := handle.AddrAdd(link, &netlink.Addr{IPNet: hostAddress(ip)}); err != nil {
+		return nil, fmt.Errorf("unable to assign the address: %w", err)
+	}
+
+	if err := handle.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("unable to bring up the container interface: %w", err)
+	}
+
+	neighbor := &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		IP:           hostGateway,
+		HardwareAddr: hostMAC,
+	}
+	if err := handle.NeighSet(neighbor); err != nil {
+		return nil, fmt.Errorf("unable to set the neighbor entry for the gateway: %w", err)
+	}
+
+	gatewayRoute := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       hostAddress(hostGateway),
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if err := handle.RouteReplace(gatewayRoute); err != nil {
+		return nil, fmt.Errorf("unable to add the route to the gateway: %w", err)
+	}
+
+	defaultRoute := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		Gw:        hostGateway,
+	}
+	if err := handle.RouteReplace(defaultRoute); err != nil {
+		return nil, fmt.Errorf("unable to add the default route: %w", err)
+	}
+
+	// Refresh the attributes to get the final name & MAC
+	return handle.LinkByIndex(link.Attrs().Index)
+}
+
+// setupHostInterface brings the host side up and routes the pod address to it.
+func setupHostInterface(link netlink.Link, ip net.IP) error {
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("unable to bring up the host interface: %w", err)
+	}
+
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       hostAddress(ip),
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("unable to add the route to the pod: %w", err)
+	}
+
+	return nil
+}
+
+// Del removes the pod interface & releases the address. Missing resources are no error, as DEL might get called multiple times.
+func Del(args *Args, conf *NetConf) error {
+	if err := deleteHostInterface(args); err != nil {
+		return NewError(ErrCodeInternal, "unable to delete the pod interface", err)
+	}
+
+	store, err := OpenStore(conf.DataDir, conf.Name, conf.subnet)
+	if err != nil {
+		return NewError(ErrCodeIOFailure, "unable to open the IPAM store", err)
+	}
+	defer store.Close()
+
+	if err := store.Release(args.ContainerID, args.IfName); err != nil {
+		return NewError(ErrCodeIOFailure, "unable to release the address", err)
+	}
+
+	return nil
+}
+
+// deleteHostInterface deletes the host side of the veth pair, which removes the container side & the routes as well.
+func deleteHostInterface(args *Args) error {
+	link, err := netlink.LinkByName(HostInterfaceName(args.ContainerID, args.IfName))
+	if err != nil {
+		if errors.As(err, &netlink.LinkNotFoundError{}) {
+			return nil
+		}
+
+		return err
+	}
+
+	return netlink.LinkDel(link)
+}
+
+// Check verifies the pod interface, its address & the route on the host still exist.
+func Check(args *Args, conf *NetConf) error {
+	store, err := OpenStore(conf.DataDir, conf.Name, conf.subnet)
+	if err != nil {
+		return NewError(ErrCodeIOFailure, "unable to open the IPAM store", err)
+	}
+	defer store.Close()
+
+	ip, err := store.Lookup(args.ContainerID, args.IfName)
+	if err != nil {
+		return NewError(ErrCodeIOFailure, "unable to look up the address", err)
+	}
+
+	if ip == nil {
+		return NewError(ErrCodeUnknownContainer, "no address is allocated for the container", nil)
+	}
+
+	hostLink, err := netlink.LinkByName(HostInterfaceName(args.ContainerID, args.IfName))
+	if err != nil {
+		return NewError(ErrCodeInternal, "the host interface does not exist", err)
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{LinkIndex: hostLink.Attrs().Index, Dst: hostAddress(ip)}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST)
+	if err != nil {
+		return NewError(ErrCodeInternal, "unable to list the routes", err)
+	}
+
+	if len(routes) == 0 {
+		return NewError(ErrCodeInternal, fmt.Sprintf("the route to the pod address %s does not exist", ip), nil)
+	}
+
+	containerNS, err := netns.GetFromPath(args.NetNS)
+	if err != nil {
+		return NewError(ErrCodeInternal, "unable to open the network namespace", err)
+	}
+	defer containerNS.Close()
+
+	containerHandle, err := netlink.NewHandleAt(containerNS)
+	if err != nil {
+		return NewError(ErrCodeInternal, "unable to get a netlink handle for the container", err)
+	}
+	defer containerHandle.Delete()
+
+	containerLink, err := containerHandle.LinkByName(args.IfName)
+	if err != nil {
+		return NewError(ErrCodeInternal, "the container interface does not exist", err)
+	}
+
+	addresses, err := containerHandle.AddrList(containerLink, unix.AF_INET)
+	if err != nil {
+		return NewError(ErrCodeInternal, "unable to list the container addresses", err)
+	}
+
+	for _, addr := range addresses {
+		if addr.IP.Equal(ip) {
+			return nil
+		}
+	}
+
+	return NewError(ErrCodeInternal, fmt.Sprintf("the container interface is missing the address %s", ip), nil)
+}
@@ -0,0 +1,150 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+const (
+	// PluginType is the type used in the network configuration to refer to the plugin.
+	PluginType = "wireguard"
+	// DefaultDataDir is the directory the IP allocations get stored in.
+	DefaultDataDir = "/var/lib/cni/wireguard"
+
+	currentVersion = "0.4.0"
+)
+
+// SupportedVersions are the CNI spec versions the plugin implements.
+var SupportedVersions = []string{"0.3.0", "0.3.1", currentVersion}
+
+// NetConf is the network configuration passed to the plugin on stdin.
+type NetConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	// Subnet is the pod CIDR of the node, which the pod addresses get allocated from.
+	Subnet string `json:"subnet"`
+	// MTU of the pod interface. 0 keeps the kernel default.
+	MTU int `json:"mtu,omitempty"`
+	// DataDir is the directory the IP allocations get stored in.
+	DataDir string `json:"dataDir,omitempty"`
+
+	subnet *net.IPNet
+}
+
+// ParseNetConf parses & validates the network configuration.
+func ParseNetConf(data []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("unable to parse the network configuration: %w", err)
+	}
+
+	if conf.Type != PluginType {
+		return nil, fmt.Errorf("the type must be %s", PluginType)
+	}
+
+	if conf.Subnet == "" {
+		return nil, fmt.Errorf("the subnet must be set")
+	}
+
+	_, subnet, err := net.ParseCIDR(conf.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the subnet: %w", err)
+	}
+
+	if subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("the subnet %s is no IPv4 network", conf.Subnet)
+	}
+
+	conf.subnet = subnet
+
+	if conf.DataDir == "" {
+		conf.DataDir = DefaultDataDir
+	}
+
+	if conf.CNIVersion == "" {
+		conf.CNIVersion = currentVersion
+	}
+
+	return conf, nil
+}
+
+// Interface describes an interface created by the plugin.
+type Interface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// IPConfig describes an address assigned to an interface.
+type IPConfig struct {
+	Version   string `json:"version"`
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+// Route describes a route configured inside the container.
+type Route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// Result is returned by ADD.
+type Result struct {
+	CNIVersion string      `json:"cniVersion"`
+	Interfaces []Interface `json:"interfaces,omitempty"`
+	IPs        []IPConfig  `json:"ips,omitempty"`
+	Routes     []Route     `json:"routes,omitempty"`
+}
+
+// VersionResult is returned by VERSION.
+type VersionResult struct {
+	CNIVersion        string   `json:"cniVersion"`
+	SupportedVersions []string `json:"supportedVersions"`
+}
+
+// Error codes defined by the CNI spec.
+const (
+	ErrCodeIncompatibleVersion = 1
+	ErrCodeUnsupportedField    = 2
+	ErrCodeUnknownContainer    = 3
+	ErrCodeInvalidEnvironment  = 4
+	ErrCodeIOFailure           = 5
+	ErrCodeDecodingFailure     = 6
+	ErrCodeInvalidNetConfig    = 7
+	ErrCodeTryAgainLater       = 11
+	ErrCodeInternal            = 999
+)
+
+// Error is written to stdout if a command fails.
+type Error struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Details == "" {
+		return e.Msg
+	}
+
+	return fmt.Sprintf("%s: %s", e.Msg, e.Details)
+}
+
+// NewError returns an Error with the given code. The details contain err, if set.
+func NewError(code uint, msg string, err error) *Error {
+	e := &Error{
+		CNIVersion: currentVersion,
+		Code:       code,
+		Msg:        msg,
+	}
+
+	if err != nil {
+		e.Details = err.Error()
+	}
+
+	return e
+}
@@ -0,0 +1,68 @@
+package cni
+
+import (
+	"fmt"
+	"testing"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func TestParseNetConf(t *testing.T) {
+	tests := []struct {
+		name         string
+		conf         string
+		expectedErr  string
+		expectedConf string
+	}{
+		{
+			name:         "valid config",
+			conf:         `{"cniVersion": "0.3.1", "name": "wg", "type": "wireguard", "subnet": "10.244.1.0/24", "mtu": 1420}`,
+			expectedErr:  "<nil>",
+			expectedConf: "0.3.1 wg 10.244.1.0/24 1420 /var/lib/cni/wireguard",
+		},
+		{
+			name:         "defaults",
+			conf:         `{"name": "wg", "type": "wireguard", "subnet": "10.244.1.0/24", "dataDir": "/tmp/ipam"}`,
+			expectedErr:  "<nil>",
+			expectedConf: "0.4.0 wg 10.244.1.0/24 0 /tmp/ipam",
+		},
+		{
+			name:        "wrong type",
+			conf:        `{"name": "wg", "type": "bridge", "subnet": "10.244.1.0/24"}`,
+			expectedErr: "the type must be wireguard",
+		},
+		{
+			name:        "missing subnet",
+			conf:        `{"name": "wg", "type": "wireguard"}`,
+			expectedErr: "the subnet must be set",
+		},
+		{
+			name:        "IPv6 subnet",
+			conf:        `{"name": "wg", "type": "wireguard", "subnet": "fd00::/64"}`,
+			expectedErr: "the subnet fd00::/64 is no IPv4 network",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf, err := ParseNetConf([]byte(test.conf))
+			testhelper.CompareStrings(t, test.expectedErr, fmt.Sprint(err))
+
+			if err != nil {
+				return
+			}
+
+			testhelper.CompareStrings(t, test.expectedConf, fmt.Sprintf("%s %s %s %d %s", conf.CNIVersion, conf.Name, conf.subnet, conf.MTU, conf.DataDir))
+		})
+	}
+}
+
+func TestHostInterfaceName(t *testing.T) {
+	name := HostInterfaceName("8b2d6a1f0c", "eth0")
+
+	if len(name) > 15 {
+		t.Errorf("interface name %s exceeds the kernel limit of 15 characters", name)
+	}
+
+	testhelper.CompareStrings(t, name, HostInterfaceName("8b2d6a1f0c", "eth0"))
+}
@@ -2,6 +2,7 @@ package cniconfig
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -9,68 +10,168 @@ import (
 	"path"
 	"text/template"
 
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
 )
 
 type tplData struct {
 	PodCIDR     string
 	NodePodCIDR string
+	// NodePodCIDRs contains all pod CIDRs of the node. It contains one network per IP family on dual-stack clusters.
+	NodePodCIDRs []string
+	// NodePodCIDRv4 & NodePodCIDRv6 contain the pod CIDR of the node for the IP family. Empty if the node has none.
+	NodePodCIDRv4 string
+	NodePodCIDRv6 string
+	// DualStack is true if the node has a pod CIDR for both IP families.
+	DualStack bool
+	// ServiceCIDR is the network of the cluster services. Empty if not configured.
+	ServiceCIDR string
 	MTU         int
+	// NetNS contains the path to the network namespace of the WireGuard interface.
+	// Empty if the interface lives in the host namespace.
+	NetNS string
+
+	NodeName        string
+	NodeLabels      map[string]string
+	NodeAnnotations map[string]string
+	// InterfaceName is the name of the WireGuard interface.
+	InterfaceName string
+	// TunnelIP is the address of the WireGuard interface.
+	TunnelIP string
+	// GatewayIP is the first usable address of the node pod CIDR.
+	GatewayIP string
 }
 
-func (r *Reconciler) writeCNIConfig(log *zap.Logger, node *corev1.Node, mtu int) error {
-	_, nodePodCidr, err := net.ParseCIDR(node.Spec.PodCIDR)
+func (r *Reconciler) templateData(node *corev1.Node, mtu int) (tplData, error) {
+	_, nodePodCidr, err := net.ParseCIDR(kubernetes.PodCIDR(node))
 	if err != nil {
-		return fmt.Errorf("unable to parse node pod cidr: %w", err)
+		return tplData{}, fmt.Errorf("unable to parse node pod cidr: %w", err)
 	}
 
-	data := tplData{
-		PodCIDR:     r.podNet.String(),
-		NodePodCIDR: nodePodCidr.String(),
-		MTU:         mtu,
+	tunnelIP, err := kubernetes.TunnelAddress(node)
+	if err != nil {
+		return tplData{}, err
 	}
 
-	files, err := ioutil.ReadDir(path.Clean(r.cni.TemplateDir))
+	gatewayIP, err := kubernetes.GatewayAddress(node)
 	if err != nil {
-		return fmt.Errorf("unable to list template files: %w", err)
+		return tplData{}, err
+	}
+
+	data := tplData{
+		PodCIDR:         r.podNet.String(),
+		NodePodCIDR:     nodePodCidr.String(),
+		ServiceCIDR:     r.serviceCIDR,
+		MTU:             mtu,
+		NetNS:           r.namespace.Path(),
+		NodeName:        node.Name,
+		NodeLabels:      node.Labels,
+		NodeAnnotations: node.Annotations,
+		InterfaceName:   r.interfaceName,
+		TunnelIP:        tunnelIP.String(),
+		GatewayIP:       gatewayIP.String(),
 	}
 
-	for _, file := range files {
-		sourceFilename := path.Join(r.cni.TemplateDir, file.Name())
-		// ioutil.ReadDir uses LState which does not follow symlinks - So symlinked directories will return false on IsDir
-		fileInfo, err := os.Stat(sourceFilename)
+	for _, podCIDR := range kubernetes.PodCIDRs(node) {
+		_, network, err := net.ParseCIDR(podCIDR)
 		if err != nil {
-			return fmt.Errorf("unable to check file '%s': %w", sourceFilename, err)
+			return tplData{}, fmt.Errorf("unable to parse node pod cidr: %w", err)
 		}
 
-		if fileInfo.IsDir() {
-			continue
+		data.NodePodCIDRs = append(data.NodePodCIDRs, network.String())
+
+		if network.IP.To4() != nil {
+			data.NodePodCIDRv4 = network.String()
+		} else {
+			data.NodePodCIDRv6 = network.String()
 		}
+	}
+
+	data.DualStack = data.NodePodCIDRv4 != "" && data.NodePodCIDRv6 != ""
+
+	return data, nil
+}
 
-		targetFilename := path.Join(r.cni.TargetDir, fileInfo.Name())
-		if err := templateFile(log, sourceFilename, targetFilename, data); err != nil {
-			return fmt.Errorf("unable to template file '%s': %w", sourceFilename, err)
+// reportInvalidTemplates emits an event for each template, whose failure differs from the last reported one.
+// As the reconcile gets retried periodically, emitting it every time would flood the events of the node.
+func (r *Reconciler) reportInvalidTemplates(node *corev1.Node, invalid map[string]string) {
+	for name, message := range invalid {
+		if r.invalidTemplates[name] == message {
+			continue
 		}
+
+		r.recorder.Eventf(node, corev1.EventTypeWarning, eventReasonInvalidConfig, "Not writing CNI config %s: %s", name, message)
 	}
 
-	return nil
+	r.invalidTemplates = invalid
 }
 
-func templateFile(parentLog *zap.Logger, sourceFilename, targetFilename string, data tplData) error {
-	log := parentLog.With(
-		zap.String("template_source", sourceFilename),
-		zap.String("template_target", targetFilename),
+func (r *Reconciler) writeCNIConfig(ctx context.Context, log *zap.Logger, node *corev1.Node, mtu int) error {
+	data, err := r.templateData(node, mtu)
+	if err != nil {
+		return err
+	}
+
+	cniTemplates, err := r.templates.templates(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	owned, err := readOwnedFiles(r.cni.TargetDir)
+	if err != nil {
+		return err
+	}
+
+	var (
+		combinedErr error
+		invalid     = map[string]string{}
+		templates   = map[string]bool{}
 	)
 
-	content, err := ioutil.ReadFile(sourceFilename)
+	for _, tpl := range cniTemplates {
+		templates[tpl.name] = true
+
+		targetFilename := path.Join(r.cni.TargetDir, tpl.name)
+		if err := templateFile(log, tpl, targetFilename, r.cni.BinDir, data); err != nil {
+			// The last good file stays in place. Other templates are still rendered.
+			invalid[tpl.name] = err.Error()
+			r.metrics.renderFailures.WithLabelValues(tpl.name).Inc()
+
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to template file '%s': %w", tpl.name, err))
+
+			continue
+		}
+
+		owned[tpl.name] = true
+	}
+
+	r.metrics.invalidTemplates.Set(float64(len(invalid)))
+	r.reportInvalidTemplates(node, invalid)
+
+	owned, err = removeStaleFiles(log, r.cni.TargetDir, owned, templates)
 	if err != nil {
-		return fmt.Errorf("reading file failed: %w", err)
+		combinedErr = multierr.Append(combinedErr, err)
+	}
+
+	if err := writeOwnedFiles(r.cni.TargetDir, owned); err != nil {
+		combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to write the ownership marker: %w", err))
 	}
 
-	log.Debug("successfully read template file")
+	return combinedErr
+}
 
-	tpl, err := template.New(path.Base(sourceFilename)).Parse(string(content))
+// templateFile renders the template and writes the result to the target file.
+// Network configurations get validated first, so an invalid result never replaces a working config.
+func templateFile(parentLog *zap.Logger, source cniTemplate, targetFilename, binDir string, data tplData) error {
+	log := parentLog.With(
+		zap.String("template_source", source.name),
+		zap.String("template_target", targetFilename),
+	)
+
+	tpl, err := template.New(source.name).Funcs(templateFuncs()).Parse(source.content)
 	if err != nil {
 		return fmt.Errorf("failed to create template: %w", err)
 	}
@@ -84,6 +185,12 @@ func templateFile(parentLog *zap.Logger, sourceFilename, targetFilename string,
 
 	log.Debug("successfully executed the template")
 
+	if isNetworkConfig(targetFilename) {
+		if err := validateNetworkConfig(targetFilename, output.Bytes(), binDir); err != nil {
+			return fmt.Errorf("rendered an invalid network configuration: %w", err)
+		}
+	}
+
 	currentContent, err := ioutil.ReadFile(targetFilename)
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("reading file failed: %w", err)
@@ -97,7 +204,7 @@ func templateFile(parentLog *zap.Logger, sourceFilename, targetFilename string,
 
 	log.Info("CNI config does not match desired config, will override it")
 
-	if err := ioutil.WriteFile(targetFilename, output.Bytes(), 0o644); err != nil {
+	if err := writeFileAtomic(targetFilename, output.Bytes(), 0o644); err != nil {
 		return fmt.Errorf("failed to write CNI file: %w", err)
 	}
 
@@ -4,12 +4,17 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"testing"
 
 	"go.uber.org/zap/zaptest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 
 	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/namespace"
 )
 
 func TestTemplateFile(t *testing.T) {
@@ -22,11 +27,24 @@ func TestTemplateFile(t *testing.T) {
 	}{
 		{
 			name: "simple template",
+			tpl:  `{"cniVersion": "0.4.0", "name": "wg", "type": "wireguard", "subnet": "{{ .NodePodCIDR }}"}`,
+			data: tplData{
+				NodePodCIDR: "10.244.1.0/24",
+			},
+			expectedResult: `{"cniVersion": "0.4.0", "name": "wg", "type": "wireguard", "subnet": "10.244.1.0/24"}`,
+		},
+		{
+			name: "invalid JSON",
 			tpl:  "Foo {{ .PodCIDR }} Bar",
 			data: tplData{
 				PodCIDR: "10.244.1.0/24",
 			},
-			expectedResult: "Foo 10.244.1.0/24 Bar",
+			expectedErr: errors.New(`rendered an invalid network configuration: invalid JSON: invalid character 'F' looking for beginning of value`),
+		},
+		{
+			name:        "missing cniVersion",
+			tpl:         `{"name": "wg", "type": "wireguard"}`,
+			expectedErr: errors.New(`rendered an invalid network configuration: cniVersion must be set`),
 		},
 		{
 			name: "broken template",
@@ -40,15 +58,7 @@ func TestTemplateFile(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			// We cant use ioutil.TempFile() here because we need to have stable filenames to test the log output
-			srcFile, err := os.OpenFile("/tmp/wireguard-controller-test-tpl.conf", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer os.Remove(srcFile.Name())
-			if _, err := srcFile.Write([]byte(test.tpl)); err != nil {
-				t.Fatal(err)
-			}
+			source := cniTemplate{name: "wireguard-controller-test-tpl.conf", content: test.tpl}
 
 			// We cant use ioutil.TempFile() here because we need to have stable filenames to test the log output
 			targetFile, err := os.OpenFile("/tmp/wireguard-controller-test.conf", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
@@ -57,7 +67,7 @@ func TestTemplateFile(t *testing.T) {
 			}
 			defer os.Remove(targetFile.Name())
 
-			err = templateFile(zaptest.NewLogger(t), srcFile.Name(), targetFile.Name(), test.data)
+			err = templateFile(zaptest.NewLogger(t), source, targetFile.Name(), "", test.data)
 			if fmt.Sprint(err) != fmt.Sprint(test.expectedErr) {
 				t.Error(err)
 			}
@@ -74,3 +84,62 @@ func TestTemplateFile(t *testing.T) {
 		})
 	}
 }
+
+func TestTemplateData(t *testing.T) {
+	_, podNet, _ := net.ParseCIDR("10.244.0.0/16")
+	r := &Reconciler{
+		interfaceName: "wg-kube",
+		namespace:     namespace.New(""),
+		podNet:        podNet,
+		serviceCIDR:   "10.96.0.0/12",
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node1",
+			Labels: map[string]string{"pool": "edge"},
+		},
+		Spec: corev1.NodeSpec{
+			PodCIDR:  "10.244.1.0/24",
+			PodCIDRs: []string{"10.244.1.0/24", "fd00:1::/64"},
+		},
+	}
+
+	data, err := r.templateData(node, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testhelper.CompareStrings(t, "node1 edge wg-kube 10.244.1.0 10.244.1.1 10.96.0.0/12 1420", fmt.Sprintf("%s %s %s %s %s %s %d",
+		data.NodeName, data.NodeLabels["pool"], data.InterfaceName, data.TunnelIP, data.GatewayIP, data.ServiceCIDR, data.MTU))
+	testhelper.CompareStrings(t, "10.244.1.0/24 fd00:1::/64 true [10.244.1.0/24 fd00:1::/64]", fmt.Sprintf("%s %s %t %v",
+		data.NodePodCIDRv4, data.NodePodCIDRv6, data.DualStack, data.NodePodCIDRs))
+}
+
+func TestReportInvalidTemplates(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := &Reconciler{recorder: recorder}
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+
+	r.reportInvalidTemplates(node, map[string]string{"10-wg.conflist": "broken"})
+	// Same failure again
+	r.reportInvalidTemplates(node, map[string]string{"10-wg.conflist": "broken"})
+	// Changed failure
+	r.reportInvalidTemplates(node, map[string]string{"10-wg.conflist": "still broken"})
+	// Fixed & broken again
+	r.reportInvalidTemplates(node, map[string]string{})
+	r.reportInvalidTemplates(node, map[string]string{"10-wg.conflist": "still broken"})
+
+	close(recorder.Events)
+
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+
+	testhelper.CompareStrings(t, fmt.Sprint([]string{
+		"Warning InvalidCNIConfig Not writing CNI config 10-wg.conflist: broken",
+		"Warning InvalidCNIConfig Not writing CNI config 10-wg.conflist: still broken",
+		"Warning InvalidCNIConfig Not writing CNI config 10-wg.conflist: still broken",
+	}), fmt.Sprint(events))
+}
@@ -5,47 +5,118 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	ctrlsource "sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/mrincompetent/wireguard-controller/pkg/source"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/namespace"
 )
 
 const (
 	name = "cni_config_controller"
+
+	eventReasonInvalidConfig = "InvalidCNIConfig"
+	eventReasonMeshDegraded  = "MeshDegraded"
 )
 
 func Add(
 	mgr ctrl.Manager,
 	log *zap.Logger,
 	cniTemplateDir,
+	cniTemplateNamespace,
+	cniTemplateSelector,
 	cniConfigPath,
-	interfaceName string,
-	podNet *net.IPNet,
+	cniBinDir,
+	interfaceName,
+	vxlanInterfaceName string,
+	ns *namespace.Namespace,
+	podNetStore PodNetworkStore,
+	serviceCIDR,
 	nodeName string,
+	readinessStore ReadinessStore,
+	readinessGate,
+	removeOnDegraded bool,
 	metricFactory promauto.Factory,
 ) error {
+	m := &metrics{
+		renderFailures: metricFactory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cni_config_render_failures_total",
+				Help: "Number of times a CNI config template could not be rendered or produced an invalid network configuration.",
+			},
+			[]string{"template"},
+		),
+		invalidTemplates: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "cni_config_invalid_templates",
+				Help: "Number of CNI config templates, which failed during the last reconcile.",
+			},
+		),
+		meshReady: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "cni_config_mesh_ready",
+				Help: "1 if the mesh is ready and the CNI config gets written, 0 otherwise.",
+			},
+		),
+	}
+
+	var (
+		templates          templateSource = &dirTemplateSource{dir: cniTemplateDir}
+		configMapTemplates *configMapTemplateSource
+	)
+
+	// Templates get read from ConfigMaps through the cache if a selector is set. The directory is only used otherwise.
+	if cniTemplateSelector != "" {
+		selector, err := labels.Parse(cniTemplateSelector)
+		if err != nil {
+			return fmt.Errorf("unable to parse the template ConfigMap selector: %w", err)
+		}
+
+		configMapTemplates = &configMapTemplateSource{
+			client:    mgr.GetClient(),
+			namespace: cniTemplateNamespace,
+			selector:  selector,
+		}
+		templates = configMapTemplates
+	}
+
 	options := controller.Options{
 		MaxConcurrentReconciles: 1,
 		Reconciler: &Reconciler{
-			Client:        mgr.GetClient(),
-			log:           log.Named(name),
-			interfaceName: interfaceName,
-			nodeName:      nodeName,
-			podNet:        podNet,
+			Client:             mgr.GetClient(),
+			templates:          templates,
+			log:                log.Named(name),
+			interfaceName:      interfaceName,
+			vxlanInterfaceName: vxlanInterfaceName,
+			namespace:          ns,
+			nodeName:           nodeName,
+			podNetStore:        podNetStore,
+			serviceCIDR:        serviceCIDR,
+			recorder:           mgr.GetEventRecorderFor(name),
+			readiness:          readinessStore,
+			readinessGate:      readinessGate,
+			removeOnDegraded:   removeOnDegraded,
+			metrics:            m,
 			cni: CNIConfig{
-				TargetDir:   cniConfigPath,
-				TemplateDir: cniTemplateDir,
+				TargetDir: cniConfigPath,
+				BinDir:    cniBinDir,
 			},
 		},
 	}
@@ -55,21 +126,89 @@ func Add(
 		return fmt.Errorf("failed to create new controller: %w", err)
 	}
 
+	if configMapTemplates != nil {
+		configMapPredicate := predicate.Funcs{
+			CreateFunc: func(e event.CreateEvent) bool {
+				return configMapTemplates.matches(e.Meta.GetNamespace(), e.Meta.GetLabels())
+			},
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				// A ConfigMap, which lost the selected labels, must trigger a reconcile as well to remove its configs
+				return configMapTemplates.matches(e.MetaOld.GetNamespace(), e.MetaOld.GetLabels()) ||
+					configMapTemplates.matches(e.MetaNew.GetNamespace(), e.MetaNew.GetLabels())
+			},
+			DeleteFunc: func(e event.DeleteEvent) bool {
+				return configMapTemplates.matches(e.Meta.GetNamespace(), e.Meta.GetLabels())
+			},
+			GenericFunc: func(e event.GenericEvent) bool {
+				return configMapTemplates.matches(e.Meta.GetNamespace(), e.Meta.GetLabels())
+			},
+		}
+
+		if err := c.Watch(&ctrlsource.Kind{Type: &corev1.ConfigMap{}}, source.EnqueueStaticRequest(), configMapPredicate); err != nil {
+			return fmt.Errorf("failed to watch the template ConfigMaps: %w", err)
+		}
+
+		// The node labels decide which ConfigMaps apply to the node
+		ownNodePredicate := predicate.Funcs{
+			CreateFunc:  func(e event.CreateEvent) bool { return e.Meta.GetName() == nodeName },
+			UpdateFunc:  func(e event.UpdateEvent) bool { return e.MetaNew.GetName() == nodeName },
+			DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+			GenericFunc: func(e event.GenericEvent) bool { return e.Meta.GetName() == nodeName },
+		}
+
+		if err := c.Watch(&ctrlsource.Kind{Type: &corev1.Node{}}, source.EnqueueStaticRequest(), ownNodePredicate); err != nil {
+			return fmt.Errorf("failed to watch the own node: %w", err)
+		}
+	}
+
 	return c.Watch(source.NewIntervalSource(5*time.Second), &handler.EnqueueRequestForObject{})
 }
 
 type CNIConfig struct {
-	TemplateDir string
-	TargetDir   string
+	TargetDir string
+	// BinDir contains the CNI plugins. Network configurations referencing plugins, which are not installed, are rejected.
+	// Empty disables the check.
+	BinDir string
+}
+
+// ReadinessStore decides whether the mesh is ready for pods & receives whether the CNI config is in place.
+type ReadinessStore interface {
+	Ready() (bool, []string)
+	SetCNIConfigWritten(written bool)
+}
+
+// PodNetworkStore returns the cluster pod CIDR. It's nil until it got discovered.
+// The Reconciler reads it once at the start of every reconcile, so changes apply without a restart.
+type PodNetworkStore interface {
+	Get() *net.IPNet
 }
 
 type Reconciler struct {
 	client.Client
 	log           *zap.Logger
 	cni           CNIConfig
+	templates     templateSource
 	interfaceName string
-	podNet        *net.IPNet
-	nodeName      string
+	// vxlanInterfaceName is the VXLAN interface pod traffic might leave through as well. Empty if VXLAN is disabled.
+	vxlanInterfaceName string
+	namespace          *namespace.Namespace
+	podNetStore        PodNetworkStore
+	podNet             *net.IPNet
+	serviceCIDR        string
+	recorder           record.EventRecorder
+	metrics            *metrics
+	nodeName           string
+	readiness          ReadinessStore
+	// readinessGate only writes the CNI config once the mesh is ready
+	readinessGate bool
+	// removeOnDegraded removes a written CNI config again once the mesh degrades
+	removeOnDegraded bool
+	// meshReady is true if the gate was open during the last reconcile
+	meshReady bool
+	// degraded is true if the mesh degraded after the CNI config got written
+	degraded bool
+	// invalidTemplates contains the last reported failure of each invalid template, so events only get emitted when it changes.
+	invalidTemplates map[string]string
 }
 
 func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
@@ -77,7 +216,20 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	log := r.log.With(zap.String("sync_id", rand.String(12)))
 	log.Debug("Processing")
 
-	link, err := netlink.LinkByName(r.interfaceName)
+	r.podNet = r.podNetStore.Get()
+	if r.podNet == nil {
+		log.Debug("Skipping as the cluster pod CIDR is not known yet")
+
+		return ctrl.Result{}, nil
+	}
+
+	handle, err := r.namespace.Handle()
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to get a netlink handle: %w", err)
+	}
+	defer handle.Delete()
+
+	link, err := handle.LinkByName(r.interfaceName)
 	if err != nil {
 		// In case the interface was not created yet we requeue
 		if errors.As(err, &netlink.LinkNotFoundError{}) {
@@ -94,9 +246,88 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, fmt.Errorf("unable to load own node: %w", err)
 	}
 
-	if err := r.writeCNIConfig(log, node, link.Attrs().MTU); err != nil {
+	if !r.gateOpen(log, node) {
+		// Without a CNI config kubelet reports the node network as not ready, so no new pods get scheduled onto the node
+		r.readiness.SetCNIConfigWritten(false)
+
+		if err := r.removeCNIConfig(log); err != nil {
+			return ctrl.Result{}, fmt.Errorf("unable to remove the CNI config: %w", err)
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	mtu := link.Attrs().MTU
+
+	// Pods must fit their packets through every device they might get routed through
+	if r.vxlanInterfaceName != "" {
+		vxlanLink, err := handle.LinkByName(r.vxlanInterfaceName)
+		if err != nil {
+			if errors.As(err, &netlink.LinkNotFoundError{}) {
+				log.Debug("Skipping CNI config reconciling since the VXLAN link is not up yet")
+
+				return ctrl.Result{}, nil
+			}
+
+			return ctrl.Result{}, fmt.Errorf("unable to get VXLAN interface details: %w", err)
+		}
+
+		if vxlanLink.Attrs().MTU < mtu {
+			mtu = vxlanLink.Attrs().MTU
+		}
+	}
+
+	if err := r.writeCNIConfig(ctx, log, node, mtu); err != nil {
+		r.readiness.SetCNIConfigWritten(false)
+
 		return ctrl.Result{}, fmt.Errorf("unable to write CNI config: %w", err)
 	}
 
+	r.readiness.SetCNIConfigWritten(true)
+
 	return ctrl.Result{}, nil
 }
+
+// gateOpen returns true if the CNI config may be written. Transitions get logged & reported.
+func (r *Reconciler) gateOpen(log *zap.Logger, node *corev1.Node) bool {
+	if !r.readinessGate {
+		return true
+	}
+
+	ready, failing := r.readiness.Ready()
+
+	// A degraded mesh usually affects every node at once, so removing the config would stop pods from starting cluster wide.
+	// The config gets kept by default and the not ready taint, which is re-applied by the node controller, keeps new pods away instead.
+	// removeOnDegraded is always set if the taint is disabled.
+	if r.meshReady && !r.removeOnDegraded {
+		switch {
+		case !ready && !r.degraded:
+			log.Warn("Mesh degraded. Keeping the CNI config", zap.Strings("failing_checks", failing))
+			r.recorder.Eventf(node, corev1.EventTypeWarning, eventReasonMeshDegraded, "The mesh degraded: %s", strings.Join(failing, ", "))
+			r.metrics.meshReady.Set(0)
+		case ready && r.degraded:
+			log.Info("Mesh recovered")
+			r.metrics.meshReady.Set(1)
+		}
+
+		r.degraded = !ready
+
+		return true
+	}
+
+	switch {
+	case ready && !r.meshReady:
+		log.Info("Mesh is ready. Writing the CNI config")
+		r.metrics.meshReady.Set(1)
+	case !ready && r.meshReady:
+		log.Warn("Mesh degraded. Removing the CNI config", zap.Strings("failing_checks", failing))
+		r.recorder.Eventf(node, corev1.EventTypeWarning, eventReasonMeshDegraded, "Removing the CNI config as the mesh degraded: %s", strings.Join(failing, ", "))
+		r.metrics.meshReady.Set(0)
+	case !ready:
+		log.Debug("Waiting for the mesh to become ready", zap.Strings("failing_checks", failing))
+	}
+
+	r.meshReady = ready
+
+	return ready
+}
@@ -0,0 +1,157 @@
+package cniconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs returns the functions available in the CNI config templates.
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"nthHost":   nthHost,
+		"subnet":    subnet,
+		"prefixLen": prefixLen,
+		"contains":  cidrContains,
+		"json":      toJSON,
+		"default":   defaultValue,
+		"join":      strings.Join,
+	}
+}
+
+// nthHost returns the n-th address of the network. Negative values count from the end, -1 being the last address.
+func nthHost(cidr string, n int) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("nthHost: %w", err)
+	}
+
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+
+	offset := big.NewInt(int64(n))
+	if n < 0 {
+		offset.Add(size, offset)
+	}
+
+	if offset.Sign() < 0 || offset.Cmp(size) >= 0 {
+		return "", fmt.Errorf("nthHost: %s has no address %d", cidr, n)
+	}
+
+	return toIP(new(big.Int).Add(toInt(network.IP), offset), len(network.IP)).String(), nil
+}
+
+// subnet splits the network into subnets, which are newBits longer, and returns the num-th of them.
+func subnet(cidr string, newBits, num int) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("subnet: %w", err)
+	}
+
+	ones, bits := network.Mask.Size()
+	if newBits < 0 || ones+newBits > bits {
+		return "", fmt.Errorf("subnet: cannot extend the prefix of %s by %d bits", cidr, newBits)
+	}
+
+	if num < 0 || big.NewInt(int64(num)).Cmp(new(big.Int).Lsh(big.NewInt(1), uint(newBits))) >= 0 {
+		return "", fmt.Errorf("subnet: %s has no subnet %d with %d additional bits", cidr, num, newBits)
+	}
+
+	offset := new(big.Int).Lsh(big.NewInt(int64(num)), uint(bits-ones-newBits))
+	result := net.IPNet{
+		IP:   toIP(new(big.Int).Add(toInt(network.IP), offset), len(network.IP)),
+		Mask: net.CIDRMask(ones+newBits, bits),
+	}
+
+	return result.String(), nil
+}
+
+// prefixLen returns the prefix length of the network.
+func prefixLen(cidr string) (int, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, fmt.Errorf("prefixLen: %w", err)
+	}
+
+	ones, _ := network.Mask.Size()
+
+	return ones, nil
+}
+
+// cidrContains returns true if the address or network lies within the network.
+func cidrContains(cidr, addressOrCIDR string) (bool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, fmt.Errorf("contains: %w", err)
+	}
+
+	ip := net.ParseIP(addressOrCIDR)
+	if ip == nil {
+		var other *net.IPNet
+
+		if ip, other, err = net.ParseCIDR(addressOrCIDR); err != nil {
+			return false, fmt.Errorf("contains: '%s' is neither an address nor a network", addressOrCIDR)
+		}
+
+		last, err := nthHost(other.String(), -1)
+		if err != nil {
+			return false, err
+		}
+
+		return network.Contains(ip) && network.Contains(net.ParseIP(last)), nil
+	}
+
+	return network.Contains(ip), nil
+}
+
+// toJSON encodes the value as JSON. Strings get quoted & escaped, so they can safely be embedded into the config.
+func toJSON(value interface{}) (string, error) {
+	out, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("json: %w", err)
+	}
+
+	return string(out), nil
+}
+
+// defaultValue returns value, unless it's empty. Then def gets returned.
+// Meant to be used in pipelines: {{ index .NodeLabels "mtu" | default "1420" }}.
+func defaultValue(def, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if v.Len() == 0 {
+			return def
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return def
+		}
+	}
+
+	return value
+}
+
+func toInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	return new(big.Int).SetBytes(ip)
+}
+
+func toIP(i *big.Int, length int) net.IP {
+	ip := make(net.IP, length)
+	b := i.Bytes()
+	copy(ip[length-len(b):], b)
+
+	return ip
+}
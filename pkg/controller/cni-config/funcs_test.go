@@ -0,0 +1,103 @@
+package cniconfig
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"text/template"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	tests := []struct {
+		name           string
+		tpl            string
+		data           interface{}
+		expectedResult string
+		expectedErr    string
+	}{
+		{
+			name:           "first host",
+			tpl:            `{{ nthHost "10.244.1.0/24" 1 }}`,
+			expectedResult: "10.244.1.1",
+		},
+		{
+			name:           "last host",
+			tpl:            `{{ nthHost "10.244.1.0/24" -2 }}`,
+			expectedResult: "10.244.1.254",
+		},
+		{
+			name:           "IPv6 host",
+			tpl:            `{{ nthHost "fd00::/64" 10 }}`,
+			expectedResult: "fd00::a",
+		},
+		{
+			name:        "host out of range",
+			tpl:         `{{ nthHost "10.244.1.0/30" 4 }}`,
+			expectedErr: `template: test:1:3: executing "test" at <nthHost "10.244.1.0/30" 4>: error calling nthHost: nthHost: 10.244.1.0/30 has no address 4`,
+		},
+		{
+			name:           "subnet",
+			tpl:            `{{ subnet "10.244.0.0/16" 8 3 }}`,
+			expectedResult: "10.244.3.0/24",
+		},
+		{
+			name:        "subnet out of range",
+			tpl:         `{{ subnet "10.244.0.0/16" 1 2 }}`,
+			expectedErr: `template: test:1:3: executing "test" at <subnet "10.244.0.0/16" 1 2>: error calling subnet: subnet: 10.244.0.0/16 has no subnet 2 with 1 additional bits`,
+		},
+		{
+			name:           "prefix length",
+			tpl:            `{{ prefixLen "10.244.0.0/16" }}`,
+			expectedResult: "16",
+		},
+		{
+			name:           "contains",
+			tpl:            `{{ contains "10.244.0.0/16" "10.244.3.0/24" }} {{ contains "10.244.0.0/16" "10.245.0.1" }} {{ contains "10.244.0.0/24" "10.244.0.0/16" }}`,
+			expectedResult: "true false false",
+		},
+		{
+			name:           "json",
+			tpl:            `{{ json .Value }}`,
+			data:           map[string]string{"Value": `a "quoted" value`},
+			expectedResult: `"a \"quoted\" value"`,
+		},
+		{
+			name:           "default",
+			tpl:            `{{ .Set | default "fallback" }} {{ .Unset | default "fallback" }}`,
+			data:           map[string]string{"Set": "value"},
+			expectedResult: "value fallback",
+		},
+		{
+			name:           "join",
+			tpl:            `{{ join .Values "," }}`,
+			data:           map[string][]string{"Values": {"a", "b"}},
+			expectedResult: "a,b",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tpl, err := template.New("test").Funcs(templateFuncs()).Parse(test.tpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output := &bytes.Buffer{}
+			err = tpl.Execute(output, test.data)
+
+			if test.expectedErr != "" {
+				testhelper.CompareStrings(t, test.expectedErr, fmt.Sprint(err))
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testhelper.CompareStrings(t, test.expectedResult, output.String())
+		})
+	}
+}
@@ -0,0 +1,9 @@
+package cniconfig
+
+import "github.com/prometheus/client_golang/prometheus"
+
+type metrics struct {
+	renderFailures   *prometheus.CounterVec
+	invalidTemplates prometheus.Gauge
+	meshReady        prometheus.Gauge
+}
@@ -0,0 +1,150 @@
+package cniconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// ownershipMarker records the files in the target directory, which got written by the controller.
+// It's a hidden file, so the container runtime does not pick it up as network configuration.
+const ownershipMarker = ".wireguard-controller-owned"
+
+// readOwnedFiles returns the names of the files the controller wrote into the directory.
+func readOwnedFiles(dir string) (map[string]bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ownershipMarker))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]bool{}, nil
+		}
+
+		return nil, fmt.Errorf("unable to read the ownership marker: %w", err)
+	}
+
+	owned := map[string]bool{}
+
+	for _, name := range strings.Split(string(content), "\n") {
+		name = strings.TrimSpace(name)
+		// Never touch files outside of the directory, even if the marker got tampered with
+		if name == "" || name != filepath.Base(name) {
+			continue
+		}
+
+		owned[name] = true
+	}
+
+	return owned, nil
+}
+
+// writeOwnedFiles replaces the ownership marker.
+func writeOwnedFiles(dir string, owned map[string]bool) error {
+	names := make([]string, 0, len(owned))
+	for name := range owned {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	content := strings.Join(names, "\n")
+	if len(names) > 0 {
+		content += "\n"
+	}
+
+	current, err := ioutil.ReadFile(filepath.Join(dir, ownershipMarker))
+	if err == nil && string(current) == content {
+		return nil
+	}
+
+	return writeFileAtomic(filepath.Join(dir, ownershipMarker), []byte(content), 0o644)
+}
+
+// removeStaleFiles removes the owned files, whose template does not exist anymore.
+// The names of the files which are still owned get returned.
+func removeStaleFiles(log *zap.Logger, dir string, owned, templates map[string]bool) (map[string]bool, error) {
+	var combinedErr error
+
+	stillOwned := map[string]bool{}
+
+	for name := range owned {
+		if templates[name] {
+			stillOwned[name] = true
+
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to remove stale file '%s': %w", name, err))
+			// Keep the ownership, so we try again
+			stillOwned[name] = true
+
+			continue
+		}
+
+		log.Info("Removed CNI config as its template does not exist anymore", zap.String("file", name))
+	}
+
+	return stillOwned, combinedErr
+}
+
+// writeFileAtomic writes the content to a temporary file in the same directory and renames it afterwards.
+// Readers either see the old or the new content, never a partially written file.
+// The temporary file does not have a network configuration extension, so the container runtime ignores it.
+func writeFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create a temporary file: %w", err)
+	}
+	// Does nothing once the file got renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+
+		return fmt.Errorf("unable to write the temporary file: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+
+		return fmt.Errorf("unable to sync the temporary file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close the temporary file: %w", err)
+	}
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("unable to set the permissions of the temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("unable to move the temporary file into place: %w", err)
+	}
+
+	return nil
+}
+
+// removeCNIConfig removes all files the controller wrote into the target directory.
+func (r *Reconciler) removeCNIConfig(log *zap.Logger) error {
+	owned, err := readOwnedFiles(r.cni.TargetDir)
+	if err != nil {
+		return err
+	}
+
+	if len(owned) == 0 {
+		return nil
+	}
+
+	owned, err = removeStaleFiles(log, r.cni.TargetDir, owned, map[string]bool{})
+	if writeErr := writeOwnedFiles(r.cni.TargetDir, owned); writeErr != nil {
+		err = multierr.Append(err, fmt.Errorf("unable to write the ownership marker: %w", writeErr))
+	}
+
+	return err
+}
@@ -0,0 +1,90 @@
+package cniconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func TestRemoveStaleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 99-foreign.conf was not written by us and must never be removed
+	for _, name := range []string{"10-wg.conflist", "20-removed.conf", "99-foreign.conf"} {
+		if err := writeFileAtomic(filepath.Join(dir, name), []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writeOwnedFiles(dir, map[string]bool{"10-wg.conflist": true, "20-removed.conf": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	owned, err := readOwnedFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owned, err = removeStaleFiles(zaptest.NewLogger(t), dir, owned, map[string]bool{"10-wg.conflist": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeOwnedFiles(dir, owned); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+
+	sort.Strings(names)
+
+	// No temporary files must be left behind
+	testhelper.CompareStrings(t, ".wireguard-controller-owned,10-wg.conflist,99-foreign.conf", strings.Join(names, ","))
+
+	marker, err := ioutil.ReadFile(filepath.Join(dir, ownershipMarker))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testhelper.CompareStrings(t, "10-wg.conflist\n", string(marker))
+}
+
+func TestReadOwnedFilesIgnoresPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, ownershipMarker), []byte("10-wg.conflist\n../../etc/passwd\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	owned, err := readOwnedFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(owned) != 1 || !owned["10-wg.conflist"] {
+		t.Errorf("expected only 10-wg.conflist to be owned, got %v", owned)
+	}
+}
@@ -0,0 +1,133 @@
+package cniconfig
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnnotationKeyNodeSelector restricts a template ConfigMap to the nodes matching the label selector in its value.
+const AnnotationKeyNodeSelector = "wireguard/node-selector"
+
+// cniTemplate is a single CNI config template. Name is the filename of the rendered config.
+type cniTemplate struct {
+	name    string
+	content string
+}
+
+// templateSource provides the CNI config templates for a node.
+type templateSource interface {
+	templates(ctx context.Context, node *corev1.Node) ([]cniTemplate, error)
+}
+
+// dirTemplateSource reads the templates from a directory. Every file is a template.
+type dirTemplateSource struct {
+	dir string
+}
+
+func (s *dirTemplateSource) templates(_ context.Context, _ *corev1.Node) ([]cniTemplate, error) {
+	files, err := ioutil.ReadDir(path.Clean(s.dir))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list template files: %w", err)
+	}
+
+	var templates []cniTemplate
+
+	for _, file := range files {
+		sourceFilename := path.Join(s.dir, file.Name())
+		// ioutil.ReadDir uses LState which does not follow symlinks - So symlinked directories will return false on IsDir
+		fileInfo, err := os.Stat(sourceFilename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to check file '%s': %w", sourceFilename, err)
+		}
+
+		if fileInfo.IsDir() {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(sourceFilename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read template file '%s': %w", sourceFilename, err)
+		}
+
+		templates = append(templates, cniTemplate{name: fileInfo.Name(), content: string(content)})
+	}
+
+	return templates, nil
+}
+
+// configMapTemplateSource reads the templates from the ConfigMaps matching the selector. Every data key is a template.
+// ConfigMaps are applied in the order of their names, so a later ConfigMap overrides the templates of an earlier one.
+// This allows a generic ConfigMap for all nodes & a more specific one for a node pool.
+type configMapTemplateSource struct {
+	client    client.Reader
+	namespace string
+	selector  labels.Selector
+}
+
+func (s *configMapTemplateSource) templates(ctx context.Context, node *corev1.Node) ([]cniTemplate, error) {
+	configMaps := &corev1.ConfigMapList{}
+	if err := s.client.List(ctx, configMaps, client.InNamespace(s.namespace), client.MatchingLabelsSelector{Selector: s.selector}); err != nil {
+		return nil, fmt.Errorf("unable to list template ConfigMaps: %w", err)
+	}
+
+	return templatesFromConfigMaps(configMaps.Items, node)
+}
+
+// matches returns true if the ConfigMap gets selected by the source, no matter which nodes it applies to.
+func (s *configMapTemplateSource) matches(namespace string, configMapLabels map[string]string) bool {
+	return namespace == s.namespace && s.selector.Matches(labels.Set(configMapLabels))
+}
+
+// templatesFromConfigMaps returns the templates of all ConfigMaps, which apply to the node.
+// An invalid node selector fails the whole lookup, as the node might lose a config it should get otherwise.
+func templatesFromConfigMaps(configMaps []corev1.ConfigMap, node *corev1.Node) ([]cniTemplate, error) {
+	sort.Slice(configMaps, func(i, j int) bool {
+		return configMaps[i].Name < configMaps[j].Name
+	})
+
+	var (
+		combinedErr error
+		contents    = map[string]string{}
+	)
+
+	for _, configMap := range configMaps {
+		selector, err := labels.Parse(configMap.Annotations[AnnotationKeyNodeSelector])
+		if err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("invalid node selector on ConfigMap '%s/%s': %w", configMap.Namespace, configMap.Name, err))
+
+			continue
+		}
+
+		if !selector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+
+		for name, content := range configMap.Data {
+			contents[name] = content
+		}
+	}
+
+	if combinedErr != nil {
+		return nil, combinedErr
+	}
+
+	templates := make([]cniTemplate, 0, len(contents))
+	for name, content := range contents {
+		templates = append(templates, cniTemplate{name: name, content: content})
+	}
+
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].name < templates[j].name
+	})
+
+	return templates, nil
+}
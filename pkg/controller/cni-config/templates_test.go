@@ -0,0 +1,94 @@
+package cniconfig
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func TestTemplatesFromConfigMaps(t *testing.T) {
+	configMap := func(name, nodeSelector string, data map[string]string) corev1.ConfigMap {
+		cm := corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "kube-system",
+			},
+			Data: data,
+		}
+
+		if nodeSelector != "" {
+			cm.Annotations = map[string]string{AnnotationKeyNodeSelector: nodeSelector}
+		}
+
+		return cm
+	}
+
+	edgeNode := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"pool": "edge"}}}
+	coreNode := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{"pool": "core"}}}
+
+	tests := []struct {
+		name              string
+		configMaps        []corev1.ConfigMap
+		node              *corev1.Node
+		expectedTemplates string
+		expectedErr       error
+	}{
+		{
+			name: "no node selector",
+			configMaps: []corev1.ConfigMap{
+				configMap("cni-tpl", "", map[string]string{"10-wg.conflist": "all", "99-loopback.conf": "loopback"}),
+			},
+			node:              coreNode,
+			expectedTemplates: "10-wg.conflist=all 99-loopback.conf=loopback",
+		},
+		{
+			name: "node selector not matching",
+			configMaps: []corev1.ConfigMap{
+				configMap("cni-tpl", "", map[string]string{"10-wg.conflist": "all"}),
+				configMap("cni-tpl-edge", "pool=edge", map[string]string{"10-wg.conflist": "edge", "20-edge.conf": "edge"}),
+			},
+			node:              coreNode,
+			expectedTemplates: "10-wg.conflist=all",
+		},
+		{
+			name: "later ConfigMap overrides earlier one",
+			configMaps: []corev1.ConfigMap{
+				configMap("cni-tpl-edge", "pool=edge", map[string]string{"10-wg.conflist": "edge", "20-edge.conf": "edge"}),
+				configMap("cni-tpl", "", map[string]string{"10-wg.conflist": "all"}),
+			},
+			node:              edgeNode,
+			expectedTemplates: "10-wg.conflist=edge 20-edge.conf=edge",
+		},
+		{
+			name: "invalid node selector",
+			configMaps: []corev1.ConfigMap{
+				configMap("cni-tpl", "", map[string]string{"10-wg.conflist": "all"}),
+				configMap("cni-tpl-edge", "pool in edge", map[string]string{"10-wg.conflist": "edge"}),
+			},
+			node:        edgeNode,
+			expectedErr: errors.New(`invalid node selector on ConfigMap 'kube-system/cni-tpl-edge': unable to parse requirement: found 'edge' expected: '('`),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			templates, err := templatesFromConfigMaps(test.configMaps, test.node)
+			if fmt.Sprint(err) != fmt.Sprint(test.expectedErr) {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, tpl := range templates {
+				got = append(got, tpl.name+"="+tpl.content)
+			}
+
+			testhelper.CompareStrings(t, test.expectedTemplates, strings.Join(got, " "))
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package cniconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// supportedCNIVersions are the spec versions a network configuration may declare.
+var supportedCNIVersions = map[string]bool{
+	"0.1.0": true,
+	"0.2.0": true,
+	"0.3.0": true,
+	"0.3.1": true,
+	"0.4.0": true,
+	"1.0.0": true,
+}
+
+var (
+	ErrMissingCNIVersion = errors.New("cniVersion must be set")
+	ErrMissingName       = errors.New("name must be set")
+	ErrMissingType       = errors.New("type must be set")
+	ErrMissingPlugins    = errors.New("plugins must contain at least one plugin")
+	ErrMissingIPAMType   = errors.New("ipam.type must be set")
+)
+
+// isNetworkConfig returns true for the files the container runtime loads as network configuration.
+func isNetworkConfig(filename string) bool {
+	switch path.Ext(filename) {
+	case ".conf", ".conflist", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+type ipamConfig struct {
+	Type string `json:"type"`
+}
+
+type pluginConfig struct {
+	Type string      `json:"type"`
+	IPAM *ipamConfig `json:"ipam"`
+}
+
+// pluginTypes returns the plugin type & the type of its IPAM plugin, if it uses one.
+func (p *pluginConfig) pluginTypes() ([]string, error) {
+	if p.Type == "" {
+		return nil, ErrMissingType
+	}
+
+	if p.IPAM == nil {
+		return []string{p.Type}, nil
+	}
+
+	if p.IPAM.Type == "" {
+		return nil, ErrMissingIPAMType
+	}
+
+	return []string{p.Type, p.IPAM.Type}, nil
+}
+
+type networkConfig struct {
+	pluginConfig
+	CNIVersion string         `json:"cniVersion"`
+	Name       string         `json:"name"`
+	Plugins    []pluginConfig `json:"plugins"`
+}
+
+// validateNetworkConfig checks that the content is a usable network configuration or configuration list.
+// If binDir is set, all referenced plugins, including IPAM plugins, must exist in it.
+func validateNetworkConfig(filename string, content []byte, binDir string) error {
+	conf := &networkConfig{}
+	if err := json.Unmarshal(content, conf); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	if conf.CNIVersion == "" {
+		return ErrMissingCNIVersion
+	}
+
+	if !supportedCNIVersions[conf.CNIVersion] {
+		return fmt.Errorf("unsupported cniVersion %s", conf.CNIVersion)
+	}
+
+	if conf.Name == "" {
+		return ErrMissingName
+	}
+
+	var types []string
+
+	if path.Ext(filename) == ".conflist" {
+		if len(conf.Plugins) == 0 {
+			return ErrMissingPlugins
+		}
+
+		for i := range conf.Plugins {
+			pluginTypes, err := conf.Plugins[i].pluginTypes()
+			if err != nil {
+				return fmt.Errorf("plugin %d: %w", i, err)
+			}
+
+			types = append(types, pluginTypes...)
+		}
+	} else {
+		pluginTypes, err := conf.pluginTypes()
+		if err != nil {
+			return err
+		}
+
+		types = append(types, pluginTypes...)
+	}
+
+	if binDir == "" {
+		return nil
+	}
+
+	for _, pluginType := range types {
+		info, err := os.Stat(filepath.Join(binDir, pluginType))
+		if err != nil {
+			return fmt.Errorf("plugin %s is not installed in %s: %w", pluginType, binDir, err)
+		}
+
+		if info.IsDir() || info.Mode()&0o111 == 0 {
+			return fmt.Errorf("plugin %s in %s is not executable", pluginType, binDir)
+		}
+	}
+
+	return nil
+}
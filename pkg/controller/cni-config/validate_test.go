@@ -0,0 +1,106 @@
+package cniconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func TestValidateNetworkConfig(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "cni-bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+
+	for name, mode := range map[string]os.FileMode{"wireguard": 0o755, "portmap": 0o755, "not-executable": 0o644} {
+		if err := ioutil.WriteFile(filepath.Join(binDir, name), nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		filename    string
+		content     string
+		expectedErr string
+	}{
+		{
+			name:        "valid config",
+			filename:    "10-wg.conf",
+			content:     `{"cniVersion": "0.4.0", "name": "wg", "type": "wireguard"}`,
+			expectedErr: "<nil>",
+		},
+		{
+			name:        "valid config list",
+			filename:    "10-wg.conflist",
+			content:     `{"cniVersion": "0.4.0", "name": "wg", "plugins": [{"type": "wireguard"}, {"type": "portmap"}]}`,
+			expectedErr: "<nil>",
+		},
+		{
+			name:        "unsupported version",
+			filename:    "10-wg.conf",
+			content:     `{"cniVersion": "0.5.0", "name": "wg", "type": "wireguard"}`,
+			expectedErr: "unsupported cniVersion 0.5.0",
+		},
+		{
+			name:        "missing name",
+			filename:    "10-wg.conf",
+			content:     `{"cniVersion": "0.4.0", "type": "wireguard"}`,
+			expectedErr: "name must be set",
+		},
+		{
+			name:        "config list without plugins",
+			filename:    "10-wg.conflist",
+			content:     `{"cniVersion": "0.4.0", "name": "wg"}`,
+			expectedErr: "plugins must contain at least one plugin",
+		},
+		{
+			name:        "plugin without type",
+			filename:    "10-wg.conflist",
+			content:     `{"cniVersion": "0.4.0", "name": "wg", "plugins": [{"type": "wireguard"}, {}]}`,
+			expectedErr: "plugin 1: type must be set",
+		},
+		{
+			name:        "missing plugin",
+			filename:    "10-wg.conflist",
+			content:     `{"cniVersion": "0.4.0", "name": "wg", "plugins": [{"type": "bridge"}]}`,
+			expectedErr: fmt.Sprintf("plugin bridge is not installed in %s: stat %s: no such file or directory", binDir, filepath.Join(binDir, "bridge")),
+		},
+		{
+			name:        "valid IPAM plugin",
+			filename:    "10-wg.conf",
+			content:     `{"cniVersion": "0.4.0", "name": "wg", "type": "wireguard", "ipam": {"type": "portmap"}}`,
+			expectedErr: "<nil>",
+		},
+		{
+			name:        "missing IPAM plugin",
+			filename:    "10-wg.conflist",
+			content:     `{"cniVersion": "0.4.0", "name": "wg", "plugins": [{"type": "wireguard", "ipam": {"type": "host-local"}}]}`,
+			expectedErr: fmt.Sprintf("plugin host-local is not installed in %s: stat %s: no such file or directory", binDir, filepath.Join(binDir, "host-local")),
+		},
+		{
+			name:        "IPAM without type",
+			filename:    "10-wg.conflist",
+			content:     `{"cniVersion": "0.4.0", "name": "wg", "plugins": [{"type": "wireguard", "ipam": {}}]}`,
+			expectedErr: "plugin 0: ipam.type must be set",
+		},
+		{
+			name:        "plugin not executable",
+			filename:    "10-wg.conf",
+			content:     `{"cniVersion": "0.4.0", "name": "wg", "type": "not-executable"}`,
+			expectedErr: fmt.Sprintf("plugin not-executable in %s is not executable", binDir),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateNetworkConfig(test.filename, []byte(test.content), binDir)
+			testhelper.CompareStrings(t, test.expectedErr, fmt.Sprint(err))
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	ctrlsource "sigs.k8s.io/controller-runtime/pkg/source"
+
+	nodecontroller "github.com/mrincompetent/wireguard-controller/pkg/controller/node"
+	"github.com/mrincompetent/wireguard-controller/pkg/ipam"
+	"github.com/mrincompetent/wireguard-controller/pkg/source"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+const (
+	name = "ipam_controller"
+
+	eventReasonExhausted = "PodCIDRExhausted"
+)
+
+// Reconciler allocates a pod CIDR for every node, which got none assigned by Kubernetes.
+// Allocations are stored in the wireguard/pod_cidr annotation of the node. They're released by deleting the node,
+// as the subnets in use get collected from all nodes on every reconcile.
+type Reconciler struct {
+	client.Client
+	// apiReader reads the nodes bypassing the cache. A stale cache might miss the allocations of the previous leader.
+	apiReader client.Reader
+	log       *zap.Logger
+	allocator *ipam.Allocator
+	recorder  record.EventRecorder
+	metrics   *metrics
+	// exhaustedNodes contains the nodes, which got reported as exhausted, so they only get reported again once the set changes.
+	exhaustedNodes map[string]bool
+}
+
+func Add(
+	mgr ctrl.Manager,
+	log *zap.Logger,
+	podNet *net.IPNet,
+	maskSize int,
+	resyncInterval time.Duration,
+	metricFactory promauto.Factory,
+) error {
+	allocator, err := ipam.NewAllocator(podNet, maskSize)
+	if err != nil {
+		return fmt.Errorf("unable to create the allocator: %w", err)
+	}
+
+	m := &metrics{
+		allocations: metricFactory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "ipam_allocations_total",
+				Help: "Number of pod CIDRs allocated for nodes.",
+			},
+		),
+		allocatedSubnets: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "ipam_allocated_subnets",
+				Help: "Number of nodes with a pod CIDR inside of the cluster pod CIDR.",
+			},
+		),
+		freeSubnets: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "ipam_free_subnets",
+				Help: "Number of subnets left in the cluster pod CIDR.",
+			},
+		),
+	}
+
+	options := controller.Options{
+		MaxConcurrentReconciles: 1,
+		Reconciler: &Reconciler{
+			Client:    mgr.GetClient(),
+			apiReader: mgr.GetAPIReader(),
+			log:       log.Named(name),
+			allocator: allocator,
+			recorder:  mgr.GetEventRecorderFor(name),
+			metrics:   m,
+		},
+	}
+
+	c, err := controller.New(name, mgr, options)
+	if err != nil {
+		return fmt.Errorf("failed to create new controller: %w", err)
+	}
+
+	// Allocations depend on all nodes, so every change results in the same request
+	if err := c.Watch(&ctrlsource.Kind{Type: &corev1.Node{}}, source.EnqueueStaticRequest()); err != nil {
+		return fmt.Errorf("failed to watch nodes: %w", err)
+	}
+
+	return c.Watch(source.NewIntervalSource(resyncInterval), &handler.EnqueueRequestForObject{})
+}
+
+func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.log.With(zap.String("sync_id", rand.String(12)))
+	log.Debug("Processing")
+
+	nodeList := &corev1.NodeList{}
+	if err := r.apiReader.List(ctx, nodeList); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to list nodes: %w", err)
+	}
+
+	nodes := nodeList.Items
+	// Allocate in a stable order
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+
+	var (
+		used       []net.IPNet
+		unassigned []string
+	)
+
+	for i := range nodes {
+		podCIDR := kubernetes.PodCIDR(&nodes[i])
+		if podCIDR == "" {
+			unassigned = append(unassigned, nodes[i].Name)
+
+			continue
+		}
+
+		_, podNet, err := net.ParseCIDR(podCIDR)
+		if err != nil {
+			log.Warn("Ignoring invalid pod CIDR of node", zap.String("node", nodes[i].Name), zap.String("pod_cidr", podCIDR), zap.Error(err))
+
+			continue
+		}
+
+		used = append(used, *podNet)
+	}
+
+	var exhausted []string
+
+	for i, nodeName := range unassigned {
+		podNet, err := r.allocator.Next(used)
+		if errors.Is(err, ipam.ErrClusterCIDRExhausted) {
+			exhausted = unassigned[i:]
+			break
+		}
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		assigned, err := r.assign(ctx, log, nodeName, podNet)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if assigned != nil {
+			used = append(used, *assigned)
+		}
+	}
+
+	r.exhausted(ctx, log, exhausted)
+	r.updateMetrics(used)
+
+	return ctrl.Result{}, nil
+}
+
+// assign stores the pod CIDR on the node, unless it got one in the meantime.
+// The pod CIDR the node ends up with gets returned. It's nil if the node got an invalid one in the meantime.
+func (r *Reconciler) assign(ctx context.Context, log *zap.Logger, nodeName string, podNet *net.IPNet) (*net.IPNet, error) {
+	var podCIDR string
+
+	err := retry.OnError(retry.DefaultBackoff, nodecontroller.IsConflictError, func() error {
+		node := &corev1.Node{}
+		if err := r.apiReader.Get(ctx, types.NamespacedName{Name: nodeName}, node); err != nil {
+			return fmt.Errorf("unable to load node: %w", err)
+		}
+
+		if kubernetes.SetPodCIDR(node, podNet.String()) {
+			if err := r.Client.Update(ctx, node); err != nil {
+				return fmt.Errorf("failed to update the pod CIDR on the node: %w", err)
+			}
+			log.Info("Allocated pod CIDR", zap.String("node", nodeName), zap.String("pod_cidr", podNet.String()))
+			r.metrics.allocations.Inc()
+		}
+
+		podCIDR = kubernetes.PodCIDR(node)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to store the pod CIDR on node '%s': %w", nodeName, err)
+	}
+
+	_, assigned, err := net.ParseCIDR(podCIDR)
+	if err != nil {
+		log.Warn("Ignoring invalid pod CIDR of node", zap.String("node", nodeName), zap.String("pod_cidr", podCIDR), zap.Error(err))
+
+		return nil, nil
+	}
+
+	return assigned, nil
+}
+
+// exhausted reports the nodes, for which no pod CIDR is left.
+// As the reconcile runs periodically, they only get reported if the set of nodes changed. Events are only emitted for newly exhausted nodes.
+func (r *Reconciler) exhausted(ctx context.Context, log *zap.Logger, nodeNames []string) {
+	exhaustedNodes := make(map[string]bool, len(nodeNames))
+	for _, nodeName := range nodeNames {
+		exhaustedNodes[nodeName] = true
+	}
+
+	changed := len(exhaustedNodes) != len(r.exhaustedNodes)
+	for nodeName := range exhaustedNodes {
+		if !r.exhaustedNodes[nodeName] {
+			changed = true
+		}
+	}
+
+	previous := r.exhaustedNodes
+	r.exhaustedNodes = exhaustedNodes
+
+	if !changed || len(nodeNames) == 0 {
+		return
+	}
+
+	log.Error("No pod CIDR left for nodes", zap.Strings("nodes", nodeNames))
+
+	for _, nodeName := range nodeNames {
+		if previous[nodeName] {
+			continue
+		}
+
+		node := &corev1.Node{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Name: nodeName}, node); err != nil {
+			continue
+		}
+
+		if kubernetes.PodCIDR(node) == "" {
+			r.recorder.Event(node, corev1.EventTypeWarning, eventReasonExhausted, "No free pod CIDR left in the cluster pod CIDR")
+		}
+	}
+}
+
+func (r *Reconciler) updateMetrics(used []net.IPNet) {
+	allocated := 0
+	for i := range used {
+		if r.allocator.Contains(&used[i]) {
+			allocated++
+		}
+	}
+
+	r.metrics.allocatedSubnets.Set(float64(allocated))
+	r.metrics.freeSubnets.Set(math.Max(0, float64(r.allocator.Size()-float64(allocated))))
+}
@@ -0,0 +1,168 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/ipam"
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+func node(name, podCIDR string) *corev1.Node {
+	n := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if podCIDR != "" {
+		n.Annotations = map[string]string{kubernetes.AnnotationKeyPodCIDR: podCIDR}
+	}
+
+	return n
+}
+
+// staleCache serves reads from an outdated set of nodes, while writes go to the API server.
+type staleCache struct {
+	client.Client
+	cache client.Client
+}
+
+func (c *staleCache) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	return c.cache.Get(ctx, key, obj)
+}
+
+func (c *staleCache) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	return c.cache.List(ctx, list, opts...)
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name           string
+		podNet         string
+		nodes          []runtime.Object
+		cachedNodes    []runtime.Object
+		expectedCIDRs  string
+		expectedEvents string
+	}{
+		{
+			name:   "allocation in name order",
+			podNet: "10.244.0.0/16",
+			nodes: []runtime.Object{
+				node("node-c", ""),
+				node("node-a", ""),
+				node("node-b", "10.244.0.0/24"),
+			},
+			expectedCIDRs: "node-a=10.244.1.0/24 node-b=10.244.0.0/24 node-c=10.244.2.0/24",
+		},
+		{
+			name:   "allocations by Kubernetes are respected",
+			podNet: "10.244.0.0/16",
+			nodes: []runtime.Object{
+				&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}, Spec: corev1.NodeSpec{PodCIDR: "10.244.0.0/24"}},
+				node("node-b", ""),
+			},
+			expectedCIDRs: "node-a=10.244.0.0/24 node-b=10.244.1.0/24",
+		},
+		{
+			name:   "exhausted",
+			podNet: "10.244.0.0/23",
+			nodes: []runtime.Object{
+				node("node-a", "10.244.0.0/24"),
+				node("node-b", ""),
+				node("node-c", ""),
+			},
+			expectedCIDRs:  "node-a=10.244.0.0/24 node-b=10.244.1.0/24 node-c=",
+			expectedEvents: "Warning PodCIDRExhausted No free pod CIDR left in the cluster pod CIDR",
+		},
+		{
+			name:   "stale cache misses an allocation",
+			podNet: "10.244.0.0/16",
+			nodes: []runtime.Object{
+				node("node-a", ""),
+				node("node-b", "10.244.0.0/24"),
+			},
+			cachedNodes: []runtime.Object{
+				node("node-a", ""),
+				node("node-b", ""),
+			},
+			expectedCIDRs: "node-a=10.244.1.0/24 node-b=10.244.0.0/24",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, podNet, err := net.ParseCIDR(test.podNet)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			allocator, err := ipam.NewAllocator(podNet, 24)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			apiServer := fake.NewFakeClient(test.nodes...)
+
+			var cachedClient client.Client = apiServer
+			if test.cachedNodes != nil {
+				cachedClient = &staleCache{Client: apiServer, cache: fake.NewFakeClient(test.cachedNodes...)}
+			}
+
+			recorder := record.NewFakeRecorder(10)
+
+			r := &Reconciler{
+				Client:    cachedClient,
+				apiReader: apiServer,
+				log:       zap.NewNop(),
+				allocator: allocator,
+				recorder:  recorder,
+				metrics: &metrics{
+					allocations:      prometheus.NewCounter(prometheus.CounterOpts{Name: "allocations"}),
+					allocatedSubnets: prometheus.NewGauge(prometheus.GaugeOpts{Name: "allocated"}),
+					freeSubnets:      prometheus.NewGauge(prometheus.GaugeOpts{Name: "free"}),
+				},
+			}
+
+			// The second reconcile must neither change allocations nor report the exhausted nodes again
+			for i := 0; i < 2; i++ {
+				if _, err := r.Reconcile(ctrl.Request{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			nodeList := &corev1.NodeList{}
+			if err := apiServer.List(context.Background(), nodeList); err != nil {
+				t.Fatal(err)
+			}
+
+			var cidrs []string
+			for i := range nodeList.Items {
+				cidrs = append(cidrs, fmt.Sprintf("%s=%s", nodeList.Items[i].Name, kubernetes.PodCIDR(&nodeList.Items[i])))
+			}
+
+			sort.Strings(cidrs)
+
+			testhelper.CompareStrings(t, test.expectedCIDRs, strings.Join(cidrs, " "))
+
+			close(recorder.Events)
+
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+
+			testhelper.CompareStrings(t, test.expectedEvents, strings.Join(events, "\n"))
+		})
+	}
+}
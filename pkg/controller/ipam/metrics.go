@@ -0,0 +1,9 @@
+package ipam
+
+import "github.com/prometheus/client_golang/prometheus"
+
+type metrics struct {
+	allocations      prometheus.Counter
+	allocatedSubnets prometheus.Gauge
+	freeSubnets      prometheus.Gauge
+}
@@ -15,6 +15,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 
+	"github.com/mrincompetent/wireguard-controller/pkg/mesh"
 	"github.com/mrincompetent/wireguard-controller/pkg/source"
 )
 
@@ -37,23 +38,25 @@ type Reconciler struct {
 func Add(
 	mgr ctrl.Manager,
 	log *zap.Logger,
-	privateKeyFilePath string,
+	wgMesh *mesh.Mesh,
 	keyStore keyStore,
 	metricFactory promauto.Factory,
 ) error {
+	controllerName := wgMesh.ControllerName(name)
+
 	options := controller.Options{
 		MaxConcurrentReconciles: 1,
 		Reconciler: &Reconciler{
 			Client: mgr.GetClient(),
-			log: log.Named(name).With(
-				zap.String("private_key_file", privateKeyFilePath),
+			log: log.Named(controllerName).With(
+				zap.String("private_key_file", wgMesh.PrivateKeyPath),
 			),
-			privateKeyFilePath: privateKeyFilePath,
+			privateKeyFilePath: wgMesh.PrivateKeyPath,
 			keyStore:           keyStore,
 		},
 	}
 
-	c, err := controller.New(name, mgr, options)
+	c, err := controller.New(controllerName, mgr, options)
 	if err != nil {
 		return fmt.Errorf("failed to create new controller: %w", err)
 	}
@@ -0,0 +1,171 @@
+package masquerade
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/nftables"
+	"github.com/mrincompetent/wireguard-controller/pkg/source"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+const (
+	name = "masquerade_controller"
+)
+
+// PodNetworkStore returns the cluster pod CIDR. It's nil until it got discovered.
+// The Reconciler reads it once at the start of every reconcile, so changes apply without a restart.
+type PodNetworkStore interface {
+	Get() *net.IPNet
+}
+
+// Reconciler manages an nftables table, which masquerades pod traffic leaving the cluster network.
+// Traffic to the pod network, the routes advertised by nodes & the no-masquerade networks keeps the pod address.
+type Reconciler struct {
+	client.Client
+	log          *zap.Logger
+	podNetStore  PodNetworkStore
+	podNet       *net.IPNet
+	noMasquerade []net.IPNet
+	metrics      *metrics
+
+	// applied is the last ruleset which got applied successfully
+	applied string
+	// appliedTable is the table of the applied ruleset. It changes with the IP family of the pod CIDR.
+	appliedTable nftables.Table
+}
+
+func Add(
+	mgr ctrl.Manager,
+	log *zap.Logger,
+	podNetStore PodNetworkStore,
+	noMasquerade []net.IPNet,
+	resyncInterval time.Duration,
+	metricFactory promauto.Factory,
+) error {
+	m := &metrics{
+		rulesetUpdates: metricFactory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "masquerade_ruleset_updates_total",
+				Help: "Number of times the masquerade nftables table got replaced.",
+			},
+		),
+		noMasqueradeNetworks: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "masquerade_no_masquerade_networks",
+				Help: "Number of destination networks traffic from pods gets not masqueraded to.",
+			},
+		),
+	}
+
+	options := controller.Options{
+		MaxConcurrentReconciles: 1,
+		Reconciler: &Reconciler{
+			Client:       mgr.GetClient(),
+			log:          log.Named(name),
+			podNetStore:  podNetStore,
+			noMasquerade: noMasquerade,
+			metrics:      m,
+		},
+	}
+
+	c, err := controller.New(name, mgr, options)
+	if err != nil {
+		return fmt.Errorf("failed to create new controller: %w", err)
+	}
+
+	return c.Watch(source.NewIntervalSource(resyncInterval), &handler.EnqueueRequestForObject{})
+}
+
+func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.log.With(zap.String("sync_id", rand.String(12)))
+	log.Debug("Processing")
+
+	r.podNet = r.podNetStore.Get()
+	if r.podNet == nil {
+		log.Debug("Skipping as the cluster pod CIDR is not known yet")
+
+		return ctrl.Result{}, nil
+	}
+
+	nodeList := &corev1.NodeList{}
+	if err := r.List(ctx, nodeList); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to list nodes: %w", err)
+	}
+
+	// Rejected routes are reported by the WireGuard interface controller
+	advertisedRoutes, _ := kubernetes.ValidateAdvertisedRoutes(nodeList.Items, r.podNet)
+
+	noMasquerade := append([]net.IPNet{}, r.noMasquerade...)
+	for _, routes := range advertisedRoutes {
+		noMasquerade = append(noMasquerade, routes...)
+	}
+
+	r.metrics.noMasqueradeNetworks.Set(float64(len(mergeNetworks(r.podNet, noMasquerade))))
+
+	ruleset := Ruleset(r.podNet, noMasquerade)
+	table := nftTable(r.podNet)
+
+	if ruleset == r.applied {
+		// The table might have been flushed by someone else
+		exists, err := nftables.TableExists(ctx, table)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if exists {
+			log.Debug("Masquerade rules are up to date")
+
+			return ctrl.Result{}, nil
+		}
+
+		log.Info("Masquerade table got removed, will recreate it")
+	}
+
+	if err := nftables.Apply(ctx, ruleset); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to apply the masquerade rules: %w", err)
+	}
+
+	// The pod CIDR got discovered with another IP family, so the table of the old family is stale
+	if r.appliedTable.Name != "" && r.appliedTable != table {
+		if err := nftables.DeleteTable(ctx, r.appliedTable); err != nil {
+			return ctrl.Result{}, fmt.Errorf("unable to remove the stale masquerade table: %w", err)
+		}
+
+		log.Info("Removed stale masquerade table", zap.String("table", r.appliedTable.String()))
+	}
+
+	r.applied = ruleset
+	r.appliedTable = table
+	r.metrics.rulesetUpdates.Inc()
+	log.Info("Applied masquerade rules", zap.String("table", table.String()))
+
+	return ctrl.Result{}, nil
+}
+
+// Uninstall removes the tables of both IP families.
+func Uninstall(ctx context.Context) error {
+	var combinedErr error
+
+	for _, family := range []string{"ip", "ip6"} {
+		if err := nftables.DeleteTable(ctx, nftables.Table{Family: family, Name: TableName}); err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to remove the %s masquerade table: %w", family, err))
+		}
+	}
+
+	return combinedErr
+}
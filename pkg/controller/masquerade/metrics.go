@@ -0,0 +1,8 @@
+package masquerade
+
+import "github.com/prometheus/client_golang/prometheus"
+
+type metrics struct {
+	rulesetUpdates       prometheus.Counter
+	noMasqueradeNetworks prometheus.Gauge
+}
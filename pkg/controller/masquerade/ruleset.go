@@ -0,0 +1,106 @@
+package masquerade
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/nftables"
+)
+
+// TableName is the name of the nftables table owned by the controller.
+const TableName = "wireguard_masquerade"
+
+// nftTable returns the table for the IP family of the pod network.
+func nftTable(podNet *net.IPNet) nftables.Table {
+	if podNet.IP.To4() != nil {
+		return nftables.Table{Family: "ip", Name: TableName}
+	}
+
+	return nftables.Table{Family: "ip6", Name: TableName}
+}
+
+// Ruleset returns the nft script, which masquerades traffic from the pod network to all destinations except the given networks.
+func Ruleset(podNet *net.IPNet, noMasquerade []net.IPNet) string {
+	table := nftTable(podNet)
+
+	addrFamily, addrType := "ip", "ipv4_addr"
+	if table.Family == "ip6" {
+		addrFamily, addrType = "ip6", "ipv6_addr"
+	}
+
+	var elements []string
+	for _, network := range mergeNetworks(podNet, noMasquerade) {
+		elements = append(elements, network.String())
+	}
+
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "\tset no_masquerade {\n")
+	fmt.Fprintf(body, "\t\ttype %s\n", addrType)
+	fmt.Fprintf(body, "\t\tflags interval\n")
+	fmt.Fprintf(body, "\t\telements = { %s }\n", strings.Join(elements, ", "))
+	fmt.Fprintf(body, "\t}\n\n")
+	fmt.Fprintf(body, "\tchain postrouting {\n")
+	fmt.Fprintf(body, "\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	fmt.Fprintf(body, "\t\t%s saddr != %s return\n", addrFamily, podNet.String())
+	fmt.Fprintf(body, "\t\t%s daddr @no_masquerade return\n", addrFamily)
+	fmt.Fprintf(body, "\t\tmasquerade\n")
+	fmt.Fprintf(body, "\t}\n")
+
+	return nftables.ReplaceTable(table, body.String())
+}
+
+// mergeNetworks returns the pod network & the given networks of the same IP family, without the ones contained in another network.
+// nftables rejects overlapping elements in interval sets.
+func mergeNetworks(podNet *net.IPNet, networks []net.IPNet) []net.IPNet {
+	v4 := podNet.IP.To4() != nil
+
+	candidates := []net.IPNet{*podNet}
+
+	for _, network := range networks {
+		if (network.IP.To4() != nil) != v4 {
+			continue
+		}
+
+		candidates = append(candidates, network)
+	}
+
+	// Bigger networks first, so the networks they contain can be dropped
+	sort.Slice(candidates, func(i, j int) bool {
+		iOnes, _ := candidates[i].Mask.Size()
+		jOnes, _ := candidates[j].Mask.Size()
+
+		if iOnes != jOnes {
+			return iOnes < jOnes
+		}
+
+		return bytes.Compare(candidates[i].IP.To16(), candidates[j].IP.To16()) < 0
+	})
+
+	var merged []net.IPNet
+
+	for _, candidate := range candidates {
+		contained := false
+
+		for _, network := range merged {
+			if network.Contains(candidate.IP) {
+				contained = true
+
+				break
+			}
+		}
+
+		if !contained {
+			merged = append(merged, candidate)
+		}
+	}
+
+	// Keep the output stable & readable
+	sort.Slice(merged, func(i, j int) bool {
+		return bytes.Compare(merged[i].IP.To16(), merged[j].IP.To16()) < 0
+	})
+
+	return merged
+}
@@ -0,0 +1,84 @@
+package masquerade
+
+import (
+	"net"
+	"testing"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func parseNetworks(t *testing.T, cidrs ...string) []net.IPNet {
+	var networks []net.IPNet
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		networks = append(networks, *network)
+	}
+
+	return networks
+}
+
+func TestRuleset(t *testing.T) {
+	tests := []struct {
+		name            string
+		podNet          string
+		noMasquerade    []string
+		expectedRuleset string
+	}{
+		{
+			name:         "contained & foreign family networks get dropped",
+			podNet:       "10.244.0.0/16",
+			noMasquerade: []string{"192.168.0.0/16", "10.244.3.0/24", "192.168.10.0/24", "fd00::/64", "172.16.0.0/12"},
+			expectedRuleset: `table ip wireguard_masquerade {}
+delete table ip wireguard_masquerade
+table ip wireguard_masquerade {
+	set no_masquerade {
+		type ipv4_addr
+		flags interval
+		elements = { 10.244.0.0/16, 172.16.0.0/12, 192.168.0.0/16 }
+	}
+
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		ip saddr != 10.244.0.0/16 return
+		ip daddr @no_masquerade return
+		masquerade
+	}
+}
+`,
+		},
+		{
+			name:   "IPv6",
+			podNet: "fd00:10::/56",
+			expectedRuleset: `table ip6 wireguard_masquerade {}
+delete table ip6 wireguard_masquerade
+table ip6 wireguard_masquerade {
+	set no_masquerade {
+		type ipv6_addr
+		flags interval
+		elements = { fd00:10::/56 }
+	}
+
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		ip6 saddr != fd00:10::/56 return
+		ip6 daddr @no_masquerade return
+		masquerade
+	}
+}
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			podNet := parseNetworks(t, test.podNet)[0]
+
+			testhelper.CompareStrings(t, test.expectedRuleset, Ruleset(&podNet, parseNetworks(t, test.noMasquerade...)))
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package networkpolicy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/rand"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	ctrlsource "sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/nftables"
+	"github.com/mrincompetent/wireguard-controller/pkg/policy"
+	"github.com/mrincompetent/wireguard-controller/pkg/source"
+)
+
+const (
+	name = "network_policy_controller"
+)
+
+// Reconciler enforces the NetworkPolicies for the pods running on the node using an nftables table.
+type Reconciler struct {
+	client.Client
+	log      *zap.Logger
+	nodeName string
+	metrics  *metrics
+
+	// applied is the last ruleset which got applied successfully
+	applied string
+}
+
+func Add(
+	mgr ctrl.Manager,
+	log *zap.Logger,
+	nodeName string,
+	resyncInterval time.Duration,
+	metricFactory promauto.Factory,
+) error {
+	m := &metrics{
+		rulesetUpdates: metricFactory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "network_policy_ruleset_updates_total",
+				Help: "Number of times the network policy nftables table got replaced.",
+			},
+		),
+		policies: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "network_policy_count",
+				Help: "Number of NetworkPolicies in the cluster.",
+			},
+		),
+	}
+
+	options := controller.Options{
+		MaxConcurrentReconciles: 1,
+		Reconciler: &Reconciler{
+			Client:   mgr.GetClient(),
+			log:      log.Named(name),
+			nodeName: nodeName,
+			metrics:  m,
+		},
+	}
+
+	c, err := controller.New(name, mgr, options)
+	if err != nil {
+		return fmt.Errorf("failed to create new controller: %w", err)
+	}
+
+	// The ruleset covers all pods, so every change results in the same request
+	for _, object := range []runtime.Object{&networkingv1.NetworkPolicy{}, &corev1.Pod{}, &corev1.Namespace{}} {
+		if err := c.Watch(&ctrlsource.Kind{Type: object}, source.EnqueueStaticRequest()); err != nil {
+			return fmt.Errorf("failed to watch %T: %w", object, err)
+		}
+	}
+
+	// The interval recreates the table in case it got removed
+	return c.Watch(source.NewIntervalSource(resyncInterval), &handler.EnqueueRequestForObject{})
+}
+
+func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.log.With(zap.String("sync_id", rand.String(12)))
+	log.Debug("Processing")
+
+	policies := &networkingv1.NetworkPolicyList{}
+	if err := r.List(ctx, policies); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to list network policies: %w", err)
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to list pods: %w", err)
+	}
+
+	namespaces := &corev1.NamespaceList{}
+	if err := r.List(ctx, namespaces); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to list namespaces: %w", err)
+	}
+
+	r.metrics.policies.Set(float64(len(policies.Items)))
+
+	ruleset, err := policy.Compile(r.nodeName, policies.Items, pods.Items, namespaces.Items)
+	if err != nil {
+		// The previous ruleset stays in place
+		return ctrl.Result{}, fmt.Errorf("unable to compile the network policies: %w", err)
+	}
+
+	if ruleset == r.applied {
+		exists, err := nftables.TableExists(ctx, policy.Table)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if exists {
+			log.Debug("Network policy rules are up to date")
+
+			return ctrl.Result{}, nil
+		}
+
+		log.Info("Network policy table got removed, will recreate it")
+	}
+
+	if err := nftables.Apply(ctx, ruleset); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to apply the network policy rules: %w", err)
+	}
+
+	r.applied = ruleset
+	r.metrics.rulesetUpdates.Inc()
+	log.Info("Applied network policy rules", zap.Int("policies", len(policies.Items)))
+
+	return ctrl.Result{}, nil
+}
+
+// Uninstall removes the network policy table.
+func Uninstall(ctx context.Context) error {
+	if err := nftables.DeleteTable(ctx, policy.Table); err != nil {
+		return fmt.Errorf("unable to remove the network policy table: %w", err)
+	}
+
+	return nil
+}
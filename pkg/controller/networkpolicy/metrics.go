@@ -0,0 +1,8 @@
+package networkpolicy
+
+import "github.com/prometheus/client_golang/prometheus"
+
+type metrics struct {
+	rulesetUpdates prometheus.Counter
+	policies       prometheus.Gauge
+}
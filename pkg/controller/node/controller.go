@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
@@ -21,8 +22,12 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 
+	"github.com/mrincompetent/wireguard-controller/pkg/mesh"
+	"github.com/mrincompetent/wireguard-controller/pkg/readiness"
 	"github.com/mrincompetent/wireguard-controller/pkg/source"
 	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/namespace"
+	wgnetlink "github.com/mrincompetent/wireguard-controller/pkg/wireguard/netlink"
 )
 
 const (
@@ -34,34 +39,62 @@ type KeyStore interface {
 	Get() wgtypes.Key
 }
 
+// ReadinessStore receives the state of the checks, which gate the CNI config.
+type ReadinessStore interface {
+	Register(mesh, check string)
+	Report(mesh, check string, expected, present int)
+	Reconciled() (bool, []string)
+}
+
 type Reconciler struct {
 	client.Client
 	log           *zap.Logger
+	mesh          *mesh.Mesh
 	nodeName      string
 	wireguardPort int
 	keyStore      KeyStore
+	readiness     ReadinessStore
+	// notReadyTaint keeps pods off the node while it's not reconciled or degraded. Only used by the primary mesh.
+	notReadyTaint bool
+	// directRouting publishes the network segment of the node, so peers on the same segment get routed directly.
+	// Only used by the primary mesh.
+	directRouting bool
+	namespace     *namespace.Namespace
 }
 
 func Add(
 	mgr ctrl.Manager,
 	log *zap.Logger,
+	wgMesh *mesh.Mesh,
+	ns *namespace.Namespace,
 	nodeName string,
-	wireGuardPort int,
 	keyStore KeyStore,
+	readinessStore ReadinessStore,
+	notReadyTaint,
+	directRouting bool,
 	metricFactory promauto.Factory,
 ) error {
+	controllerName := wgMesh.ControllerName(name)
+
+	readinessStore.Register(wgMesh.InterfaceName, readiness.CheckKey)
+
 	options := controller.Options{
 		MaxConcurrentReconciles: 1,
 		Reconciler: &Reconciler{
 			Client:        mgr.GetClient(),
-			log:           log.Named(name),
+			log:           log.Named(controllerName),
+			mesh:          wgMesh,
 			nodeName:      nodeName,
-			wireguardPort: wireGuardPort,
+			wireguardPort: wgMesh.ListenPort,
 			keyStore:      keyStore,
+			readiness:     readinessStore,
+			notReadyTaint: notReadyTaint && wgMesh.Primary,
+			directRouting: directRouting,
+			namespace:     ns,
 		},
 	}
 
-	c, err := controller.New(name, mgr, options)
+	c, err := controller.New(controllerName, mgr, options)
 	if err != nil {
 		return fmt.Errorf("failed to create new controller: %w", err)
 	}
@@ -95,6 +128,14 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	log := r.log.With(zap.String("sync_id", rand.String(12)))
 	log.Debug("Processing")
 
+	// The taint has to be in place before anything else, so no pods get scheduled while we're still setting up.
+	// It gets reconciled every time, so it comes back once the mesh degrades.
+	if r.notReadyTaint {
+		if err := r.reconcileTaint(ctx, log); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
 	if !r.keyStore.HasKey() {
 		log.Debug("Requeueing as the private key does not exist yet")
 
@@ -108,12 +149,21 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, fmt.Errorf("unable to load own node: %w", err)
 	}
 
+	if !r.mesh.Selects(node) {
+		log.Debug("Skipping as the node we're running on is not part of the mesh")
+		r.readiness.Report(r.mesh.InterfaceName, readiness.CheckKey, 0, 0)
+
+		return ctrl.Result{}, nil
+	}
+
+	annotations := r.mesh.Annotations()
+
 	err := retry.OnError(retry.DefaultBackoff, IsConflictError, func() error {
 		if err := r.Client.Get(ctx, types.NamespacedName{Name: r.nodeName}, node); err != nil {
 			return fmt.Errorf("unable to load own node: %w", err)
 		}
 
-		if kubernetes.SetPublicKey(node, key.PublicKey()) {
+		if kubernetes.SetPublicKey(node, annotations, key.PublicKey()) {
 			if err := r.Client.Update(ctx, node); err != nil {
 				return fmt.Errorf("failed to update public key on node: %w", err)
 			}
@@ -138,7 +188,7 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			return fmt.Errorf("unable to load own node: %w", err)
 		}
 
-		if kubernetes.SetEndpointAddress(node, wireGuardEndpoint) {
+		if kubernetes.SetEndpointAddress(node, annotations, wireGuardEndpoint) {
 			if err := r.Client.Update(ctx, node); err != nil {
 				return fmt.Errorf("failed to update endpoint address on node: %w", err)
 			}
@@ -151,9 +201,114 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, fmt.Errorf("unable to store the WireGuard endpoint on the node object: %w", err)
 	}
 
+	if r.mesh.Primary {
+		if err := r.reconcileNetworkSegment(ctx, log); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Peers can only reach us once both are published
+	r.readiness.Report(r.mesh.InterfaceName, readiness.CheckKey, 1, 1)
+
 	return ctrl.Result{}, nil
 }
 
+// reconcileNetworkSegment publishes the local network, which contains the node address, if direct routing is enabled.
+// Peers only route directly to us if they published the same segment.
+func (r *Reconciler) reconcileNetworkSegment(ctx context.Context, log *zap.Logger) error {
+	var localNetworks []net.IPNet
+
+	if r.directRouting {
+		handle, err := r.namespace.Handle()
+		if err != nil {
+			return fmt.Errorf("unable to get a netlink handle: %w", err)
+		}
+		defer handle.Delete()
+
+		localNetworks, err = wgnetlink.LocalNetworks(handle, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := retry.OnError(retry.DefaultBackoff, IsConflictError, func() error {
+		node := &corev1.Node{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Name: r.nodeName}, node); err != nil {
+			return fmt.Errorf("unable to load own node: %w", err)
+		}
+
+		segment := networkSegment(kubernetes.NodeAddress(node), localNetworks)
+
+		if kubernetes.SetNetworkSegment(node, segment) {
+			if err := r.Client.Update(ctx, node); err != nil {
+				return fmt.Errorf("failed to update the network segment on node: %w", err)
+			}
+			log.Info("Updated the node's network segment", zap.String("segment", node.Annotations[kubernetes.AnnotationKeyNetworkSegment]))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to store the network segment on the node object: %w", err)
+	}
+
+	return nil
+}
+
+// networkSegment returns the local network containing the address. Nil gets returned if there is none.
+func networkSegment(ip net.IP, localNetworks []net.IPNet) *net.IPNet {
+	if ip == nil {
+		return nil
+	}
+
+	for i := range localNetworks {
+		if localNetworks[i].Contains(ip) {
+			return &localNetworks[i]
+		}
+	}
+
+	return nil
+}
+
+// reconcileTaint keeps the not ready taint on the node until the key, interface, peers, routes & the CNI config got reconciled.
+// It gets added again while the mesh is degraded.
+func (r *Reconciler) reconcileTaint(ctx context.Context, log *zap.Logger) error {
+	reconciled, failing := r.readiness.Reconciled()
+	taint := kubernetes.AgentNotReadyTaint()
+
+	err := retry.OnError(retry.DefaultBackoff, IsConflictError, func() error {
+		node := &corev1.Node{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Name: r.nodeName}, node); err != nil {
+			return fmt.Errorf("unable to load own node: %w", err)
+		}
+
+		if reconciled {
+			if kubernetes.RemoveTaint(node, taint) {
+				if err := r.Client.Update(ctx, node); err != nil {
+					return fmt.Errorf("failed to remove the taint from the node: %w", err)
+				}
+				log.Info("Removed the not ready taint from the node")
+			}
+
+			return nil
+		}
+
+		if kubernetes.SetTaint(node, taint) {
+			if err := r.Client.Update(ctx, node); err != nil {
+				return fmt.Errorf("failed to add the taint to the node: %w", err)
+			}
+			log.Info("Tainted the node as not ready", zap.Strings("failing_checks", failing))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to reconcile the not ready taint on the node object: %w", err)
+	}
+
+	return nil
+}
+
 func IsConflictError(err error) bool {
 	var statusErr kerrors.APIStatus
 	if errors.As(err, &statusErr) {
@@ -0,0 +1,83 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/readiness"
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+// keyStore has no key yet, so Reconcile stops right after the taint.
+type keyStore struct{}
+
+func (keyStore) HasKey() bool     { return false }
+func (keyStore) Get() wgtypes.Key { return wgtypes.Key{} }
+
+func TestReconcileTaint(t *testing.T) {
+	store := readiness.New(readiness.DefaultInitialThreshold, readiness.DefaultDegradedThreshold)
+	for _, check := range []string{readiness.CheckKey, readiness.CheckPeers, readiness.CheckRoutes} {
+		store.Register("wg-kube", check)
+	}
+
+	r := &Reconciler{
+		Client:        fake.NewFakeClient(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}),
+		log:           zap.NewNop(),
+		keyStore:      keyStore{},
+		nodeName:      "node1",
+		readiness:     store,
+		notReadyTaint: true,
+	}
+
+	tainted := func() string {
+		node := &corev1.Node{}
+		if err := r.Client.Get(context.Background(), types.NamespacedName{Name: "node1"}, node); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == kubernetes.TaintKeyAgentNotReady {
+				return "tainted"
+			}
+		}
+
+		return "untainted"
+	}
+
+	steps := []struct {
+		name     string
+		peers    int
+		routes   int
+		expected string
+	}{
+		{name: "setting up", peers: 0, routes: 0, expected: "tainted"},
+		{name: "ready", peers: 4, routes: 4, expected: "untainted"},
+		{name: "below the degraded threshold", peers: 3, routes: 4, expected: "untainted"},
+		{name: "degraded", peers: 1, routes: 4, expected: "tainted"},
+		{name: "recovered", peers: 4, routes: 4, expected: "untainted"},
+	}
+
+	store.Report("wg-kube", readiness.CheckKey, 1, 1)
+	store.SetCNIConfigWritten(true)
+
+	for _, step := range steps {
+		store.Report("wg-kube", readiness.CheckPeers, 4, step.peers)
+		store.Report("wg-kube", readiness.CheckRoutes, 4, step.routes)
+
+		if _, err := r.Reconcile(ctrl.Request{}); err != nil {
+			t.Fatal(err)
+		}
+
+		testhelper.CompareStrings(t, fmt.Sprintf("%s: %s", step.name, step.expected), fmt.Sprintf("%s: %s", step.name, tainted()))
+	}
+}
@@ -0,0 +1,218 @@
+package podcidr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	ctrlsource "sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/podnet"
+	"github.com/mrincompetent/wireguard-controller/pkg/source"
+)
+
+const (
+	name = "pod_cidr_discovery_controller"
+
+	eventReasonWidened = "PodCIDRWidened"
+)
+
+// Store receives the discovered cluster pod CIDR.
+type Store interface {
+	Set(network *net.IPNet) bool
+	Get() *net.IPNet
+}
+
+// Reconciler discovers the cluster pod CIDR. The ConfigMap takes precedence.
+// Without one, the smallest network containing the pod CIDRs of all nodes gets used if fromNodes is set.
+// A network inferred from the nodes only ever gets widened, so running pods never end up outside of it.
+type Reconciler struct {
+	client.Client
+	log       *zap.Logger
+	store     Store
+	configMap types.NamespacedName
+	fromNodes bool
+	nodeName  string
+	recorder  record.EventRecorder
+	metrics   *metrics
+}
+
+// Add registers the discovery controller. An empty ConfigMap name only uses the pod CIDRs of the nodes, if fromNodes is set.
+func Add(
+	mgr ctrl.Manager,
+	log *zap.Logger,
+	store Store,
+	configMapNamespace,
+	configMapName string,
+	fromNodes bool,
+	nodeName string,
+	resyncInterval time.Duration,
+	metricFactory promauto.Factory,
+) error {
+	m := &metrics{
+		podCIDR: metricFactory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "pod_cidr_discovered",
+				Help: "Cluster pod CIDR in use. The source label is either configmap or nodes.",
+			},
+			[]string{"pod_cidr", "source"},
+		),
+		changes: metricFactory.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pod_cidr_changes_total",
+				Help: "Number of times the discovered cluster pod CIDR changed.",
+			},
+		),
+	}
+
+	configMap := types.NamespacedName{Namespace: configMapNamespace, Name: configMapName}
+
+	options := controller.Options{
+		MaxConcurrentReconciles: 1,
+		Reconciler: &Reconciler{
+			Client:    mgr.GetClient(),
+			log:       log.Named(name),
+			store:     store,
+			configMap: configMap,
+			fromNodes: fromNodes,
+			nodeName:  nodeName,
+			recorder:  mgr.GetEventRecorderFor(name),
+			metrics:   m,
+		},
+	}
+
+	c, err := controller.New(name, mgr, options)
+	if err != nil {
+		return fmt.Errorf("failed to create new controller: %w", err)
+	}
+
+	if configMapName != "" {
+		isConfigMap := func(namespace, name string) bool {
+			return namespace == configMap.Namespace && name == configMap.Name
+		}
+
+		configMapPredicate := predicate.Funcs{
+			CreateFunc:  func(e event.CreateEvent) bool { return isConfigMap(e.Meta.GetNamespace(), e.Meta.GetName()) },
+			UpdateFunc:  func(e event.UpdateEvent) bool { return isConfigMap(e.MetaNew.GetNamespace(), e.MetaNew.GetName()) },
+			DeleteFunc:  func(e event.DeleteEvent) bool { return isConfigMap(e.Meta.GetNamespace(), e.Meta.GetName()) },
+			GenericFunc: func(e event.GenericEvent) bool { return isConfigMap(e.Meta.GetNamespace(), e.Meta.GetName()) },
+		}
+
+		if err := c.Watch(&ctrlsource.Kind{Type: &corev1.ConfigMap{}}, source.EnqueueStaticRequest(), configMapPredicate); err != nil {
+			return fmt.Errorf("failed to watch the pod CIDR ConfigMap: %w", err)
+		}
+	}
+
+	if fromNodes {
+		if err := c.Watch(&ctrlsource.Kind{Type: &corev1.Node{}}, source.EnqueueStaticRequest()); err != nil {
+			return fmt.Errorf("failed to watch nodes: %w", err)
+		}
+	}
+
+	return c.Watch(source.NewIntervalSource(resyncInterval), &handler.EnqueueRequestForObject{})
+}
+
+func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.log.With(zap.String("sync_id", rand.String(12)))
+	log.Debug("Processing")
+
+	network, discoveredFrom, err := r.discover(ctx, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if network == nil {
+		log.Debug("Unable to discover the cluster pod CIDR yet")
+
+		return ctrl.Result{}, nil
+	}
+
+	if discoveredFrom == sourceNodes {
+		current := r.store.Get()
+
+		network, err = podnet.Widen(current, network)
+		if err != nil {
+			log.Error("Ignoring the pod CIDRs of the nodes", zap.Error(err))
+
+			return ctrl.Result{}, nil
+		}
+
+		if current != nil && network.String() != current.String() {
+			log.Warn("Widening the cluster pod CIDR, as a node's pod CIDR lies outside of it", zap.String("previous", current.String()), zap.String("pod_cidr", network.String()))
+			r.recordWidened(ctx, current, network)
+		}
+	}
+
+	if r.store.Set(network) {
+		r.metrics.podCIDR.Reset()
+		r.metrics.podCIDR.WithLabelValues(network.String(), discoveredFrom).Set(1)
+		r.metrics.changes.Inc()
+
+		log.Info("Discovered the cluster pod CIDR", zap.String("pod_cidr", network.String()), zap.String("source", discoveredFrom))
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// discover returns the cluster pod CIDR and its source. The network is nil if it can't be discovered yet.
+func (r *Reconciler) discover(ctx context.Context, log *zap.Logger) (*net.IPNet, string, error) {
+	if r.configMap.Name != "" {
+		configMap := &corev1.ConfigMap{}
+
+		err := r.Client.Get(ctx, r.configMap, configMap)
+		switch {
+		case kerrors.IsNotFound(err):
+			log.Debug("Pod CIDR ConfigMap does not exist", zap.Stringer("configmap", r.configMap))
+		case err != nil:
+			return nil, "", fmt.Errorf("unable to load the pod CIDR ConfigMap: %w", err)
+		default:
+			network, err := podnet.FromConfigMap(configMap)
+			if err == nil {
+				return network, sourceConfigMap, nil
+			}
+
+			// A broken ConfigMap must not take down the cluster network, so the last known network stays in use
+			if !errors.Is(err, podnet.ErrNotConfigured) {
+				log.Warn("Ignoring the pod CIDR ConfigMap", zap.Stringer("configmap", r.configMap), zap.Error(err))
+			}
+		}
+	}
+
+	if !r.fromNodes {
+		return nil, "", nil
+	}
+
+	nodeList := &corev1.NodeList{}
+	if err := r.List(ctx, nodeList); err != nil {
+		return nil, "", fmt.Errorf("unable to list nodes: %w", err)
+	}
+
+	return podnet.FromNodes(nodeList.Items), sourceNodes, nil
+}
+
+// recordWidened emits an event on the node we're running on, as every agent widens its network on its own.
+func (r *Reconciler) recordWidened(ctx context.Context, previous, network *net.IPNet) {
+	node := &corev1.Node{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: r.nodeName}, node); err != nil {
+		return
+	}
+
+	r.recorder.Eventf(node, corev1.EventTypeWarning, eventReasonWidened, "Widened the cluster pod CIDR inferred from the nodes from %s to %s", previous.String(), network.String())
+}
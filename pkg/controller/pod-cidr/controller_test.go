@@ -0,0 +1,167 @@
+package podcidr
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/podnet"
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func node(name, podCIDR string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{PodCIDR: podCIDR},
+	}
+}
+
+func configMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kubeadm-config"},
+		Data:       data,
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name            string
+		objects         []runtime.Object
+		fromNodes       bool
+		current         string
+		expectedNetwork string
+		expectedEvents  string
+	}{
+		{
+			name: "ConfigMap takes precedence over the nodes",
+			objects: []runtime.Object{
+				configMap(map[string]string{podnet.ConfigMapKeyPodCIDR: "10.244.0.0/16"}),
+				node("node1", "172.25.1.0/24"),
+			},
+			fromNodes:       true,
+			expectedNetwork: "10.244.0.0/16",
+		},
+		{
+			name: "ConfigMap may shrink the network",
+			objects: []runtime.Object{
+				configMap(map[string]string{podnet.ConfigMapKeyPodCIDR: "10.244.0.0/16"}),
+			},
+			current:         "10.0.0.0/8",
+			expectedNetwork: "10.244.0.0/16",
+		},
+		{
+			name:            "nodes are only used if enabled",
+			objects:         []runtime.Object{node("node1", "10.244.1.0/24")},
+			expectedNetwork: "<nil>",
+		},
+		{
+			name: "nodes",
+			objects: []runtime.Object{
+				node("node1", "10.244.1.0/24"),
+				node("node2", "10.244.2.0/24"),
+			},
+			fromNodes:       true,
+			expectedNetwork: "10.244.0.0/22",
+		},
+		{
+			name: "broken ConfigMap keeps the last known network",
+			objects: []runtime.Object{
+				configMap(map[string]string{podnet.ConfigMapKeyPodCIDR: "invalid"}),
+			},
+			current:         "10.244.0.0/16",
+			expectedNetwork: "10.244.0.0/16",
+		},
+		{
+			name: "broken ConfigMap falls back to the nodes",
+			objects: []runtime.Object{
+				configMap(map[string]string{podnet.ConfigMapKeyPodCIDR: "invalid"}),
+				node("node1", "10.244.1.0/24"),
+			},
+			fromNodes:       true,
+			expectedNetwork: "10.244.1.0/24",
+		},
+		{
+			name:            "nodes never shrink the network",
+			objects:         []runtime.Object{node("node1", "10.244.1.0/24")},
+			fromNodes:       true,
+			current:         "10.244.0.0/16",
+			expectedNetwork: "10.244.0.0/16",
+		},
+		{
+			name: "nodes widen the network",
+			objects: []runtime.Object{
+				node("node1", "10.244.0.0/24"),
+				node("node2", "10.244.1.0/24"),
+			},
+			fromNodes:       true,
+			current:         "10.244.0.0/24",
+			expectedNetwork: "10.244.0.0/23",
+			expectedEvents:  "Warning PodCIDRWidened Widened the cluster pod CIDR inferred from the nodes from 10.244.0.0/24 to 10.244.0.0/23",
+		},
+		{
+			name: "unrelated node ranges",
+			objects: []runtime.Object{
+				node("node1", "10.244.1.0/24"),
+				node("node2", "192.168.1.0/24"),
+			},
+			fromNodes:       true,
+			expectedNetwork: "<nil>",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := podnet.New()
+			if test.current != "" {
+				_, current, err := net.ParseCIDR(test.current)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				store.Set(current)
+			}
+
+			recorder := record.NewFakeRecorder(10)
+
+			r := &Reconciler{
+				Client:    fake.NewFakeClient(test.objects...),
+				log:       zap.NewNop(),
+				store:     store,
+				configMap: types.NamespacedName{Namespace: "kube-system", Name: "kubeadm-config"},
+				fromNodes: test.fromNodes,
+				nodeName:  "node1",
+				recorder:  recorder,
+				metrics: &metrics{
+					podCIDR: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "pod_cidr"}, []string{"pod_cidr", "source"}),
+					changes: prometheus.NewCounter(prometheus.CounterOpts{Name: "changes"}),
+				},
+			}
+
+			if _, err := r.Reconcile(ctrl.Request{}); err != nil {
+				t.Fatal(err)
+			}
+
+			testhelper.CompareStrings(t, test.expectedNetwork, fmt.Sprint(store.Get()))
+
+			close(recorder.Events)
+
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+
+			testhelper.CompareStrings(t, test.expectedEvents, strings.Join(events, "\n"))
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package podcidr
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	sourceConfigMap = "configmap"
+	sourceNodes     = "nodes"
+)
+
+type metrics struct {
+	podCIDR *prometheus.GaugeVec
+	changes prometheus.Counter
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/vishvananda/netlink"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/rand"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -19,28 +20,89 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 
+	"github.com/mrincompetent/wireguard-controller/pkg/mesh"
+	"github.com/mrincompetent/wireguard-controller/pkg/readiness"
 	"github.com/mrincompetent/wireguard-controller/pkg/source"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/namespace"
 )
 
 const (
 	name = "route_controller"
+
+	// DefaultTable is the main routing table.
+	DefaultTable = 254
+	// DefaultRulePriority is the priority of the rule, which selects the routing table for the cluster pod CIDR.
+	DefaultRulePriority = 1000
+	// SourceTunnel uses the address of the tunnel interface as preferred source of the pod routes.
+	SourceTunnel = "tunnel"
+	// SourceGateway uses the address of the pod gateway (e.g. the CNI bridge) as preferred source of the pod routes.
+	SourceGateway = "gateway"
+	// SourceNone lets the kernel pick the source address.
+	SourceNone = "none"
+
+	// DefaultProtocol is the route protocol used to tag the routes this controller owns.
+	DefaultProtocol = 92
 )
 
+// PodNetworkStore returns the cluster pod CIDR. It's nil until it got discovered.
+// The Reconciler reads it once at the start of every reconcile, so changes apply without a restart.
+type PodNetworkStore interface {
+	Get() *net.IPNet
+}
+
 type Reconciler struct {
 	client.Client
 	log           *zap.Logger
+	mesh          *mesh.Mesh
 	interfaceName string
+	namespace     *namespace.Namespace
 	nodeName      string
-	metrics       *metrics
+	protocol      int
+	table         int
+	rulePriority  int
+	// ruleStateFile records the installed rules, so they can be removed after the table, priority or pod CIDR changed.
+	ruleStateFile string
+	sourceMode    string
+	// directRouting routes the pod CIDR of nodes, which share a network segment with us, via their node address.
+	// Only the primary mesh installs those routes, as they don't depend on a WireGuard interface.
+	directRouting bool
+	// vxlanInterfaceName is the VXLAN interface used for nodes in the same trusted zone. Empty disables VXLAN.
+	vxlanInterfaceName string
+	podNetStore        PodNetworkStore
+	podNet             *net.IPNet
+	readiness          ReadinessStore
+	metrics            *metrics
+}
+
+// ReadinessStore receives the state of the checks, which gate the CNI config.
+type ReadinessStore interface {
+	Register(mesh, check string)
+	Report(mesh, check string, expected, present int)
 }
 
 func Add(
 	mgr ctrl.Manager,
 	log *zap.Logger,
-	interfaceName,
+	wgMesh *mesh.Mesh,
+	ns *namespace.Namespace,
 	nodeName string,
+	podNetStore PodNetworkStore,
+	protocol,
+	table,
+	rulePriority int,
+	ruleStateFile,
+	sourceMode string,
+	directRouting bool,
+	vxlanInterfaceName string,
+	readinessStore ReadinessStore,
+	resyncInterval time.Duration,
 	metricFactory promauto.Factory,
 ) error {
+	if sourceMode != SourceTunnel && sourceMode != SourceGateway && sourceMode != SourceNone {
+		return fmt.Errorf("%w: %s", ErrInvalidSourceMode, sourceMode)
+	}
+
 	m := &metrics{
 		routeReplaceLatency: metricFactory.NewHistogram(
 			prometheus.HistogramOpts{
@@ -49,33 +111,88 @@ func Add(
 				Buckets: prometheus.ExponentialBuckets(0.001, 2, 10),
 			},
 		),
+		routes: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "netlink_routes",
+				Help: "Number of pod routes managed by the controller.",
+			},
+		),
+		routeChanges: metricFactory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "netlink_route_changes_total",
+				Help: "Number of routes installed, replaced & removed by the controller.",
+			},
+			[]string{"operation"},
+		),
+		ruleChanges: metricFactory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "netlink_rule_changes_total",
+				Help: "Number of routing rules installed & removed by the controller.",
+			},
+			[]string{"operation"},
+		),
 	}
 
+	controllerName := wgMesh.ControllerName(name)
+
+	readinessStore.Register(wgMesh.InterfaceName, readiness.CheckRoutes)
+
 	options := controller.Options{
 		MaxConcurrentReconciles: 1,
 		Reconciler: &Reconciler{
-			Client:        mgr.GetClient(),
-			log:           log.Named(name),
-			interfaceName: interfaceName,
-			nodeName:      nodeName,
-			metrics:       m,
+			Client:             mgr.GetClient(),
+			log:                log.Named(controllerName),
+			mesh:               wgMesh,
+			interfaceName:      wgMesh.InterfaceName,
+			namespace:          ns,
+			nodeName:           nodeName,
+			protocol:           protocol,
+			table:              table,
+			rulePriority:       rulePriority,
+			ruleStateFile:      ruleStateFile,
+			sourceMode:         sourceMode,
+			directRouting:      directRouting,
+			vxlanInterfaceName: vxlanInterfaceName,
+			podNetStore:        podNetStore,
+			readiness:          readinessStore,
+			metrics:            m,
 		},
 	}
 
-	c, err := controller.New(name, mgr, options)
+	c, err := controller.New(controllerName, mgr, options)
 	if err != nil {
 		return fmt.Errorf("failed to create new controller: %w", err)
 	}
 
-	return c.Watch(source.NewIntervalSource(5*time.Second), &handler.EnqueueRequestForObject{})
+	// Netlink events let us repair deleted routes right away. The interval catches node changes and missed events.
+	if err := c.Watch(source.NewNetlinkSource(log, ns, wgMesh.InterfaceName, protocol), &handler.EnqueueRequestForObject{}); err != nil {
+		return fmt.Errorf("unable to watch netlink events: %w", err)
+	}
+
+	return c.Watch(source.NewIntervalSource(resyncInterval), &handler.EnqueueRequestForObject{})
 }
 
+var ErrInvalidSourceMode = fmt.Errorf("invalid route source mode. Must be one of %s, %s or %s", SourceTunnel, SourceGateway, SourceNone)
+
 func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
 	log := r.log.With(zap.String("sync_id", rand.String(12)))
 	log.Debug("Processing")
 
-	link, err := netlink.LinkByName(r.interfaceName)
+	r.podNet = r.podNetStore.Get()
+	if r.podNet == nil {
+		log.Debug("Skipping as the cluster pod CIDR is not known yet")
+
+		return ctrl.Result{}, nil
+	}
+
+	handle, err := r.namespace.Handle()
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to get a netlink handle: %w", err)
+	}
+	defer handle.Delete()
+
+	link, err := handle.LinkByName(r.interfaceName)
 	if err != nil {
 		// In case the interface was not created yet we requeue
 		if errors.As(err, &netlink.LinkNotFoundError{}) {
@@ -87,6 +204,18 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, fmt.Errorf("unable to get interface details: %w", err)
 	}
 
+	// The rule is shared by all meshes. Thus only the primary mesh manages it.
+	if r.mesh.Primary {
+		if err := r.setupRule(log, handle); err != nil {
+			return ctrl.Result{}, fmt.Errorf("unable to setup the routing rule: %w", err)
+		}
+	}
+
+	existingRoutes, err := r.ownedRoutes(handle, link)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to list the existing routes: %w", err)
+	}
+
 	nodeList := &corev1.NodeList{}
 	if err := r.List(ctx, nodeList); err != nil {
 		return ctrl.Result{}, fmt.Errorf("unable to list nodes: %w", err)
@@ -94,48 +223,344 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 	var combinedErr error
 
+	ownNode := findNode(nodeList, r.nodeName)
+
+	src, err := r.preferredSource(log, handle, ownNode)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to determine the preferred source address: %w", err)
+	}
+
+	backends := r.backendSelector(ownNode)
+
+	// Rejected routes are reported by the WireGuard interface controller
+	advertisedRoutes, _ := kubernetes.ValidateAdvertisedRoutes(nodeList.Items, r.podNet)
+	// Conflicting pod CIDRs are reported by the WireGuard interface controller
+	rejectedNodes, _ := kubernetes.ValidatePodCIDRs(nodeList.Items, r.podNet)
+
+	var (
+		desiredRoutes = map[string]bool{}
+		// routedNodes counts the nodes whose routes are all in place
+		expectedNodes, routedNodes int
+	)
+
 	for i := range nodeList.Items {
 		if nodeList.Items[i].Name == r.nodeName {
 			// Do not setup routes for the local node.
 			continue
 		}
 
+		backend := backends.Backend(&nodeList.Items[i])
+
+		if backend == kubernetes.BackendWireGuard && (ownNode == nil || !r.mesh.Connects(ownNode, &nodeList.Items[i])) {
+			// The node is reachable through another mesh
+			continue
+		}
+
+		if backend != kubernetes.BackendWireGuard && !r.mesh.Primary {
+			// Nodes which are not reached through WireGuard are handled by the primary mesh
+			continue
+		}
+
 		nodeLog := log.With(zap.String("node", nodeList.Items[i].Name))
-		if err := r.setupRoute(nodeLog, link, &nodeList.Items[i]); err != nil {
-			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to setup route for node '%s': %w", nodeList.Items[i].Name, err))
+
+		if kubernetes.PodCIDR(&nodeList.Items[i]) == "" {
+			nodeLog.Debug("Skipping node as it has no pod CIDR yet")
+
+			continue
+		}
+
+		if rejectedNodes[nodeList.Items[i].Name] {
+			nodeLog.Debug("Skipping node as its pod CIDR conflicts")
+
+			continue
+		}
+
+		expectedNodes++
+
+		hop, err := r.nexthop(handle, link, backends, backend, &nodeList.Items[i])
+		if err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to determine the %s nexthop for node '%s': %w", backend, nodeList.Items[i].Name, err))
+
+			continue
+		}
+
+		routes, err := r.nodeRoutes(hop, &nodeList.Items[i], src, advertisedRoutes[nodeList.Items[i].Name])
+		if err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to build routes for node '%s': %w", nodeList.Items[i].Name, err))
+
+			continue
+		}
+
+		routed := true
+
+		for _, route := range routes {
+			desiredRoutes[routeKey(route)] = true
+
+			if err := r.setupRoute(nodeLog, handle, route, existingRoutes[routeKey(route)]); err != nil {
+				combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to setup route %s for node '%s': %w", route.Dst.String(), nodeList.Items[i].Name, err))
+				routed = false
+			}
+		}
+
+		if routed {
+			routedNodes++
+		}
+	}
+
+	r.metrics.routes.Set(float64(len(desiredRoutes)))
+	r.readiness.Report(r.mesh.InterfaceName, readiness.CheckRoutes, expectedNodes, routedNodes)
+
+	if combinedErr != nil {
+		// We don't know which routes belong to the failed nodes. Thus we don't clean up until all nodes got processed.
+		return ctrl.Result{}, fmt.Errorf("failed to setup routes for all nodes: %w", combinedErr)
+	}
+
+	for key := range existingRoutes {
+		if desiredRoutes[key] {
+			continue
+		}
+
+		route := existingRoutes[key]
+		if err := handle.RouteDel(route); err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to remove stale route %s: %w", route.String(), err))
 
 			continue
 		}
+
+		r.metrics.routeChanges.WithLabelValues(routeOperationRemove).Inc()
+		log.Info("Removed stale route", zap.String("route", route.String()))
 	}
 
 	if combinedErr != nil {
-		return ctrl.Result{}, fmt.Errorf("failed to setup routes for all nodes: %w", err)
+		return ctrl.Result{}, fmt.Errorf("failed to remove all stale routes: %w", combinedErr)
 	}
 
 	return ctrl.Result{}, nil
 }
 
-func (r *Reconciler) setupRoute(log *zap.Logger, link netlink.Link, node *corev1.Node) error {
-	_, podCIDRNet, err := net.ParseCIDR(node.Spec.PodCIDR)
+// routeKey identifies a route by its table & destination.
+func routeKey(route *netlink.Route) string {
+	return fmt.Sprintf("%d/%s", route.Table, route.Dst.String())
+}
+
+// ownedRoutes returns all routes, which got installed by this controller, indexed by routeKey.
+// They are identified by the route protocol and either the link or, for the primary mesh, a gateway (direct & VXLAN routes).
+// Routes from all tables are returned, so routes in a previously configured table get cleaned up.
+func (r *Reconciler) ownedRoutes(handle *netlink.Handle, link netlink.Link) (map[string]*netlink.Route, error) {
+	filter := &netlink.Route{
+		Protocol: r.protocol,
+		Table:    unix.RT_TABLE_UNSPEC,
+	}
+
+	routes, err := handle.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.filterOwnedRoutes(routes, link.Attrs().Index), nil
+}
+
+// filterOwnedRoutes returns the routes of the mesh indexed by routeKey.
+// WireGuard routes use the link of the mesh. Routes via a gateway belong to the primary mesh.
+func (r *Reconciler) filterOwnedRoutes(routes []netlink.Route, linkIndex int) map[string]*netlink.Route {
+	owned := make(map[string]*netlink.Route, len(routes))
+	for i := range routes {
+		if routes[i].Dst == nil || routes[i].Protocol != r.protocol {
+			continue
+		}
+
+		direct := routes[i].Gw != nil
+		if (direct && !r.mesh.Primary) || (!direct && routes[i].LinkIndex != linkIndex) {
+			continue
+		}
+
+		owned[routeKey(&routes[i])] = &routes[i]
+	}
+
+	return owned
+}
+
+// preferredSource returns the source address for the pod routes.
+// Setting it ensures traffic from the host to remote pods uses an address from the pod network,
+// so replies get routed back through the tunnel.
+// The gateway address is only used if it's assigned on the host, which is the case for the bridge plugin.
+// The bundled CNI plugin routes pods via a link-local gateway, so the tunnel address gets used instead.
+func (r *Reconciler) preferredSource(log *zap.Logger, handle *netlink.Handle, ownNode *corev1.Node) (net.IP, error) {
+	if r.sourceMode == SourceNone {
+		return nil, nil
+	}
+
+	if ownNode == nil || kubernetes.PodCIDR(ownNode) == "" {
+		log.Debug("Not setting a preferred source as the node we're running on has no pod CIDR yet")
+
+		return nil, nil
+	}
+
+	if r.sourceMode == SourceGateway {
+		gateway, err := kubernetes.GatewayAddress(ownNode)
+		if err != nil {
+			return nil, err
+		}
+
+		local, err := isLocalAddress(handle, gateway)
+		if err != nil {
+			return nil, err
+		}
+
+		if local {
+			return gateway, nil
+		}
+
+		log.Debug("Using the tunnel address as preferred source, as the gateway address is not assigned on the host", zap.Stringer("gateway", gateway))
+	}
+
+	return kubernetes.TunnelAddress(ownNode)
+}
+
+// isLocalAddress returns true if the address is assigned to an interface.
+func isLocalAddress(handle *netlink.Handle, ip net.IP) (bool, error) {
+	addresses, err := handle.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return false, fmt.Errorf("unable to list addresses: %w", err)
+	}
+
+	for i := range addresses {
+		if addresses[i].IP.Equal(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func findNode(nodeList *corev1.NodeList, name string) *corev1.Node {
+	for i := range nodeList.Items {
+		if nodeList.Items[i].Name == name {
+			return &nodeList.Items[i]
+		}
+	}
+
+	return nil
+}
+
+// backendSelector returns the backend decisions for the own node.
+// Without an own node, all nodes are reached through WireGuard.
+func (r *Reconciler) backendSelector(ownNode *corev1.Node) *kubernetes.BackendSelector {
+	if ownNode == nil || (!r.directRouting && r.vxlanInterfaceName == "") {
+		return nil
+	}
+
+	return kubernetes.NewBackendSelector(ownNode, r.directRouting, r.vxlanInterfaceName != "")
+}
+
+// nexthop describes where the routes of a node point to.
+type nexthop struct {
+	linkIndex int
+	gateway   net.IP
+	onlink    bool
+}
+
+// nexthop returns the nexthop for the node, depending on the backend it's reached through.
+func (r *Reconciler) nexthop(handle *netlink.Handle, link netlink.Link, backends *kubernetes.BackendSelector, backend kubernetes.Backend, node *corev1.Node) (nexthop, error) {
+	switch backend {
+	case kubernetes.BackendDirect:
+		gateway := backends.DirectGateway(node)
+
+		linkIndex, err := gatewayLinkIndex(handle, gateway)
+		if err != nil {
+			return nexthop{}, err
+		}
+
+		return nexthop{linkIndex: linkIndex, gateway: gateway}, nil
+	case kubernetes.BackendVXLAN:
+		vxlanLink, err := handle.LinkByName(r.vxlanInterfaceName)
+		if err != nil {
+			return nexthop{}, fmt.Errorf("unable to get the VXLAN interface: %w", err)
+		}
+
+		// The tunnel address of the node is resolved by a static neighbor entry on the VXLAN interface
+		gateway, err := kubernetes.TunnelAddress(node)
+		if err != nil {
+			return nexthop{}, err
+		}
+
+		return nexthop{linkIndex: vxlanLink.Attrs().Index, gateway: gateway, onlink: true}, nil
+	default:
+		return nexthop{linkIndex: link.Attrs().Index}, nil
+	}
+}
+
+// gatewayLinkIndex returns the index of the link the gateway is reachable through.
+func gatewayLinkIndex(handle *netlink.Handle, gateway net.IP) (int, error) {
+	routes, err := handle.RouteGet(gateway)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(routes) == 0 {
+		return 0, fmt.Errorf("no route to %s", gateway.String())
+	}
+
+	return routes[0].LinkIndex, nil
+}
+
+// nodeRoutes returns the routes to the node's pod CIDR and the routes the node advertises.
+func (r *Reconciler) nodeRoutes(hop nexthop, node *corev1.Node, src net.IP, advertised kubernetes.Networks) ([]*netlink.Route, error) {
+	_, podCIDRNet, err := net.ParseCIDR(kubernetes.PodCIDR(node))
 	if err != nil {
-		return fmt.Errorf("unable to parse pod CIDR: %w", err)
+		return nil, fmt.Errorf("unable to parse pod CIDR: %w", err)
+	}
+
+	destinations := append([]net.IPNet{*podCIDRNet}, advertised...)
+	routes := make([]*netlink.Route, len(destinations))
+
+	for i := range destinations {
+		routes[i] = &netlink.Route{
+			LinkIndex: hop.linkIndex,
+			Gw:        hop.gateway,
+			Dst:       &destinations[i],
+			Table:     r.table,
+			Protocol:  r.protocol,
+			Src:       src,
+		}
+
+		if hop.onlink {
+			routes[i].SetFlag(netlink.FLAG_ONLINK)
+		}
 	}
 
-	route := netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst:       podCIDRNet,
-		Table:     254,
+	return routes, nil
+}
+
+// routeUpToDate compares the fields the controller manages.
+func routeUpToDate(existing, desired *netlink.Route) bool {
+	return existing.LinkIndex == desired.LinkIndex &&
+		existing.Table == desired.Table &&
+		existing.Protocol == desired.Protocol &&
+		existing.Gw.Equal(desired.Gw) &&
+		existing.Src.Equal(desired.Src)
+}
+
+func (r *Reconciler) setupRoute(log *zap.Logger, handle *netlink.Handle, route, existing *netlink.Route) error {
+	if existing != nil && routeUpToDate(existing, route) {
+		return nil
 	}
 
 	start := time.Now()
 
-	if err := netlink.RouteReplace(&route); err != nil {
+	if err := handle.RouteReplace(route); err != nil {
 		return fmt.Errorf("unable to replace route: %w", err)
 	}
 
 	r.metrics.routeReplaceLatency.Observe(time.Since(start).Seconds())
 
-	log.Debug("Replaced route", zap.String("route", route.String()))
+	if existing == nil {
+		r.metrics.routeChanges.WithLabelValues(routeOperationInstall).Inc()
+		log.Info("Installed route", zap.String("route", route.String()))
+	} else {
+		r.metrics.routeChanges.WithLabelValues(routeOperationReplace).Inc()
+		log.Info("Replaced route", zap.String("route", route.String()))
+	}
 
 	return nil
 }
@@ -0,0 +1,227 @@
+package route
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/mesh"
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func parseNet(t *testing.T, cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return network
+}
+
+func TestOwnsRule(t *testing.T) {
+	podNet := parseNet(t, "10.244.0.0/16")
+
+	tests := []struct {
+		name     string
+		table    int
+		rule     netlink.Rule
+		expected bool
+	}{
+		{
+			name:     "our priority & table",
+			table:    100,
+			rule:     netlink.Rule{Priority: DefaultRulePriority, Table: 100, Dst: podNet},
+			expected: true,
+		},
+		{
+			name:     "our priority & table with an old pod CIDR",
+			table:    100,
+			rule:     netlink.Rule{Priority: DefaultRulePriority, Table: 100, Dst: parseNet(t, "172.25.0.0/16")},
+			expected: true,
+		},
+		{
+			name:  "same priority of another daemon",
+			table: 100,
+			rule:  netlink.Rule{Priority: DefaultRulePriority, Table: 200},
+		},
+		{
+			name:  "pod CIDR rule of another daemon",
+			table: 100,
+			rule:  netlink.Rule{Priority: 2000, Table: 200, Dst: podNet},
+		},
+		{
+			name:  "main table manages no rules",
+			table: DefaultTable,
+			rule:  netlink.Rule{Priority: DefaultRulePriority, Table: DefaultTable, Dst: podNet},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Reconciler{table: test.table, rulePriority: DefaultRulePriority, podNet: podNet}
+
+			if got := r.ownsRule(&test.rule); got != test.expected {
+				t.Errorf("expected ownsRule to return %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestStaleRules(t *testing.T) {
+	podNet := parseNet(t, "10.244.0.0/16")
+	oldRule := netlink.Rule{Priority: DefaultRulePriority, Table: 100, Dst: podNet}
+	foreignRule := netlink.Rule{Priority: 2000, Table: 300, Dst: podNet}
+
+	tests := []struct {
+		name          string
+		table         int
+		priority      int
+		recorded      []netlink.Rule
+		expectedStale string
+		expectedFound bool
+	}{
+		{
+			name:          "unchanged config",
+			table:         100,
+			priority:      DefaultRulePriority,
+			recorded:      []netlink.Rule{oldRule},
+			expectedFound: true,
+		},
+		{
+			name:          "table changed",
+			table:         200,
+			priority:      DefaultRulePriority,
+			recorded:      []netlink.Rule{oldRule},
+			expectedStale: ruleKey(&oldRule),
+		},
+		{
+			name:          "priority changed",
+			table:         100,
+			priority:      500,
+			recorded:      []netlink.Rule{oldRule},
+			expectedStale: ruleKey(&oldRule),
+		},
+		{
+			name:          "switched back to the main table",
+			table:         DefaultTable,
+			priority:      DefaultRulePriority,
+			recorded:      []netlink.Rule{oldRule},
+			expectedStale: ruleKey(&oldRule),
+		},
+		{
+			name:     "table changed without a recorded state",
+			table:    200,
+			priority: DefaultRulePriority,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Reconciler{table: test.table, rulePriority: test.priority, podNet: podNet}
+
+			recorded := map[string]bool{}
+			for i := range test.recorded {
+				recorded[ruleKey(&test.recorded[i])] = true
+			}
+
+			var desired *netlink.Rule
+			if test.table != DefaultTable {
+				desired = &netlink.Rule{Priority: test.priority, Table: test.table, Dst: podNet}
+			}
+
+			stale, found := r.staleRules([]netlink.Rule{oldRule, foreignRule}, recorded, desired)
+
+			var keys []string
+			for i := range stale {
+				keys = append(keys, ruleKey(&stale[i]))
+			}
+
+			testhelper.CompareStrings(t, test.expectedStale, strings.Join(keys, " "))
+
+			if found != test.expectedFound {
+				t.Errorf("expected found to be %t, got %t", test.expectedFound, found)
+			}
+		})
+	}
+}
+
+func TestOwnedRulesRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules")
+
+	owned, err := readOwnedRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(owned) != 0 {
+		t.Fatalf("expected no owned rules without a state file, got %v", owned)
+	}
+
+	expected := map[string]bool{"1000 100 10.244.0.0/16": true, "1000 200 10.244.0.0/16": true}
+	if err := writeOwnedRules(path, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	owned, err = readOwnedRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testhelper.CompareStrings(t, fmt.Sprint(expected), fmt.Sprint(owned))
+}
+
+func TestFilterOwnedRoutes(t *testing.T) {
+	const linkIndex = 5
+
+	routes := []netlink.Route{
+		{Dst: parseNet(t, "10.244.1.0/24"), LinkIndex: linkIndex, Protocol: DefaultProtocol, Table: DefaultTable},
+		{Dst: parseNet(t, "10.244.2.0/24"), LinkIndex: 6, Protocol: DefaultProtocol, Table: DefaultTable},
+		{Dst: parseNet(t, "10.244.3.0/24"), LinkIndex: 2, Gw: net.ParseIP("192.168.1.3"), Protocol: DefaultProtocol, Table: DefaultTable},
+		{Dst: parseNet(t, "10.244.4.0/24"), LinkIndex: linkIndex, Protocol: 4, Table: DefaultTable},
+		{Dst: parseNet(t, "10.244.5.0/24"), LinkIndex: linkIndex, Protocol: DefaultProtocol, Table: 100},
+		{LinkIndex: linkIndex, Protocol: DefaultProtocol, Table: DefaultTable},
+	}
+
+	tests := []struct {
+		name     string
+		primary  bool
+		expected string
+	}{
+		{
+			name:     "primary mesh owns gateway routes",
+			primary:  true,
+			expected: "100/10.244.5.0/24 254/10.244.1.0/24 254/10.244.3.0/24",
+		},
+		{
+			name:     "other meshes only own routes via their link",
+			expected: "100/10.244.5.0/24 254/10.244.1.0/24",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Reconciler{protocol: DefaultProtocol, mesh: &mesh.Mesh{Primary: test.primary}}
+
+			var keys []string
+			for key := range r.filterOwnedRoutes(routes, linkIndex) {
+				keys = append(keys, key)
+			}
+
+			sort.Strings(keys)
+			testhelper.CompareStrings(t, test.expected, strings.Join(keys, " "))
+		})
+	}
+}
@@ -2,6 +2,15 @@ package route
 
 import "github.com/prometheus/client_golang/prometheus"
 
+const (
+	routeOperationInstall = "install"
+	routeOperationReplace = "replace"
+	routeOperationRemove  = "remove"
+)
+
 type metrics struct {
 	routeReplaceLatency prometheus.Histogram
+	routes              prometheus.Gauge
+	routeChanges        *prometheus.CounterVec
+	ruleChanges         *prometheus.CounterVec
 }
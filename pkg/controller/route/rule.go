@@ -0,0 +1,195 @@
+package route
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// setupRule makes sure traffic to the cluster pod CIDR uses the configured routing table.
+// Routes in the main table don't need a rule, so only previously installed rules get removed in that case.
+// The installed rules get recorded in the rule state file, as the kernel offers no way to tag them.
+// That way rules installed with a previous table, priority or pod CIDR can still be identified & removed.
+// Without a recorded state only rules with our priority pointing to our table are considered owned, as other daemons might use the same priority.
+func (r *Reconciler) setupRule(log *zap.Logger, handle *netlink.Handle) error {
+	recorded, err := readOwnedRules(r.ruleStateFile)
+	if err != nil {
+		return err
+	}
+
+	var desired *netlink.Rule
+	if r.table != DefaultTable {
+		desired = netlink.NewRule()
+		desired.Family = netlink.FAMILY_V4
+		desired.Priority = r.rulePriority
+		desired.Table = r.table
+		desired.Dst = r.podNet
+
+		// Record the rule before installing it, so it does not get lost if we die in between
+		if !recorded[ruleKey(desired)] {
+			recorded[ruleKey(desired)] = true
+			if err := writeOwnedRules(r.ruleStateFile, recorded); err != nil {
+				return err
+			}
+		}
+	}
+
+	rules, err := handle.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("unable to list rules: %w", err)
+	}
+
+	stale, found := r.staleRules(rules, recorded, desired)
+
+	var combinedErr error
+
+	stillOwned := map[string]bool{}
+	if desired != nil {
+		stillOwned[ruleKey(desired)] = true
+	}
+
+	for i := range stale {
+		if err := handle.RuleDel(&stale[i]); err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to remove stale rule '%s': %w", stale[i].String(), err))
+			// Keep the ownership, so we try again
+			stillOwned[ruleKey(&stale[i])] = true
+
+			continue
+		}
+
+		r.metrics.ruleChanges.WithLabelValues(routeOperationRemove).Inc()
+		log.Info("Removed stale rule", zap.String("rule", stale[i].String()), zap.Int("table", stale[i].Table))
+	}
+
+	if desired != nil && !found {
+		if err := handle.RuleAdd(desired); err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to add rule: %w", err))
+		} else {
+			r.metrics.ruleChanges.WithLabelValues(routeOperationInstall).Inc()
+			log.Info("Installed rule", zap.String("rule", desired.String()), zap.Int("table", desired.Table))
+		}
+	}
+
+	if err := writeOwnedRules(r.ruleStateFile, stillOwned); err != nil {
+		combinedErr = multierr.Append(combinedErr, err)
+	}
+
+	return combinedErr
+}
+
+// staleRules returns the owned rules, which don't match the desired rule.
+// A nil desired rule means no rule is wanted, so all owned rules are stale.
+// The second return value reports whether the desired rule already exists.
+func (r *Reconciler) staleRules(rules []netlink.Rule, recorded map[string]bool, desired *netlink.Rule) ([]netlink.Rule, bool) {
+	var (
+		stale []netlink.Rule
+		found bool
+	)
+
+	for i := range rules {
+		if !recorded[ruleKey(&rules[i])] && !r.ownsRule(&rules[i]) {
+			continue
+		}
+
+		if desired != nil && ruleMatches(&rules[i], desired) {
+			found = true
+
+			continue
+		}
+
+		stale = append(stale, rules[i])
+	}
+
+	return stale, found
+}
+
+func (r *Reconciler) ownsRule(rule *netlink.Rule) bool {
+	return r.table != DefaultTable && rule.Priority == r.rulePriority && rule.Table == r.table
+}
+
+func ruleMatches(existing, desired *netlink.Rule) bool {
+	return existing.Priority == desired.Priority &&
+		existing.Table == desired.Table &&
+		existing.Dst != nil &&
+		existing.Dst.String() == desired.Dst.String()
+}
+
+// ruleKey identifies a rule by its priority, table & destination.
+func ruleKey(rule *netlink.Rule) string {
+	dst := ""
+	if rule.Dst != nil {
+		dst = rule.Dst.String()
+	}
+
+	return fmt.Sprintf("%d %d %s", rule.Priority, rule.Table, dst)
+}
+
+// readOwnedRules returns the keys of the rules recorded in the state file.
+// An empty path disables the state file.
+func readOwnedRules(path string) (map[string]bool, error) {
+	owned := map[string]bool{}
+
+	if path == "" {
+		return owned, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return owned, nil
+		}
+
+		return nil, fmt.Errorf("unable to read the rule state file: %w", err)
+	}
+
+	for _, key := range strings.Split(string(content), "\n") {
+		if key = strings.TrimSpace(key); key != "" {
+			owned[key] = true
+		}
+	}
+
+	return owned, nil
+}
+
+// writeOwnedRules replaces the rule state file.
+func writeOwnedRules(path string, owned map[string]bool) error {
+	if path == "" {
+		return nil
+	}
+
+	keys := make([]string, 0, len(owned))
+	for key := range owned {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	content := strings.Join(keys, "\n")
+	if len(keys) > 0 {
+		content += "\n"
+	}
+
+	current, err := ioutil.ReadFile(path)
+	if err == nil && string(current) == content {
+		return nil
+	}
+
+	// Write to a temporary file & rename it, so a crash never leaves a partially written state behind
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		return fmt.Errorf("unable to write the rule state file: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("unable to move the rule state file into place: %w", err)
+	}
+
+	return nil
+}
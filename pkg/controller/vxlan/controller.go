@@ -0,0 +1,204 @@
+package vxlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/source"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/namespace"
+)
+
+const (
+	name = "vxlan_controller"
+
+	// DefaultInterfaceName is the name of the VXLAN interface.
+	DefaultInterfaceName = "vxlan-kube"
+	// DefaultVNI is the VXLAN network identifier.
+	DefaultVNI = 1
+	// DefaultPort is the UDP port used for VXLAN. It matches the Linux default.
+	DefaultPort = 8472
+	// DefaultMTU leaves room for the VXLAN header on a 1500 byte underlay.
+	DefaultMTU = 1450
+)
+
+// PodNetworkStore returns the cluster pod CIDR. It's nil until it got discovered.
+// The Reconciler reads it once at the start of every reconcile, so changes apply without a restart.
+type PodNetworkStore interface {
+	Get() *net.IPNet
+}
+
+// Reconciler manages the VXLAN interface, which connects the nodes of the same trusted zone without encryption.
+// Routes via the interface get managed by the route controller.
+type Reconciler struct {
+	client.Client
+	log           *zap.Logger
+	interfaceName string
+	vni           int
+	port          int
+	mtu           int
+	namespace     *namespace.Namespace
+	nodeName      string
+	podNetStore   PodNetworkStore
+	podNet        *net.IPNet
+	directRouting bool
+	metrics       *metrics
+}
+
+func Add(
+	mgr ctrl.Manager,
+	log *zap.Logger,
+	interfaceName string,
+	vni,
+	port,
+	mtu int,
+	ns *namespace.Namespace,
+	nodeName string,
+	podNetStore PodNetworkStore,
+	directRouting bool,
+	resyncInterval time.Duration,
+	metricFactory promauto.Factory,
+) error {
+	m := &metrics{
+		peers: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "vxlan_peer_count",
+				Help: "Number of nodes reached through the VXLAN interface.",
+			},
+		),
+		entryChanges: metricFactory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vxlan_entry_changes_total",
+				Help: "Number of neighbor & forwarding database entries set & removed by the controller.",
+			},
+			[]string{"operation"},
+		),
+	}
+
+	options := controller.Options{
+		MaxConcurrentReconciles: 1,
+		Reconciler: &Reconciler{
+			Client:        mgr.GetClient(),
+			log:           log.Named(name),
+			interfaceName: interfaceName,
+			vni:           vni,
+			port:          port,
+			mtu:           mtu,
+			namespace:     ns,
+			nodeName:      nodeName,
+			podNetStore:   podNetStore,
+			directRouting: directRouting,
+			metrics:       m,
+		},
+	}
+
+	c, err := controller.New(name, mgr, options)
+	if err != nil {
+		return fmt.Errorf("failed to create new controller: %w", err)
+	}
+
+	if err := c.Watch(source.NewNetlinkSource(log, ns, interfaceName, 0), &handler.EnqueueRequestForObject{}); err != nil {
+		return fmt.Errorf("unable to watch netlink events: %w", err)
+	}
+
+	return c.Watch(source.NewIntervalSource(resyncInterval), &handler.EnqueueRequestForObject{})
+}
+
+func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.log.With(zap.String("sync_id", rand.String(12)))
+	log.Debug("Processing")
+
+	r.podNet = r.podNetStore.Get()
+	if r.podNet == nil {
+		log.Debug("Skipping as the cluster pod CIDR is not known yet")
+
+		return ctrl.Result{}, nil
+	}
+
+	nodeList := &corev1.NodeList{}
+	if err := r.List(ctx, nodeList); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to list nodes: %w", err)
+	}
+
+	var ownNode *corev1.Node
+
+	for i := range nodeList.Items {
+		if nodeList.Items[i].Name == r.nodeName {
+			ownNode = &nodeList.Items[i]
+
+			break
+		}
+	}
+
+	if ownNode == nil || kubernetes.PodCIDR(ownNode) == "" {
+		log.Debug("Skipping as the node we're running on has no pod CIDR yet")
+
+		return ctrl.Result{}, nil
+	}
+
+	handle, err := r.namespace.Handle()
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to get a netlink handle: %w", err)
+	}
+	defer handle.Delete()
+
+	link, err := r.configureInterface(log, handle, ownNode)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to configure the VXLAN interface: %w", err)
+	}
+
+	backends := kubernetes.NewBackendSelector(ownNode, r.directRouting, true)
+
+	// Conflicting pod CIDRs are reported by the WireGuard interface controller
+	rejectedNodes, _ := kubernetes.ValidatePodCIDRs(nodeList.Items, r.podNet)
+
+	var (
+		combinedErr error
+		peers       []peer
+	)
+
+	for i := range nodeList.Items {
+		if backends.Backend(&nodeList.Items[i]) != kubernetes.BackendVXLAN {
+			continue
+		}
+
+		if kubernetes.PodCIDR(&nodeList.Items[i]) == "" || rejectedNodes[nodeList.Items[i].Name] {
+			continue
+		}
+
+		p, err := peerForNode(&nodeList.Items[i])
+		if err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("node '%s': %w", nodeList.Items[i].Name, err))
+
+			continue
+		}
+
+		peers = append(peers, p)
+	}
+
+	r.metrics.peers.Set(float64(len(peers)))
+
+	if err := r.configureEntries(log, handle, link, peers, combinedErr == nil); err != nil {
+		combinedErr = multierr.Append(combinedErr, err)
+	}
+
+	if combinedErr != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to configure all VXLAN peers: %w", combinedErr)
+	}
+
+	return ctrl.Result{}, nil
+}
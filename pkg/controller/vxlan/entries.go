@@ -0,0 +1,186 @@
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+// peer describes how to reach a node through the VXLAN interface.
+type peer struct {
+	node string
+	// tunnelIP is the nexthop of the routes to the node
+	tunnelIP net.IP
+	// mac is the MAC address of the node's VXLAN interface
+	mac net.HardwareAddr
+	// underlayIP is the address the encapsulated packets get sent to
+	underlayIP net.IP
+}
+
+func peerForNode(node *corev1.Node) (peer, error) {
+	tunnelIP, err := kubernetes.TunnelAddress(node)
+	if err != nil {
+		return peer{}, err
+	}
+
+	mac, err := kubernetes.VXLANAddress(node)
+	if err != nil {
+		return peer{}, err
+	}
+
+	underlayIP, err := kubernetes.UnderlayAddress(node)
+	if err != nil {
+		return peer{}, err
+	}
+
+	return peer{
+		node:       node.Name,
+		tunnelIP:   tunnelIP,
+		mac:        mac,
+		underlayIP: underlayIP,
+	}, nil
+}
+
+// configureEntries sets a static neighbor entry, resolving the tunnel address to the MAC address,
+// and a forwarding database entry, sending frames for the MAC address to the node, for each peer.
+// Entries of nodes which are not reached through VXLAN anymore get removed, if removeStale is set.
+func (r *Reconciler) configureEntries(log *zap.Logger, handle *netlink.Handle, link netlink.Link, peers []peer, removeStale bool) error {
+	neighbors, err := handle.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("unable to list the neighbor entries: %w", err)
+	}
+
+	fdbEntries, err := handle.NeighList(link.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("unable to list the forwarding database entries: %w", err)
+	}
+
+	var combinedErr error
+
+	desiredNeighbors := map[string]bool{}
+	desiredFDBEntries := map[string]bool{}
+
+	for _, p := range peers {
+		peerLog := log.With(zap.String("node", p.node))
+
+		neighbor := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       netlink.FAMILY_V4,
+			State:        netlink.NUD_PERMANENT,
+			IP:           p.tunnelIP,
+			HardwareAddr: p.mac,
+		}
+		desiredNeighbors[p.tunnelIP.String()] = true
+
+		if !containsEntry(neighbors, neighbor) {
+			if err := handle.NeighSet(neighbor); err != nil {
+				combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to set the neighbor entry for node '%s': %w", p.node, err))
+			} else {
+				r.metrics.entryChanges.WithLabelValues(entryOperationSet).Inc()
+				peerLog.Info("Set neighbor entry", zap.String("entry", neighbor.String()))
+			}
+		}
+
+		fdbEntry := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       unix.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT,
+			Flags:        netlink.NTF_SELF,
+			IP:           p.underlayIP,
+			HardwareAddr: p.mac,
+		}
+		desiredFDBEntries[p.mac.String()] = true
+
+		if !containsEntry(fdbEntries, fdbEntry) {
+			if err := handle.NeighSet(fdbEntry); err != nil {
+				combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to set the forwarding database entry for node '%s': %w", p.node, err))
+			} else {
+				r.metrics.entryChanges.WithLabelValues(entryOperationSet).Inc()
+				peerLog.Info("Set forwarding database entry", zap.String("entry", fdbEntry.String()))
+			}
+		}
+	}
+
+	if !removeStale || combinedErr != nil {
+		// We don't know which entries belong to the failed nodes. Thus we don't clean up until all nodes got processed.
+		return combinedErr
+	}
+
+	for _, neighbor := range staleNeighbors(neighbors, desiredNeighbors) {
+		neighbor := neighbor
+		if err := handle.NeighDel(&neighbor); err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to remove stale neighbor entry %s: %w", neighbor.String(), err))
+
+			continue
+		}
+
+		r.metrics.entryChanges.WithLabelValues(entryOperationRemove).Inc()
+		log.Info("Removed stale neighbor entry", zap.String("entry", neighbor.String()))
+	}
+
+	for _, fdbEntry := range staleFDBEntries(fdbEntries, desiredFDBEntries) {
+		fdbEntry := fdbEntry
+		if err := handle.NeighDel(&fdbEntry); err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("unable to remove stale forwarding database entry %s: %w", fdbEntry.String(), err))
+
+			continue
+		}
+
+		r.metrics.entryChanges.WithLabelValues(entryOperationRemove).Inc()
+		log.Info("Removed stale forwarding database entry", zap.String("entry", fdbEntry.String()))
+	}
+
+	return combinedErr
+}
+
+// staleNeighbors returns the static neighbor entries, whose tunnel address is not desired anymore.
+// Entries learned by the kernel are left alone.
+func staleNeighbors(neighbors []netlink.Neigh, desired map[string]bool) []netlink.Neigh {
+	var stale []netlink.Neigh
+
+	for i := range neighbors {
+		if neighbors[i].State != netlink.NUD_PERMANENT || desired[neighbors[i].IP.String()] {
+			continue
+		}
+
+		stale = append(stale, neighbors[i])
+	}
+
+	return stale
+}
+
+// staleFDBEntries returns the forwarding database entries pointing to a node, whose MAC address is not desired anymore.
+// Entries without a destination, like the one of the interface itself, are left alone.
+func staleFDBEntries(fdbEntries []netlink.Neigh, desired map[string]bool) []netlink.Neigh {
+	var stale []netlink.Neigh
+
+	for i := range fdbEntries {
+		if fdbEntries[i].IP == nil || desired[fdbEntries[i].HardwareAddr.String()] {
+			continue
+		}
+
+		stale = append(stale, fdbEntries[i])
+	}
+
+	return stale
+}
+
+func containsEntry(entries []netlink.Neigh, desired *netlink.Neigh) bool {
+	for i := range entries {
+		if entries[i].IP.Equal(desired.IP) &&
+			bytes.Equal(entries[i].HardwareAddr, desired.HardwareAddr) &&
+			entries[i].State&netlink.NUD_PERMANENT != 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,201 @@
+package vxlan
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+func parseMAC(t *testing.T, s string) net.HardwareAddr {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mac
+}
+
+func TestPeerForNode(t *testing.T) {
+	tests := []struct {
+		name          string
+		node          *corev1.Node
+		expectedPeer  string
+		expectedError string
+	}{
+		{
+			name: "published endpoint",
+			node: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "node1",
+					Annotations: map[string]string{kubernetes.AnnotationKeyEndpoint: "10.0.0.1:51820"},
+				},
+				Spec: corev1.NodeSpec{PodCIDR: "10.244.1.0/24"},
+				Status: corev1.NodeStatus{
+					Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "192.168.1.1"}},
+				},
+			},
+			expectedPeer:  "node1 10.244.1.0 0a:58:0a:f4:01:00 10.0.0.1",
+			expectedError: "<nil>",
+		},
+		{
+			name: "internal address",
+			node: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+				Spec:       corev1.NodeSpec{PodCIDR: "10.244.1.0/24"},
+				Status: corev1.NodeStatus{
+					Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "192.168.1.1"}},
+				},
+			},
+			expectedPeer:  "node1 10.244.1.0 0a:58:0a:f4:01:00 192.168.1.1",
+			expectedError: "<nil>",
+		},
+		{
+			name: "no address",
+			node: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+				Spec:       corev1.NodeSpec{PodCIDR: "10.244.1.0/24"},
+			},
+			expectedError: "node has neither a published endpoint nor an internal or external address",
+		},
+		{
+			name: "no pod CIDR",
+			node: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+			},
+			expectedError: "unable to parse node pod cidr: invalid CIDR address: ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := peerForNode(test.node)
+
+			testhelper.CompareStrings(t, test.expectedError, fmt.Sprint(err))
+
+			if err == nil {
+				testhelper.CompareStrings(t, test.expectedPeer, fmt.Sprintf("%s %s %s %s", p.node, p.tunnelIP, p.mac, p.underlayIP))
+			}
+		})
+	}
+}
+
+func TestContainsEntry(t *testing.T) {
+	desired := &netlink.Neigh{
+		IP:           net.ParseIP("10.244.1.0"),
+		HardwareAddr: parseMAC(t, "0a:58:0a:f4:01:00"),
+		State:        netlink.NUD_PERMANENT,
+	}
+
+	tests := []struct {
+		name     string
+		entries  []netlink.Neigh
+		expected bool
+	}{
+		{
+			name:     "present",
+			entries:  []netlink.Neigh{*desired},
+			expected: true,
+		},
+		{
+			name: "other MAC address",
+			entries: []netlink.Neigh{{
+				IP:           net.ParseIP("10.244.1.0"),
+				HardwareAddr: parseMAC(t, "0a:58:0a:f4:02:00"),
+				State:        netlink.NUD_PERMANENT,
+			}},
+		},
+		{
+			name: "learned entry",
+			entries: []netlink.Neigh{{
+				IP:           net.ParseIP("10.244.1.0"),
+				HardwareAddr: parseMAC(t, "0a:58:0a:f4:01:00"),
+				State:        netlink.NUD_REACHABLE,
+			}},
+		},
+		{
+			name: "missing",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if contained := containsEntry(test.entries, desired); contained != test.expected {
+				t.Errorf("Expected the entry to be contained: %t, got %t", test.expected, contained)
+			}
+		})
+	}
+}
+
+func TestStaleNeighbors(t *testing.T) {
+	neighbors := []netlink.Neigh{
+		{IP: net.ParseIP("10.244.1.0"), State: netlink.NUD_PERMANENT},
+		{IP: net.ParseIP("10.244.2.0"), State: netlink.NUD_PERMANENT},
+		{IP: net.ParseIP("10.244.3.0"), State: netlink.NUD_REACHABLE},
+	}
+
+	var stale []string
+	for _, neighbor := range staleNeighbors(neighbors, map[string]bool{"10.244.1.0": true}) {
+		stale = append(stale, neighbor.IP.String())
+	}
+
+	testhelper.CompareStrings(t, "[10.244.2.0]", fmt.Sprint(stale))
+}
+
+func TestStaleFDBEntries(t *testing.T) {
+	fdbEntries := []netlink.Neigh{
+		{IP: net.ParseIP("192.168.1.1"), HardwareAddr: parseMAC(t, "0a:58:0a:f4:01:00")},
+		{IP: net.ParseIP("192.168.1.2"), HardwareAddr: parseMAC(t, "0a:58:0a:f4:02:00")},
+		// Entries without destination belong to the interface itself
+		{HardwareAddr: parseMAC(t, "0a:58:0a:f4:03:00")},
+	}
+
+	var stale []string
+	for _, fdbEntry := range staleFDBEntries(fdbEntries, map[string]bool{"0a:58:0a:f4:01:00": true}) {
+		stale = append(stale, fdbEntry.HardwareAddr.String())
+	}
+
+	testhelper.CompareStrings(t, "[0a:58:0a:f4:02:00]", fmt.Sprint(stale))
+}
+
+func TestMatchesLinkSettings(t *testing.T) {
+	r := &Reconciler{vni: 4096, port: 4789}
+
+	tests := []struct {
+		name     string
+		link     netlink.Link
+		expected bool
+	}{
+		{
+			name:     "matching",
+			link:     &netlink.Vxlan{VxlanId: 4096, Port: 4789},
+			expected: true,
+		},
+		{
+			name: "other VNI",
+			link: &netlink.Vxlan{VxlanId: 1, Port: 4789},
+		},
+		{
+			name: "other port",
+			link: &netlink.Vxlan{VxlanId: 4096, Port: 8472},
+		},
+		{
+			name: "no VXLAN interface",
+			link: &netlink.Dummy{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if matches := r.matchesLinkSettings(test.link); matches != test.expected {
+				t.Errorf("Expected the settings to match: %t, got %t", test.expected, matches)
+			}
+		})
+	}
+}
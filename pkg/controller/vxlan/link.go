@@ -0,0 +1,132 @@
+package vxlan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+// configureInterface ensures the VXLAN interface exists with the desired settings, carries the tunnel address & is up.
+func (r *Reconciler) configureInterface(log *zap.Logger, handle *netlink.Handle, node *corev1.Node) (netlink.Link, error) {
+	mac, err := kubernetes.VXLANAddress(node)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := handle.LinkByName(r.interfaceName)
+	if err != nil && !errors.As(err, &netlink.LinkNotFoundError{}) {
+		return nil, fmt.Errorf("unable to get the interface %s: %w", r.interfaceName, err)
+	}
+
+	if link != nil && !r.matchesLinkSettings(link) {
+		// VNI & port cannot be changed on an existing interface
+		log.Info("Recreating the VXLAN interface as its settings changed")
+
+		if err := handle.LinkDel(link); err != nil {
+			return nil, fmt.Errorf("unable to remove the outdated interface: %w", err)
+		}
+
+		link = nil
+	}
+
+	if link == nil {
+		link = &netlink.Vxlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:         r.interfaceName,
+				MTU:          r.mtu,
+				HardwareAddr: mac,
+			},
+			VxlanId:  r.vni,
+			Port:     r.port,
+			Learning: false,
+		}
+
+		if err := handle.LinkAdd(link); err != nil {
+			return nil, fmt.Errorf("unable to create the interface: %w", err)
+		}
+
+		if link, err = handle.LinkByName(r.interfaceName); err != nil {
+			return nil, fmt.Errorf("unable to get the interface %s after creating it: %w", r.interfaceName, err)
+		}
+
+		log.Info("Created the VXLAN interface")
+	}
+
+	if !bytes.Equal(link.Attrs().HardwareAddr, mac) {
+		if err := handle.LinkSetHardwareAddr(link, mac); err != nil {
+			return nil, fmt.Errorf("unable to set the MAC address of the interface: %w", err)
+		}
+
+		log.Info("Configured MAC address on VXLAN interface", zap.Stringer("mac", mac))
+	}
+
+	if link.Attrs().MTU != r.mtu {
+		if err := handle.LinkSetMTU(link, r.mtu); err != nil {
+			return nil, fmt.Errorf("unable to set the MTU of the interface: %w", err)
+		}
+
+		log.Info("Configured MTU on VXLAN interface", zap.Int("mtu", r.mtu))
+	}
+
+	if err := r.configureAddress(log, handle, link, node); err != nil {
+		return nil, err
+	}
+
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err := handle.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf("unable to bring up the interface: %w", err)
+		}
+
+		log.Info("Brought VXLAN interface up")
+	}
+
+	return link, nil
+}
+
+func (r *Reconciler) matchesLinkSettings(link netlink.Link) bool {
+	vxlan, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return false
+	}
+
+	return vxlan.VxlanId == r.vni && vxlan.Port == r.port
+}
+
+// configureAddress assigns the tunnel address, so the kernel has a source address for the traffic through the interface.
+func (r *Reconciler) configureAddress(log *zap.Logger, handle *netlink.Handle, link netlink.Link, node *corev1.Node) error {
+	tunnelIP, err := kubernetes.TunnelAddress(node)
+	if err != nil {
+		return err
+	}
+
+	tunnelAddress, err := netlink.ParseAddr(fmt.Sprintf("%s/32", tunnelIP.String()))
+	if err != nil {
+		return fmt.Errorf("unable to parse the tunnel address: %w", err)
+	}
+
+	addresses, err := handle.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("unable to list interface addresses: %w", err)
+	}
+
+	for _, existingAddr := range addresses {
+		if existingAddr.Equal(*tunnelAddress) {
+			return nil
+		}
+	}
+
+	if err := handle.AddrAdd(link, tunnelAddress); err != nil {
+		return fmt.Errorf("unable to set address on the interface: %w", err)
+	}
+
+	log.Info("Configured address on VXLAN interface", zap.String("address", tunnelAddress.String()))
+
+	return nil
+}
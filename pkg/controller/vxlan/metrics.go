@@ -0,0 +1,13 @@
+package vxlan
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	entryOperationSet    = "set"
+	entryOperationRemove = "remove"
+)
+
+type metrics struct {
+	peers        prometheus.Gauge
+	entryChanges *prometheus.CounterVec
+}
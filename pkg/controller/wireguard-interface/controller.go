@@ -2,7 +2,10 @@ package wireguardinterface
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,27 +17,44 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 
+	"github.com/mrincompetent/wireguard-controller/pkg/mesh"
+	"github.com/mrincompetent/wireguard-controller/pkg/readiness"
 	"github.com/mrincompetent/wireguard-controller/pkg/source"
 	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/namespace"
 )
 
 const (
 	name = "wireguard_interface_controller"
+
+	eventReasonPodCIDRConflict = "PodCIDRConflict"
+	eventReasonRouteRejected   = "AdvertisedRouteRejected"
 )
 
 func Add(
 	ctx context.Context,
 	mgr ctrl.Manager,
 	log *zap.Logger,
-	interfaceName string,
-	listeningPort int,
+	wgMesh *mesh.Mesh,
+	ns *namespace.Namespace,
+	podNetStore PodNetworkStore,
+	firewallMark int,
+	mtu int,
 	nodeName string,
 	keyStore KeyStore,
+	readinessStore ReadinessStore,
+	peerOptions kubernetes.PeerOptions,
+	unmanagedPeerKeys []wgtypes.Key,
+	removeUnknownPeers bool,
+	directRouting bool,
+	vxlan bool,
+	resyncInterval time.Duration,
 	metricFactory promauto.Factory,
 ) error {
 	m := &metrics{
@@ -44,31 +64,100 @@ func Add(
 				Help: "Number of configured WireGuard peers.",
 			},
 		),
+		peerChanges: metricFactory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "wireguard_peer_changes_total",
+				Help: "Number of peer changes applied to the WireGuard interface.",
+			},
+			[]string{"operation"},
+		),
+		peerChangesPerReconcile: metricFactory.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "wireguard_peer_changes_per_reconcile",
+				Help:    "Number of peers which had to be changed during a single reconcile.",
+				Buckets: []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000},
+			},
+		),
+		unknownPeerCount: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "wireguard_unknown_peer_count",
+				Help: "Number of configured WireGuard peers without a corresponding node.",
+			},
+		),
+		unmanagedPeerCount: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "wireguard_unmanaged_peer_count",
+				Help: "Number of public keys which are excluded from being managed by the controller.",
+			},
+		),
+		rejectedRoutes: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "wireguard_rejected_advertised_routes",
+				Help: "Number of routes advertised by nodes which got rejected due to collisions.",
+			},
+		),
+		conflictingPodCIDRs: metricFactory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "wireguard_conflicting_pod_cidrs",
+				Help: "Number of nodes which are not configured as peers, as their pod CIDR is invalid or collides with another network.",
+			},
+		),
+		deviceDrift: metricFactory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "wireguard_device_drift_total",
+				Help: "Number of times a device setting got changed outside of the controller and had to be repaired.",
+			},
+			[]string{"field"},
+		),
 	}
 
+	// Each mesh publishes its peers using its own annotations
+	peerOptions.Annotations = wgMesh.Annotations()
+	controllerName := wgMesh.ControllerName(name)
+
+	readinessStore.Register(wgMesh.InterfaceName, readiness.CheckPeers)
+
 	options := controller.Options{
 		MaxConcurrentReconciles: 1,
 		Reconciler: &Reconciler{
 			Client:        mgr.GetClient(),
-			log:           log.Named(name),
-			listeningPort: listeningPort,
-			interfaceName: interfaceName,
+			log:           log.Named(controllerName),
+			mesh:          wgMesh,
+			listeningPort: wgMesh.ListenPort,
+			firewallMark:  firewallMark,
+			mtu:           mtu,
+			interfaceName: wgMesh.InterfaceName,
+			namespace:     ns,
+			podNetStore:   podNetStore,
 			nodeName:      nodeName,
 			keyStore:      keyStore,
+			readiness:     readinessStore,
+			peerOptions:   peerOptions,
 			metrics:       m,
+			recorder:      mgr.GetEventRecorderFor(controllerName),
+
+			unmanagedPeerKeys:  unmanagedPeerKeys,
+			removeUnknownPeers: removeUnknownPeers,
+			directRouting:      directRouting,
+			vxlan:              vxlan,
 		},
 	}
 
-	if err := kubernetes.RegisterPublicKeyIndexer(ctx, mgr.GetFieldIndexer()); err != nil {
+	if err := kubernetes.RegisterPublicKeyIndexer(ctx, mgr.GetFieldIndexer(), peerOptions.Annotations); err != nil {
 		return fmt.Errorf("unable to register the public key indexer: %w", err)
 	}
 
-	c, err := controller.New(name, mgr, options)
+	c, err := controller.New(controllerName, mgr, options)
 	if err != nil {
 		return fmt.Errorf("failed to create new controller: %w", err)
 	}
 
-	return c.Watch(source.NewIntervalSource(5*time.Second), &handler.EnqueueRequestForObject{})
+	// Netlink events let us repair a downed link or a removed address right away. The interval catches node changes and missed events.
+	if err := c.Watch(source.NewNetlinkSource(log, ns, wgMesh.InterfaceName, 0), &handler.EnqueueRequestForObject{}); err != nil {
+		return fmt.Errorf("unable to watch netlink events: %w", err)
+	}
+
+	return c.Watch(source.NewIntervalSource(resyncInterval), &handler.EnqueueRequestForObject{})
 }
 
 type KeyStore interface {
@@ -76,14 +165,51 @@ type KeyStore interface {
 	Get() wgtypes.Key
 }
 
+// ReadinessStore receives the state of the checks, which gate the CNI config.
+type ReadinessStore interface {
+	Register(mesh, check string)
+	Report(mesh, check string, expected, present int)
+}
+
+// PodNetworkStore returns the cluster pod CIDR. It's nil until it got discovered.
+// The Reconciler reads it once at the start of every reconcile, so changes apply without a restart.
+type PodNetworkStore interface {
+	Get() *net.IPNet
+}
+
 type Reconciler struct {
 	client.Client
 	log           *zap.Logger
+	mesh          *mesh.Mesh
 	listeningPort int
+	firewallMark  int
+	mtu           int
 	nodeName      string
 	interfaceName string
+	namespace     *namespace.Namespace
+	podNetStore   PodNetworkStore
+	podNet        *net.IPNet
 	metrics       *metrics
 	keyStore      KeyStore
+	readiness     ReadinessStore
+	peerOptions   kubernetes.PeerOptions
+	recorder      record.EventRecorder
+
+	unmanagedPeerKeys  []wgtypes.Key
+	removeUnknownPeers bool
+	// directRouting leaves nodes, which share a network segment with us, out of the WireGuard device.
+	directRouting bool
+	// vxlan leaves nodes in the same trusted zone out of the WireGuard device.
+	vxlan bool
+
+	// configured is true once the device got configured by this controller or was found in the desired state.
+	// Differences found afterwards are treated as drift.
+	configured bool
+
+	// podCIDRConflicts contains the reported conflict of each rejected node, so events only get emitted for new conflicts.
+	podCIDRConflicts map[string]string
+	// rejectedRoutes contains the reasons of the rejected advertised routes, so they only get reported when they change.
+	rejectedRoutes map[string]bool
 }
 
 func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
@@ -91,6 +217,13 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	log := r.log.With(zap.String("sync_id", rand.String(12)))
 	log.Debug("Processing")
 
+	r.podNet = r.podNetStore.Get()
+	if r.podNet == nil {
+		log.Debug("Skipping as the cluster pod CIDR is not known yet")
+
+		return ctrl.Result{}, nil
+	}
+
 	var err error
 
 	if !r.keyStore.HasKey() {
@@ -106,11 +239,26 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, fmt.Errorf("unable to load own node: %w", err)
 	}
 
+	if !r.mesh.Selects(ownNode) {
+		log.Debug("Skipping as the node we're running on is not part of the mesh")
+		r.readiness.Report(r.mesh.InterfaceName, readiness.CheckPeers, 0, 0)
+
+		return ctrl.Result{}, nil
+	}
+
 	if err = r.configureInterface(log, ownNode); err != nil {
 		return ctrl.Result{}, fmt.Errorf("unable to configure WireGuard interface: %w", err)
 	}
 
-	wgClient, err := wgctrl.New()
+	// The WireGuard client talks to the kernel using netlink.
+	// Its socket is bound to the namespace it got created in.
+	var wgClient *wgctrl.Client
+
+	err = r.namespace.Do(func() (err error) {
+		wgClient, err = wgctrl.New()
+
+		return err
+	})
 	if err != nil {
 		return ctrl.Result{}, fmt.Errorf("unable to create a new WireGuard client: %w", err)
 	}
@@ -128,38 +276,211 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 	r.metrics.peerCount.Set(float64(len(device.Peers)))
 
-	interfaceConfig := wgtypes.Config{
-		PrivateKey: &key,
-		ListenPort: &r.listeningPort,
+	peerChanges, expectedPeers, reconfigureErrors := r.peerChanges(ctx, log, device, ownNode)
+
+	interfaceConfig, deviceChanged := r.deviceConfig(log, device, key)
+	interfaceConfig.Peers = peerChanges
+
+	r.metrics.peerChangesPerReconcile.Observe(float64(len(peerChanges)))
+
+	applied := false
+
+	// A device, which already matches the desired settings, counts as configured, so drift gets detected after a restart as well
+	if !deviceChanged {
+		r.configured = true
 	}
 
-	var reconfigureErrors error
+	if len(peerChanges) > 0 || deviceChanged {
+		if err := wgClient.ConfigureDevice(r.interfaceName, interfaceConfig); err != nil {
+			if errors.Is(err, syscall.EADDRINUSE) {
+				err = fmt.Errorf("%w: port %d: %v", ErrListenPortInUse, r.listeningPort, err)
+			}
 
-	// Keep the configs indexed by public key
-	// That way we know if we already have a peerConfig or need to add a new one
-	peerConfigs := map[string]*wgtypes.PeerConfig{}
+			reconfigureErrors = multierr.Append(reconfigureErrors, fmt.Errorf("unable to reconfigure interface: %w", err))
+		} else {
+			applied = true
+			r.configured = true
+			r.countPeerChanges(peerChanges)
+		}
+	}
+
+	// Without the list of expected peers we can't tell how many are missing
+	if expectedPeers != nil {
+		r.reportPeers(device, peerChanges, applied, expectedPeers)
+	}
+
+	if reconfigureErrors != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to reconfigure at least one node: %w", reconfigureErrors)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// reportPeers reports how many of the expected peers are configured on the device.
+func (r *Reconciler) reportPeers(device *wgtypes.Device, changes []wgtypes.PeerConfig, applied bool, expectedPeers map[string]bool) {
+	configuredPeers := make(map[string]bool, len(device.Peers))
+	for i := range device.Peers {
+		configuredPeers[device.Peers[i].PublicKey.String()] = true
+	}
+
+	if applied {
+		for i := range changes {
+			configuredPeers[changes[i].PublicKey.String()] = !changes[i].Remove
+		}
+	}
+
+	present := 0
+
+	for key := range expectedPeers {
+		if configuredPeers[key] {
+			present++
+		}
+	}
+
+	r.readiness.Report(r.mesh.InterfaceName, readiness.CheckPeers, len(expectedPeers), present)
+}
+
+// ErrListenPortInUse gets returned if the configured listening port is already bound by another process.
+var ErrListenPortInUse = errors.New("the WireGuard listening port is already in use by another process")
+
+// deviceConfig returns the device level settings which differ from the desired state.
+// The bool return value is false if the device is up to date.
+func (r *Reconciler) deviceConfig(log *zap.Logger, device *wgtypes.Device, key wgtypes.Key) (wgtypes.Config, bool) {
+	cfg := wgtypes.Config{}
+	changed := false
+
+	if device.PrivateKey != key {
+		r.recordDrift(log, driftFieldPrivateKey)
+
+		cfg.PrivateKey = &key
+		changed = true
+	}
+
+	if device.ListenPort != r.listeningPort {
+		r.recordDrift(log, driftFieldListenPort, zap.Int("current", device.ListenPort), zap.Int("desired", r.listeningPort))
+
+		cfg.ListenPort = &r.listeningPort
+		changed = true
+	}
+
+	if device.FirewallMark != r.firewallMark {
+		r.recordDrift(log, driftFieldFirewallMark, zap.Int("current", device.FirewallMark), zap.Int("desired", r.firewallMark))
+
+		cfg.FirewallMark = &r.firewallMark
+		changed = true
+	}
+
+	return cfg, changed
+}
+
+// recordDrift reports a setting, which does not match the desired state.
+// Before the device matched the desired state once, differences are expected and not counted.
+func (r *Reconciler) recordDrift(log *zap.Logger, field string, fields ...zap.Field) {
+	if !r.configured {
+		return
+	}
+
+	r.metrics.deviceDrift.WithLabelValues(field).Inc()
+	log.Info("Repairing WireGuard device setting which got changed outside of the controller", append(fields, zap.String("field", field))...)
+}
+
+// peerChanges returns the minimal set of peer configs which are required to get the device into the desired state.
+// Peers which are already up to date are not part of the result.
+// The public keys of all initialized nodes, which must be configured as peers, are returned as well.
+func (r *Reconciler) peerChanges(ctx context.Context, log *zap.Logger, device *wgtypes.Device, ownNode *corev1.Node) ([]wgtypes.PeerConfig, map[string]bool, error) {
+	var (
+		reconfigureErrors error
+		changes           []wgtypes.PeerConfig
+		unknownPeers      int
+		expectedPeers     = map[string]bool{}
+	)
+
+	unmanagedPeers, err := r.unmanagedPeers(ownNode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nodeList := &corev1.NodeList{}
+	if err := r.Client.List(ctx, nodeList); err != nil {
+		return nil, nil, fmt.Errorf("unable to list nodes: %w", err)
+	}
+
+	opts := r.peerOptions
+	opts.AdvertisedRoutes = r.advertisedRoutes(log, nodeList)
+	rejectedNodes := r.conflictingPodCIDRs(log, nodeList)
+
+	opts.NodeFilter = func(node *corev1.Node) bool {
+		return r.mesh.Connects(ownNode, node)
+	}
+
+	if r.directRouting || r.vxlan {
+		backends := kubernetes.NewBackendSelector(ownNode, r.directRouting, r.vxlan)
+
+		// Nodes reached through another backend are handled by the route & VXLAN controllers
+		opts.NodeFilter = func(node *corev1.Node) bool {
+			return r.mesh.Connects(ownNode, node) && backends.Backend(node) == kubernetes.BackendWireGuard
+		}
+	}
+
+	// Conflicting nodes would steal the allowed IPs of another peer
+	nodeFilter := opts.NodeFilter
+	opts.NodeFilter = func(node *corev1.Node) bool {
+		return !rejectedNodes[node.Name] && nodeFilter(node)
+	}
+
+	// Keep track of the peers which are already configured on the device
+	// That way we know if we need to add a new one
+	existingPeers := make(map[string]bool, len(device.Peers))
 
 	// Update & Remove existing peers
 	for i := range device.Peers {
-		peerLog := log.With(zap.String("peer", device.Peers[i].PublicKey.String()))
+		pubKey := device.Peers[i].PublicKey.String()
+		existingPeers[pubKey] = true
+		peerLog := log.With(zap.String("peer", pubKey))
+
+		if unmanagedPeers[pubKey] {
+			peerLog.Debug("Skipping peer as its unmanaged")
+
+			continue
+		}
+
+		peerConfig, err := kubernetes.PeerConfigForExistingPeer(ctx, peerLog, r.Client, &device.Peers[i], opts)
+		if kubernetes.IsUnknownPeerError(err) {
+			unknownPeers++
+
+			if !r.removeUnknownPeers {
+				peerLog.Debug("Keeping peer without a corresponding node as removing unknown peers is disabled")
+
+				continue
+			}
+
+			// If the node does not exist anymore, delete the peer
+			peerLog.Info("Marking peer for removal as the corresponding nodes does not exist anymore")
+
+			changes = append(changes, wgtypes.PeerConfig{
+				PublicKey: device.Peers[i].PublicKey,
+				Remove:    true,
+			})
+
+			continue
+		}
 
-		peerConfig, err := kubernetes.PeerConfigForExistingPeer(ctx, peerLog, r.Client, &device.Peers[i])
 		if err != nil {
 			reconfigureErrors = multierr.Append(
 				reconfigureErrors,
-				fmt.Errorf("unable to get an updated peer config for peer '%s': %w", device.Peers[i].PublicKey.String(), err),
+				fmt.Errorf("unable to get an updated peer config for peer '%s': %w", pubKey, err),
 			)
 
 			continue
 		}
 
-		peerConfigs[peerConfig.PublicKey.String()] = peerConfig
+		if peerConfig != nil {
+			changes = append(changes, *peerConfig)
+		}
 	}
 
-	nodeList := &corev1.NodeList{}
-	if err := r.Client.List(ctx, nodeList); err != nil {
-		return ctrl.Result{}, fmt.Errorf("unable to get WireGuard interface: %w", err)
-	}
+	r.metrics.unknownPeerCount.Set(float64(unknownPeers))
+	r.metrics.unmanagedPeerCount.Set(float64(len(unmanagedPeers)))
 
 	for i := range nodeList.Items {
 		nodeLog := log.With(zap.String("node", nodeList.Items[i].Name))
@@ -170,7 +491,13 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			continue
 		}
 
-		pubKey, err := kubernetes.PublicKey(&nodeList.Items[i])
+		if !opts.NodeFilter(&nodeList.Items[i]) {
+			nodeLog.Debug("Skipping node as its not part of the mesh or reached through another backend")
+
+			continue
+		}
+
+		pubKey, err := kubernetes.PublicKey(&nodeList.Items[i], r.peerOptions.Annotations)
 		if err != nil {
 			if kubernetes.IsPublicKeyNotFound(err) {
 				nodeLog.Debug("Skipping node as its missing infos: " + err.Error())
@@ -183,12 +510,22 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 		nodeLog = nodeLog.With(zap.String("public_key", pubKey.String()))
 
-		// If we already have a config for that node, we can skip here
-		if _, exists := peerConfigs[pubKey.String()]; exists {
+		// If the peer is already configured, it got reconciled above
+		if existingPeers[pubKey.String()] {
+			if !unmanagedPeers[pubKey.String()] {
+				expectedPeers[pubKey.String()] = true
+			}
+
 			continue
 		}
 
-		peerConfig, err := kubernetes.PeerConfigForNode(log, &nodeList.Items[i])
+		if unmanagedPeers[pubKey.String()] {
+			nodeLog.Debug("Skipping node as its public key belongs to an unmanaged peer")
+
+			continue
+		}
+
+		peerConfig, err := kubernetes.PeerConfigForNode(log, &nodeList.Items[i], opts)
 		if err != nil {
 			if kubernetes.IsNodeNotInitializedError(err) {
 				nodeLog.Debug("Skipping node: " + err.Error())
@@ -196,27 +533,136 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				continue
 			}
 
+			expectedPeers[pubKey.String()] = true
+
 			reconfigureErrors = multierr.Append(reconfigureErrors, fmt.Errorf("unable to build the peer config for node %s: %w", nodeList.Items[i].Name, err))
 
 			continue
 		}
 
-		peerConfigs[peerConfig.PublicKey.String()] = peerConfig
+		expectedPeers[pubKey.String()] = true
+		changes = append(changes, *peerConfig)
 
 		nodeLog.Info("Added a new peer config")
 	}
 
-	for _, peerCfg := range peerConfigs {
-		interfaceConfig.Peers = append(interfaceConfig.Peers, *peerCfg)
+	return changes, expectedPeers, reconfigureErrors
+}
+
+// advertisedRoutes returns the validated routes advertised by the nodes.
+// Rejected routes are not part of the result. New rejections get logged by every agent.
+// The event only gets emitted by the agent on the advertising node, so a rejection results in one event per mesh instead of one per node.
+func (r *Reconciler) advertisedRoutes(log *zap.Logger, nodeList *corev1.NodeList) map[string]kubernetes.Networks {
+	routes, err := kubernetes.ValidateAdvertisedRoutes(nodeList.Items, r.podNet)
+	rejected := multierr.Errors(err)
+
+	r.metrics.rejectedRoutes.Set(float64(len(rejected)))
+
+	rejectedRoutes := make(map[string]bool, len(rejected))
+
+	for _, rejectErr := range rejected {
+		message := rejectErr.Error()
+		rejectedRoutes[message] = true
+
+		if r.rejectedRoutes[message] {
+			continue
+		}
+
+		log.Warn("Ignoring advertised route", zap.Error(rejectErr))
+
+		var routeErr kubernetes.RejectedRouteError
+		if !errors.As(rejectErr, &routeErr) || routeErr.Node != r.nodeName {
+			continue
+		}
+
+		for i := range nodeList.Items {
+			if nodeList.Items[i].Name == r.nodeName {
+				r.recorder.Eventf(&nodeList.Items[i], corev1.EventTypeWarning, eventReasonRouteRejected, "Ignored by the mesh %s: %s", r.mesh.InterfaceName, message)
+			}
+		}
+	}
+
+	for message := range r.rejectedRoutes {
+		if !rejectedRoutes[message] {
+			log.Info("Advertised route is no longer rejected", zap.String("reason", message))
+		}
 	}
 
-	if err := wgClient.ConfigureDevice(r.interfaceName, interfaceConfig); err != nil {
-		reconfigureErrors = multierr.Append(reconfigureErrors, fmt.Errorf("unable to reconfigure interface: %w", err))
+	r.rejectedRoutes = rejectedRoutes
+
+	return routes
+}
+
+// conflictingPodCIDRs returns the names of the nodes, whose pod CIDR is invalid or collides with another network.
+// Every agent logs new conflicts. The event only gets emitted by the agent on the conflicting node,
+// so a conflict results in one event per mesh instead of one per node.
+func (r *Reconciler) conflictingPodCIDRs(log *zap.Logger, nodeList *corev1.NodeList) map[string]bool {
+	rejected, err := kubernetes.ValidatePodCIDRs(nodeList.Items, r.podNet)
+
+	r.metrics.conflictingPodCIDRs.Set(float64(len(rejected)))
+
+	conflicts := map[string]string{}
+	for _, conflictErr := range multierr.Errors(err) {
+		var conflict kubernetes.ConflictingPodCIDRError
+		if errors.As(conflictErr, &conflict) {
+			conflicts[conflict.Node] = conflict.Error()
+		}
 	}
 
-	if reconfigureErrors != nil {
-		return ctrl.Result{}, fmt.Errorf("failed to reconfigure at least one node: %w", err)
+	for i := range nodeList.Items {
+		node := &nodeList.Items[i]
+
+		message, conflicting := conflicts[node.Name]
+		if !conflicting || r.podCIDRConflicts[node.Name] == message {
+			continue
+		}
+
+		if node.Name != r.nodeName {
+			log.Warn("Excluding node with a conflicting pod CIDR", zap.String("node", node.Name), zap.String("reason", message))
+
+			continue
+		}
+
+		log.Warn("The pod CIDR of the node we're running on conflicts, other nodes will not configure it as peer", zap.String("reason", message))
+		r.recorder.Eventf(node, corev1.EventTypeWarning, eventReasonPodCIDRConflict, "Excluded from the mesh %s: %s", r.mesh.InterfaceName, message)
 	}
 
-	return ctrl.Result{}, nil
+	r.podCIDRConflicts = conflicts
+
+	return rejected
+}
+
+// unmanagedPeers returns the public keys of all peers the controller must never touch.
+// They get configured using a flag and the annotation on the node we're running on.
+func (r *Reconciler) unmanagedPeers(ownNode *corev1.Node) (map[string]bool, error) {
+	annotatedKeys, err := kubernetes.UnmanagedPeers(ownNode)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the unmanaged peers from the node: %w", err)
+	}
+
+	keys := make(map[string]bool, len(r.unmanagedPeerKeys)+len(annotatedKeys))
+
+	// The flag keys are shared by the reconcilers of all meshes, so they must not be appended to
+	for _, key := range r.unmanagedPeerKeys {
+		keys[key.String()] = true
+	}
+
+	for _, key := range annotatedKeys {
+		keys[key.String()] = true
+	}
+
+	return keys, nil
+}
+
+func (r *Reconciler) countPeerChanges(changes []wgtypes.PeerConfig) {
+	for i := range changes {
+		switch {
+		case changes[i].Remove:
+			r.metrics.peerChanges.WithLabelValues(peerOperationRemove).Inc()
+		case changes[i].UpdateOnly:
+			r.metrics.peerChanges.WithLabelValues(peerOperationUpdate).Inc()
+		default:
+			r.metrics.peerChanges.WithLabelValues(peerOperationAdd).Inc()
+		}
+	}
 }
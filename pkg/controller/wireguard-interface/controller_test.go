@@ -0,0 +1,124 @@
+package wireguardinterface
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func TestDeviceConfigDrift(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		listenPort   = 51820
+		firewallMark = 0x4000
+	)
+
+	desired := wgtypes.Device{PrivateKey: key, ListenPort: listenPort, FirewallMark: firewallMark}
+
+	tests := []struct {
+		name       string
+		configured bool
+		device     func(device *wgtypes.Device)
+		// expectedChanges lists the settings, which are part of the returned config
+		expectedChanges string
+		// expectedDrift lists the drift counter of the private key, listen port & firewall mark
+		expectedDrift string
+	}{
+		{
+			name:            "no drift",
+			configured:      true,
+			device:          func(device *wgtypes.Device) {},
+			expectedChanges: "false false false false",
+			expectedDrift:   "0 0 0",
+		},
+		{
+			name:       "private key drifted",
+			configured: true,
+			device: func(device *wgtypes.Device) {
+				device.PrivateKey = otherKey
+			},
+			expectedChanges: "true true false false",
+			expectedDrift:   "1 0 0",
+		},
+		{
+			name:       "listen port drifted",
+			configured: true,
+			device: func(device *wgtypes.Device) {
+				device.ListenPort = 51821
+			},
+			expectedChanges: "true false true false",
+			expectedDrift:   "0 1 0",
+		},
+		{
+			name:       "firewall mark drifted",
+			configured: true,
+			device: func(device *wgtypes.Device) {
+				device.FirewallMark = 0
+			},
+			expectedChanges: "true false false true",
+			expectedDrift:   "0 0 1",
+		},
+		{
+			name: "differences before the first configuration are no drift",
+			device: func(device *wgtypes.Device) {
+				device.PrivateKey = wgtypes.Key{}
+				device.ListenPort = 0
+				device.FirewallMark = 0
+			},
+			expectedChanges: "true true true true",
+			expectedDrift:   "0 0 0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			driftCounter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "drift"}, []string{"field"})
+
+			r := &Reconciler{
+				listeningPort: listenPort,
+				firewallMark:  firewallMark,
+				configured:    test.configured,
+				metrics:       &metrics{deviceDrift: driftCounter},
+			}
+
+			device := desired
+			test.device(&device)
+
+			cfg, changed := r.deviceConfig(zap.NewNop(), &device, key)
+
+			testhelper.CompareStrings(t, test.expectedChanges, fmt.Sprintf("%t %t %t %t",
+				changed, cfg.PrivateKey != nil, cfg.ListenPort != nil, cfg.FirewallMark != nil))
+			testhelper.CompareStrings(t, test.expectedDrift, fmt.Sprintf("%v %v %v",
+				testutil.ToFloat64(driftCounter.WithLabelValues(driftFieldPrivateKey)),
+				testutil.ToFloat64(driftCounter.WithLabelValues(driftFieldListenPort)),
+				testutil.ToFloat64(driftCounter.WithLabelValues(driftFieldFirewallMark))))
+
+			if cfg.PrivateKey != nil && *cfg.PrivateKey != key {
+				t.Errorf("expected the private key to be corrected to %s, got %s", key, *cfg.PrivateKey)
+			}
+
+			if cfg.ListenPort != nil && *cfg.ListenPort != listenPort {
+				t.Errorf("expected the listen port to be corrected to %d, got %d", listenPort, *cfg.ListenPort)
+			}
+
+			if cfg.FirewallMark != nil && *cfg.FirewallMark != firewallMark {
+				t.Errorf("expected the firewall mark to be corrected to %d, got %d", firewallMark, *cfg.FirewallMark)
+			}
+		})
+	}
+}
@@ -3,17 +3,23 @@ package wireguardinterface
 import (
 	"errors"
 	"fmt"
-	"net"
 
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
 
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
 	wgnetlink "github.com/mrincompetent/wireguard-controller/pkg/wireguard/netlink"
 )
 
 func (r *Reconciler) configureInterface(log *zap.Logger, node *corev1.Node) error {
-	link, err := netlink.LinkByName(r.interfaceName)
+	handle, err := r.namespace.Handle()
+	if err != nil {
+		return fmt.Errorf("unable to get a netlink handle: %w", err)
+	}
+	defer handle.Delete()
+
+	link, err := handle.LinkByName(r.interfaceName)
 	if err != nil {
 		if !errors.As(err, &netlink.LinkNotFoundError{}) {
 			return fmt.Errorf("unable to get the interface %s: %w", r.interfaceName, err)
@@ -21,34 +27,24 @@ func (r *Reconciler) configureInterface(log *zap.Logger, node *corev1.Node) erro
 
 		log.Info("WireGuard interface does not exist. Creating...")
 
-		// Create the interface as it does not exist
-		link = &wgnetlink.Link{
-			LinkAttrs: netlink.LinkAttrs{
-				Name: r.interfaceName,
-			},
-		}
-
-		if err = netlink.LinkAdd(link); err != nil {
-			return fmt.Errorf("unable to create the interface: %w", err)
+		if link, err = r.createInterface(log, handle); err != nil {
+			return err
 		}
 
 		log.Info("Created the WireGuard interface")
 	}
 
-	nodePodCidrIP, _, err := net.ParseCIDR(node.Spec.PodCIDR)
+	wgIP, err := kubernetes.TunnelAddress(node)
 	if err != nil {
-		return fmt.Errorf("unable to parse node pod cidr: %w", err)
+		return err
 	}
 
-	wgIP := net.ParseIP(nodePodCidrIP.String())
-	wgIP = wgIP.To4()
-
 	wireGuardAddress, err := netlink.ParseAddr(fmt.Sprintf("%s/32", wgIP.String()))
 	if err != nil {
 		return fmt.Errorf("unable to parse the WireGuard address: %w", err)
 	}
 
-	addresses, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	addresses, err := handle.AddrList(link, netlink.FAMILY_V4)
 	if err != nil {
 		return fmt.Errorf("unable to list interface addresses: %w", err)
 	}
@@ -64,17 +60,27 @@ func (r *Reconciler) configureInterface(log *zap.Logger, node *corev1.Node) erro
 	}
 
 	if !found {
-		if err := netlink.AddrAdd(link, wireGuardAddress); err != nil {
+		if err := handle.AddrAdd(link, wireGuardAddress); err != nil {
 			return fmt.Errorf("unable to set address on the interface: %w", err)
 		}
 
 		log.Info("Configured address on WireGuard interface", zap.String("wireguard_address", wireGuardAddress.String()))
 	}
 
+	if r.mtu != 0 && link.Attrs().MTU != r.mtu {
+		r.recordDrift(log, driftFieldMTU, zap.Int("current", link.Attrs().MTU), zap.Int("desired", r.mtu))
+
+		if err := handle.LinkSetMTU(link, r.mtu); err != nil {
+			return fmt.Errorf("unable to set the MTU of the interface: %w", err)
+		}
+
+		log.Info("Configured MTU on WireGuard interface", zap.Int("mtu", r.mtu))
+	}
+
 	if link.Attrs().OperState != netlink.OperUp {
 		stateBefore := link.Attrs().OperState
 
-		if err := netlink.LinkSetUp(link); err != nil {
+		if err := handle.LinkSetUp(link); err != nil {
 			return fmt.Errorf("unable to bring up the interface: %w", err)
 		}
 
@@ -87,3 +93,49 @@ func (r *Reconciler) configureInterface(log *zap.Logger, node *corev1.Node) erro
 
 	return nil
 }
+
+// createInterface creates the WireGuard interface in the host namespace.
+// If a dedicated namespace is configured, the interface gets moved into it afterwards.
+// WireGuard keeps its UDP socket in the namespace the interface got created in,
+// so the encrypted traffic leaves through the host, while the tunnel itself lives in the dedicated namespace.
+func (r *Reconciler) createInterface(log *zap.Logger, handle *netlink.Handle) (netlink.Link, error) {
+	link, err := netlink.LinkByName(r.interfaceName)
+	if err != nil {
+		if !errors.As(err, &netlink.LinkNotFoundError{}) {
+			return nil, fmt.Errorf("unable to get the interface %s from the host namespace: %w", r.interfaceName, err)
+		}
+
+		link = &wgnetlink.Link{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: r.interfaceName,
+			},
+		}
+
+		if err = netlink.LinkAdd(link); err != nil {
+			return nil, fmt.Errorf("unable to create the interface: %w", err)
+		}
+	}
+
+	if r.namespace.IsHost() {
+		return link, nil
+	}
+
+	nsHandle, err := r.namespace.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer nsHandle.Close()
+
+	if err := netlink.LinkSetNsFd(link, int(nsHandle)); err != nil {
+		return nil, fmt.Errorf("unable to move the interface into network namespace '%s': %w", r.namespace, err)
+	}
+
+	log.Info("Moved the WireGuard interface into its network namespace", zap.Stringer("namespace", r.namespace))
+
+	link, err = handle.LinkByName(r.interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the interface %s after moving it into network namespace '%s': %w", r.interfaceName, r.namespace, err)
+	}
+
+	return link, nil
+}
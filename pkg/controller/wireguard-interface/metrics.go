@@ -4,6 +4,24 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const (
+	peerOperationAdd    = "add"
+	peerOperationUpdate = "update"
+	peerOperationRemove = "remove"
+
+	driftFieldPrivateKey   = "private_key"
+	driftFieldListenPort   = "listen_port"
+	driftFieldFirewallMark = "firewall_mark"
+	driftFieldMTU          = "mtu"
+)
+
 type metrics struct {
-	peerCount prometheus.Gauge
+	peerCount               prometheus.Gauge
+	peerChanges             *prometheus.CounterVec
+	peerChangesPerReconcile prometheus.Histogram
+	unknownPeerCount        prometheus.Gauge
+	unmanagedPeerCount      prometheus.Gauge
+	rejectedRoutes          prometheus.Gauge
+	conflictingPodCIDRs     prometheus.Gauge
+	deviceDrift             *prometheus.CounterVec
 }
@@ -0,0 +1,103 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+)
+
+var (
+	// ErrClusterCIDRExhausted gets returned if all subnets of the cluster CIDR are in use.
+	ErrClusterCIDRExhausted = errors.New("no free subnet left in the cluster CIDR")
+	// ErrInvalidMaskSize gets returned if the subnets would not fit into the cluster CIDR.
+	ErrInvalidMaskSize = errors.New("the subnet mask size must be at least the prefix length of the cluster CIDR")
+)
+
+// Allocator carves equally sized subnets out of the cluster CIDR.
+// It's stateless: the subnets in use get passed in on every allocation.
+type Allocator struct {
+	clusterCIDR *net.IPNet
+	maskSize    int
+	bits        int
+}
+
+func NewAllocator(clusterCIDR *net.IPNet, maskSize int) (*Allocator, error) {
+	ones, bits := clusterCIDR.Mask.Size()
+	if maskSize < ones || maskSize > bits {
+		return nil, fmt.Errorf("%w: cluster CIDR %s, mask size %d", ErrInvalidMaskSize, clusterCIDR.String(), maskSize)
+	}
+
+	return &Allocator{
+		clusterCIDR: clusterCIDR,
+		maskSize:    maskSize,
+		bits:        bits,
+	}, nil
+}
+
+// Next returns the first subnet, which does not overlap with any of the used networks.
+func (a *Allocator) Next(used []net.IPNet) (*net.IPNet, error) {
+	ones, _ := a.clusterCIDR.Mask.Size()
+
+	subnets := new(big.Int).Lsh(big.NewInt(1), uint(a.maskSize-ones))
+	subnetSize := new(big.Int).Lsh(big.NewInt(1), uint(a.bits-a.maskSize))
+	base := new(big.Int).SetBytes(a.ip(a.clusterCIDR.IP))
+
+	for index := big.NewInt(0); index.Cmp(subnets) < 0; index.Add(index, big.NewInt(1)) {
+		start := new(big.Int).Add(base, new(big.Int).Mul(index, subnetSize))
+
+		candidate := &net.IPNet{
+			IP:   a.toIP(start),
+			Mask: net.CIDRMask(a.maskSize, a.bits),
+		}
+
+		if !overlapsAny(candidate, used) {
+			return candidate, nil
+		}
+	}
+
+	return nil, ErrClusterCIDRExhausted
+}
+
+// Size returns the number of subnets in the cluster CIDR.
+func (a *Allocator) Size() float64 {
+	ones, _ := a.clusterCIDR.Mask.Size()
+
+	return math.Pow(2, float64(a.maskSize-ones))
+}
+
+// Contains returns true if the network is part of the cluster CIDR.
+func (a *Allocator) Contains(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	clusterOnes, _ := a.clusterCIDR.Mask.Size()
+
+	return bits == a.bits && ones >= clusterOnes && a.clusterCIDR.Contains(network.IP)
+}
+
+// ip returns the address in the length matching the cluster CIDR.
+func (a *Allocator) ip(ip net.IP) net.IP {
+	if a.bits == 32 {
+		return ip.To4()
+	}
+
+	return ip.To16()
+}
+
+func (a *Allocator) toIP(i *big.Int) net.IP {
+	ip := make(net.IP, a.bits/8)
+	b := i.Bytes()
+	copy(ip[len(ip)-len(b):], b)
+
+	return ip
+}
+
+func overlapsAny(candidate *net.IPNet, used []net.IPNet) bool {
+	for i := range used {
+		if candidate.Contains(used[i].IP) || used[i].Contains(candidate.IP) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,110 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func parseNetworks(t *testing.T, cidrs ...string) []net.IPNet {
+	var networks []net.IPNet
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		networks = append(networks, *network)
+	}
+
+	return networks
+}
+
+func TestAllocatorNext(t *testing.T) {
+	tests := []struct {
+		name           string
+		clusterCIDR    string
+		maskSize       int
+		used           []string
+		expectedSubnet string
+		expectedErr    error
+	}{
+		{
+			name:           "first subnet",
+			clusterCIDR:    "10.244.0.0/16",
+			maskSize:       24,
+			expectedSubnet: "10.244.0.0/24",
+		},
+		{
+			name:           "gap gets reused",
+			clusterCIDR:    "10.244.0.0/16",
+			maskSize:       24,
+			used:           []string{"10.244.0.0/24", "10.244.2.0/24"},
+			expectedSubnet: "10.244.1.0/24",
+		},
+		{
+			name:           "bigger used network blocks all contained subnets",
+			clusterCIDR:    "10.244.0.0/16",
+			maskSize:       24,
+			used:           []string{"10.244.0.0/23", "10.244.3.0/24"},
+			expectedSubnet: "10.244.2.0/24",
+		},
+		{
+			name:           "smaller used network blocks its subnet",
+			clusterCIDR:    "10.244.0.0/16",
+			maskSize:       24,
+			used:           []string{"10.244.0.128/25"},
+			expectedSubnet: "10.244.1.0/24",
+		},
+		{
+			name:           "networks outside of the cluster CIDR are ignored",
+			clusterCIDR:    "10.244.0.0/16",
+			maskSize:       24,
+			used:           []string{"10.0.0.0/24"},
+			expectedSubnet: "10.244.0.0/24",
+		},
+		{
+			name:        "exhausted",
+			clusterCIDR: "10.244.0.0/23",
+			maskSize:    24,
+			used:        []string{"10.244.0.0/24", "10.244.1.0/24"},
+			expectedErr: ErrClusterCIDRExhausted,
+		},
+		{
+			name:           "IPv6",
+			clusterCIDR:    "fd00:10::/48",
+			maskSize:       64,
+			used:           []string{"fd00:10::/64"},
+			expectedSubnet: "fd00:10:0:1::/64",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allocator, err := NewAllocator(&parseNetworks(t, test.clusterCIDR)[0], test.maskSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			subnet, err := allocator.Next(parseNetworks(t, test.used...))
+			if fmt.Sprint(err) != fmt.Sprint(test.expectedErr) {
+				t.Fatal(err)
+			}
+
+			if test.expectedErr != nil {
+				return
+			}
+
+			testhelper.CompareStrings(t, test.expectedSubnet, subnet.String())
+		})
+	}
+}
+
+func TestNewAllocatorInvalidMaskSize(t *testing.T) {
+	_, err := NewAllocator(&parseNetworks(t, "10.244.0.0/16")[0], 12)
+
+	testhelper.CompareStrings(t, "the subnet mask size must be at least the prefix length of the cluster CIDR: cluster CIDR 10.244.0.0/16, mask size 12", fmt.Sprint(err))
+}
@@ -0,0 +1,173 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+// Mesh describes a single WireGuard network the agent takes part in.
+// Each mesh uses its own interface, key & port and only connects the nodes matching its node selector.
+type Mesh struct {
+	// InterfaceName is the name of the WireGuard interface.
+	InterfaceName string `json:"interface"`
+	// ListenPort is the WireGuard listening port.
+	ListenPort int `json:"listenPort"`
+	// PrivateKeyPath is the path to the private key of the interface.
+	PrivateKeyPath string `json:"privateKeyPath"`
+	// NodeSelector is a label selector (e.g. "pool=edge"). Only matching nodes are part of the mesh. Empty selects all nodes.
+	NodeSelector string `json:"nodeSelector"`
+	// PodCIDR limits the mesh to nodes whose pod CIDR lies within it. Empty allows all pod CIDRs.
+	PodCIDR string `json:"podCIDR"`
+
+	// Primary is set for the first mesh. It uses the legacy annotations & controller names and manages the CNI config.
+	Primary bool `json:"-"`
+
+	selector labels.Selector
+	podNet   *net.IPNet
+	// preceding contains the meshes configured before this one. They take precedence for nodes selected by multiple meshes.
+	preceding []*Mesh
+}
+
+type config struct {
+	Meshes []Mesh `json:"meshes"`
+}
+
+var ErrNoMeshConfigured = errors.New("at least one mesh must be configured")
+
+// Load reads the mesh configuration from the given YAML file.
+func Load(path string) ([]*Mesh, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mesh config '%s': %w", path, err)
+	}
+
+	cfg := &config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse mesh config '%s': %w", path, err)
+	}
+
+	meshes := make([]*Mesh, len(cfg.Meshes))
+	for i := range cfg.Meshes {
+		meshes[i] = &cfg.Meshes[i]
+	}
+
+	if err := Complete(meshes); err != nil {
+		return nil, err
+	}
+
+	return meshes, nil
+}
+
+// Complete validates the meshes, marks the first one as primary and prepares the selectors.
+func Complete(meshes []*Mesh) error {
+	if len(meshes) == 0 {
+		return ErrNoMeshConfigured
+	}
+
+	interfaces := map[string]bool{}
+	ports := map[int]bool{}
+
+	for i, m := range meshes {
+		m.Primary = i == 0
+		m.preceding = meshes[:i]
+
+		if m.InterfaceName == "" {
+			return fmt.Errorf("mesh %d: the interface name must be set", i)
+		}
+
+		if interfaces[m.InterfaceName] {
+			return fmt.Errorf("mesh %s: the interface name is used by multiple meshes", m.InterfaceName)
+		}
+
+		interfaces[m.InterfaceName] = true
+
+		if ports[m.ListenPort] {
+			return fmt.Errorf("mesh %s: the listen port %d is used by multiple meshes", m.InterfaceName, m.ListenPort)
+		}
+
+		ports[m.ListenPort] = true
+
+		if m.PrivateKeyPath == "" {
+			return fmt.Errorf("mesh %s: the private key path must be set", m.InterfaceName)
+		}
+
+		selector, err := labels.Parse(m.NodeSelector)
+		if err != nil {
+			return fmt.Errorf("mesh %s: unable to parse node selector: %w", m.InterfaceName, err)
+		}
+
+		m.selector = selector
+
+		if m.PodCIDR != "" {
+			_, podNet, err := net.ParseCIDR(m.PodCIDR)
+			if err != nil {
+				return fmt.Errorf("mesh %s: unable to parse pod cidr: %w", m.InterfaceName, err)
+			}
+
+			m.podNet = podNet
+		}
+	}
+
+	return nil
+}
+
+// Annotations returns the annotation keys the mesh uses to publish the WireGuard settings on the node object.
+func (m *Mesh) Annotations() kubernetes.Annotations {
+	if m.Primary {
+		return kubernetes.DefaultAnnotations
+	}
+
+	return kubernetes.AnnotationsForInterface(m.InterfaceName)
+}
+
+// ControllerName returns a unique controller name for the mesh.
+func (m *Mesh) ControllerName(name string) string {
+	if m.Primary {
+		return name
+	}
+
+	return fmt.Sprintf("%s_%s", name, m.InterfaceName)
+}
+
+// Selects returns true if the node is part of the mesh.
+func (m *Mesh) Selects(node *corev1.Node) bool {
+	if m.selector != nil && !m.selector.Matches(labels.Set(node.Labels)) {
+		return false
+	}
+
+	if m.podNet == nil {
+		return true
+	}
+
+	podIP, _, err := net.ParseCIDR(kubernetes.PodCIDR(node))
+	if err != nil {
+		return false
+	}
+
+	return m.podNet.Contains(podIP)
+}
+
+// Connects returns true if the mesh is responsible for the traffic between the own node and the given node.
+// If both nodes are part of multiple meshes, the first one in the configuration wins.
+// Otherwise both meshes would configure the same peer and install routes for the same pod CIDR.
+func (m *Mesh) Connects(ownNode, node *corev1.Node) bool {
+	if !m.Selects(node) {
+		return false
+	}
+
+	for _, p := range m.preceding {
+		if p.Selects(ownNode) && p.Selects(node) {
+			return false
+		}
+	}
+
+	return true
+}
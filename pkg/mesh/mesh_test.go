@@ -0,0 +1,174 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func TestComplete(t *testing.T) {
+	tests := []struct {
+		name        string
+		meshes      []*Mesh
+		expectedErr error
+	}{
+		{
+			name: "valid meshes",
+			meshes: []*Mesh{
+				{InterfaceName: "wg-kube", ListenPort: 51820, PrivateKeyPath: "/etc/wireguard/wg-kube-key"},
+				{InterfaceName: "wg-edge", ListenPort: 51821, PrivateKeyPath: "/etc/wireguard/wg-edge-key", NodeSelector: "pool=edge"},
+			},
+		},
+		{
+			name:        "no mesh",
+			expectedErr: ErrNoMeshConfigured,
+		},
+		{
+			name: "duplicate port",
+			meshes: []*Mesh{
+				{InterfaceName: "wg-kube", ListenPort: 51820, PrivateKeyPath: "/etc/wireguard/wg-kube-key"},
+				{InterfaceName: "wg-edge", ListenPort: 51820, PrivateKeyPath: "/etc/wireguard/wg-edge-key"},
+			},
+			expectedErr: errors.New("mesh wg-edge: the listen port 51820 is used by multiple meshes"),
+		},
+		{
+			name: "invalid pod cidr",
+			meshes: []*Mesh{
+				{InterfaceName: "wg-kube", ListenPort: 51820, PrivateKeyPath: "/etc/wireguard/wg-kube-key", PodCIDR: "AAA"},
+			},
+			expectedErr: errors.New("mesh wg-kube: unable to parse pod cidr: invalid CIDR address: AAA"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Complete(test.meshes)
+			testhelper.CompareStrings(t, fmt.Sprint(test.expectedErr), fmt.Sprint(err))
+			if err != nil {
+				return
+			}
+
+			if !test.meshes[0].Primary {
+				t.Error("expected the first mesh to be the primary mesh")
+			}
+		})
+	}
+}
+
+func TestSelects(t *testing.T) {
+	meshes := []*Mesh{
+		{
+			InterfaceName:  "wg-edge",
+			ListenPort:     51821,
+			PrivateKeyPath: "/etc/wireguard/wg-edge-key",
+			NodeSelector:   "pool=edge",
+			PodCIDR:        "10.244.128.0/17",
+		},
+	}
+	if err := Complete(meshes); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		podCIDR  string
+		expected bool
+	}{
+		{
+			name:     "matching node",
+			labels:   map[string]string{"pool": "edge"},
+			podCIDR:  "10.244.130.0/24",
+			expected: true,
+		},
+		{
+			name:     "label does not match",
+			labels:   map[string]string{"pool": "core"},
+			podCIDR:  "10.244.130.0/24",
+			expected: false,
+		},
+		{
+			name:     "pod cidr outside of the mesh",
+			labels:   map[string]string{"pool": "edge"},
+			podCIDR:  "10.244.1.0/24",
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "test-node",
+					Labels: test.labels,
+				},
+				Spec: corev1.NodeSpec{
+					PodCIDR: test.podCIDR,
+				},
+			}
+
+			if got := meshes[0].Selects(node); got != test.expected {
+				t.Errorf("expected Selects to return %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestConnects(t *testing.T) {
+	meshes := []*Mesh{
+		{InterfaceName: "wg-kube", ListenPort: 51820, PrivateKeyPath: "/etc/wireguard/wg-kube-key"},
+		{InterfaceName: "wg-edge", ListenPort: 51821, PrivateKeyPath: "/etc/wireguard/wg-edge-key", NodeSelector: "pool=edge"},
+	}
+	if err := Complete(meshes); err != nil {
+		t.Fatal(err)
+	}
+
+	node := func(pool string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: pool, Labels: map[string]string{"pool": pool}}}
+	}
+
+	tests := []struct {
+		name     string
+		ownNode  *corev1.Node
+		node     *corev1.Node
+		expected string
+	}{
+		{
+			name:     "both nodes in both meshes are connected by the first mesh",
+			ownNode:  node("edge"),
+			node:     node("edge"),
+			expected: "wg-kube=true wg-edge=false",
+		},
+		{
+			name:     "node only selected by the first mesh",
+			ownNode:  node("edge"),
+			node:     node("core"),
+			expected: "wg-kube=true wg-edge=false",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := fmt.Sprintf("wg-kube=%t wg-edge=%t", meshes[0].Connects(test.ownNode, test.node), meshes[1].Connects(test.ownNode, test.node))
+			testhelper.CompareStrings(t, test.expected, got)
+		})
+	}
+
+	// Without overlapping selectors the second mesh connects its nodes
+	disjoint := []*Mesh{
+		{InterfaceName: "wg-kube", ListenPort: 51820, PrivateKeyPath: "/etc/wireguard/wg-kube-key", NodeSelector: "pool!=edge"},
+		{InterfaceName: "wg-edge", ListenPort: 51821, PrivateKeyPath: "/etc/wireguard/wg-edge-key", NodeSelector: "pool=edge"},
+	}
+	if err := Complete(disjoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if !disjoint[1].Connects(node("edge"), node("edge")) {
+		t.Error("expected the edge mesh to connect edge nodes")
+	}
+}
@@ -0,0 +1,71 @@
+package nftables
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Binary is the nft binary used to apply the rulesets.
+const Binary = "nft"
+
+// Table identifies an nftables table.
+type Table struct {
+	// Family is the address family of the table, e.g. ip, ip6 or inet.
+	Family string
+	Name   string
+}
+
+func (t Table) String() string {
+	return t.Family + " " + t.Name
+}
+
+// ReplaceTable returns a script, which atomically replaces the table with the given body.
+// Declaring the table first makes the delete succeed, even if the table does not exist yet.
+func ReplaceTable(table Table, body string) string {
+	return fmt.Sprintf("table %s {}\ndelete table %s\ntable %s {\n%s}\n", table, table, table, body)
+}
+
+// Apply runs the script in a single nft transaction. Either all of it gets applied or nothing.
+func Apply(ctx context.Context, script string) error {
+	cmd := exec.CommandContext(ctx, Binary, "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+
+	return run(cmd)
+}
+
+// TableExists returns true if the table exists.
+func TableExists(ctx context.Context, table Table) (bool, error) {
+	cmd := exec.CommandContext(ctx, Binary, "list", "tables", table.Family)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("unable to list the nftables tables: %w", err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) == "table "+table.String() {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// DeleteTable removes the table. A missing table is not an error.
+func DeleteTable(ctx context.Context, table Table) error {
+	return Apply(ctx, fmt.Sprintf("table %s {}\ndelete table %s\n", table, table))
+}
+
+func run(cmd *exec.Cmd) error {
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", Binary, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
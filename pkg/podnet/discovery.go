@@ -0,0 +1,142 @@
+package podnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+const (
+	// ConfigMapKeyPodCIDR contains the cluster pod CIDR in a ConfigMap managed by the cluster operator.
+	ConfigMapKeyPodCIDR = "podCIDR"
+	// ConfigMapKeyClusterConfiguration contains kubeadm's ClusterConfiguration in the kubeadm-config ConfigMap.
+	ConfigMapKeyClusterConfiguration = "ClusterConfiguration"
+)
+
+// Networks inferred from the nodes must not be broader than this, as unrelated node ranges would otherwise add up to everything.
+const (
+	MinPrefixLengthIPv4 = 8
+	MinPrefixLengthIPv6 = 32
+)
+
+var (
+	// ErrNotConfigured gets returned if the ConfigMap does not contain a pod CIDR.
+	ErrNotConfigured = errors.New("no pod CIDR configured")
+	// ErrTooBroad gets returned if the network inferred from the nodes exceeds the minimum prefix length.
+	ErrTooBroad = errors.New("network inferred from the nodes is too broad")
+)
+
+type clusterConfiguration struct {
+	Networking struct {
+		PodSubnet string `json:"podSubnet"`
+	} `json:"networking"`
+}
+
+// FromConfigMap returns the cluster pod CIDR stored in the ConfigMap.
+// The podCIDR key takes precedence over the pod subnet of kubeadm's ClusterConfiguration.
+// On dual-stack clusters the first network gets used.
+func FromConfigMap(configMap *corev1.ConfigMap) (*net.IPNet, error) {
+	podCIDR := configMap.Data[ConfigMapKeyPodCIDR]
+
+	if podCIDR == "" && configMap.Data[ConfigMapKeyClusterConfiguration] != "" {
+		cfg := &clusterConfiguration{}
+		if err := yaml.Unmarshal([]byte(configMap.Data[ConfigMapKeyClusterConfiguration]), cfg); err != nil {
+			return nil, fmt.Errorf("unable to parse the %s: %w", ConfigMapKeyClusterConfiguration, err)
+		}
+
+		podCIDR = cfg.Networking.PodSubnet
+	}
+
+	podCIDR = strings.TrimSpace(strings.Split(podCIDR, ",")[0])
+	if podCIDR == "" {
+		return nil, ErrNotConfigured
+	}
+
+	_, network, err := net.ParseCIDR(podCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod CIDR '%s': %w", podCIDR, err)
+	}
+
+	return network, nil
+}
+
+// FromNodes returns the smallest network, which contains the pod CIDRs of all nodes.
+// IPv4 pod CIDRs take precedence over IPv6 ones. Nodes with an invalid pod CIDR are ignored.
+// Nil gets returned if no node has a pod CIDR yet.
+func FromNodes(nodes []corev1.Node) *net.IPNet {
+	var v4, v6 *net.IPNet
+
+	for i := range nodes {
+		_, nodePodNet, err := net.ParseCIDR(kubernetes.PodCIDR(&nodes[i]))
+		if err != nil {
+			continue
+		}
+
+		if nodePodNet.IP.To4() != nil {
+			v4 = supernet(v4, nodePodNet)
+		} else {
+			v6 = supernet(v6, nodePodNet)
+		}
+	}
+
+	if v4 != nil {
+		return v4
+	}
+
+	return v6
+}
+
+// Widen returns the smallest network containing the current & the inferred network, so a network inferred
+// from the nodes never shrinks while nodes come and go. The current network is nil if none is known yet.
+// If both are of different IP families, the current network is kept.
+func Widen(current, inferred *net.IPNet) (*net.IPNet, error) {
+	if current != nil && (current.IP.To4() == nil) != (inferred.IP.To4() == nil) {
+		return current, nil
+	}
+
+	network := supernet(current, inferred)
+
+	minPrefixLength := MinPrefixLengthIPv4
+	if network.IP.To4() == nil {
+		minPrefixLength = MinPrefixLengthIPv6
+	}
+
+	if ones, _ := network.Mask.Size(); ones < minPrefixLength {
+		return nil, fmt.Errorf("%w: %s is broader than /%d", ErrTooBroad, network.String(), minPrefixLength)
+	}
+
+	return network, nil
+}
+
+// supernet returns the smallest network containing both networks. Both must be of the same IP family.
+func supernet(a, b *net.IPNet) *net.IPNet {
+	if a == nil {
+		return b
+	}
+
+	aOnes, bits := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+
+	ones := aOnes
+	if bOnes < ones {
+		ones = bOnes
+	}
+
+	// Shorten the prefix until it covers both networks
+	for ; ones > 0; ones-- {
+		mask := net.CIDRMask(ones, bits)
+		if a.IP.Mask(mask).Equal(b.IP.Mask(mask)) {
+			break
+		}
+	}
+
+	mask := net.CIDRMask(ones, bits)
+
+	return &net.IPNet{IP: a.IP.Mask(mask), Mask: mask}
+}
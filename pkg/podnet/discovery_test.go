@@ -0,0 +1,210 @@
+package podnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/kubernetes"
+)
+
+func TestFromConfigMap(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            map[string]string
+		expectedNetwork string
+		expectedErr     error
+	}{
+		{
+			name: "kubeadm ClusterConfiguration",
+			data: map[string]string{
+				ConfigMapKeyClusterConfiguration: `apiVersion: kubeadm.k8s.io/v1beta2
+kind: ClusterConfiguration
+networking:
+  dnsDomain: cluster.local
+  podSubnet: 10.244.0.0/16
+  serviceSubnet: 10.96.0.0/12
+`,
+			},
+			expectedNetwork: "10.244.0.0/16",
+		},
+		{
+			name: "dual-stack uses the first network",
+			data: map[string]string{
+				ConfigMapKeyClusterConfiguration: "networking:\n  podSubnet: fd00:10::/48,10.244.0.0/16\n",
+			},
+			expectedNetwork: "fd00:10::/48",
+		},
+		{
+			name: "podCIDR key takes precedence",
+			data: map[string]string{
+				ConfigMapKeyPodCIDR:              "172.25.0.0/16",
+				ConfigMapKeyClusterConfiguration: "networking:\n  podSubnet: 10.244.0.0/16\n",
+			},
+			expectedNetwork: "172.25.0.0/16",
+		},
+		{
+			name: "kubeadm without pod subnet",
+			data: map[string]string{
+				ConfigMapKeyClusterConfiguration: "networking:\n  serviceSubnet: 10.96.0.0/12\n",
+			},
+			expectedErr: ErrNotConfigured,
+		},
+		{
+			name:        "invalid pod CIDR",
+			data:        map[string]string{ConfigMapKeyPodCIDR: "10.244.0.0"},
+			expectedErr: errors.New("invalid pod CIDR '10.244.0.0': invalid CIDR address: 10.244.0.0"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network, err := FromConfigMap(&corev1.ConfigMap{Data: test.data})
+			if fmt.Sprint(err) != fmt.Sprint(test.expectedErr) {
+				t.Fatal(err)
+			}
+
+			if test.expectedErr != nil {
+				return
+			}
+
+			testhelper.CompareStrings(t, test.expectedNetwork, network.String())
+		})
+	}
+}
+
+func TestFromNodes(t *testing.T) {
+	node := func(name, podCIDR, annotatedPodCIDR string) corev1.Node {
+		return corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Annotations: map[string]string{kubernetes.AnnotationKeyPodCIDR: annotatedPodCIDR},
+			},
+			Spec: corev1.NodeSpec{PodCIDR: podCIDR},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		nodes           []corev1.Node
+		expectedNetwork string
+	}{
+		{
+			name:            "no pod CIDRs",
+			nodes:           []corev1.Node{node("node1", "", "")},
+			expectedNetwork: "<nil>",
+		},
+		{
+			name:            "single node",
+			nodes:           []corev1.Node{node("node1", "10.244.1.0/24", "")},
+			expectedNetwork: "10.244.1.0/24",
+		},
+		{
+			name: "supernet of all nodes",
+			nodes: []corev1.Node{
+				node("node1", "10.244.1.0/24", ""),
+				node("node2", "", "10.244.6.0/24"),
+				node("node3", "invalid", ""),
+			},
+			expectedNetwork: "10.244.0.0/21",
+		},
+		{
+			name: "IPv4 takes precedence",
+			nodes: []corev1.Node{
+				node("node1", "fd00:10:0:1::/64", ""),
+				node("node2", "10.244.2.0/24", ""),
+			},
+			expectedNetwork: "10.244.2.0/24",
+		},
+		{
+			name: "IPv6",
+			nodes: []corev1.Node{
+				node("node1", "fd00:10:0:1::/64", ""),
+				node("node2", "fd00:10:0:2::/64", ""),
+			},
+			expectedNetwork: "fd00:10::/62",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testhelper.CompareStrings(t, test.expectedNetwork, FromNodes(test.nodes).String())
+		})
+	}
+}
+
+func TestWiden(t *testing.T) {
+	tests := []struct {
+		name            string
+		current         string
+		inferred        string
+		expectedNetwork string
+		expectedErr     string
+	}{
+		{
+			name:            "nothing known yet",
+			inferred:        "10.244.1.0/24",
+			expectedNetwork: "10.244.1.0/24",
+			expectedErr:     "<nil>",
+		},
+		{
+			name:            "never shrinks",
+			current:         "10.244.0.0/16",
+			inferred:        "10.244.1.0/24",
+			expectedNetwork: "10.244.0.0/16",
+			expectedErr:     "<nil>",
+		},
+		{
+			name:            "widens",
+			current:         "10.244.0.0/24",
+			inferred:        "10.244.1.0/24",
+			expectedNetwork: "10.244.0.0/23",
+			expectedErr:     "<nil>",
+		},
+		{
+			name:        "unrelated ranges",
+			current:     "10.244.0.0/16",
+			inferred:    "192.168.0.0/24",
+			expectedErr: "network inferred from the nodes is too broad: 0.0.0.0/0 is broader than /8",
+		},
+		{
+			name:        "unrelated IPv6 ranges",
+			inferred:    "fd00::/8",
+			expectedErr: "network inferred from the nodes is too broad: fd00::/8 is broader than /32",
+		},
+		{
+			name:            "other IP family",
+			current:         "10.244.0.0/16",
+			inferred:        "fd00:10::/64",
+			expectedNetwork: "10.244.0.0/16",
+			expectedErr:     "<nil>",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var current *net.IPNet
+			if test.current != "" {
+				_, current, _ = net.ParseCIDR(test.current)
+			}
+
+			_, inferred, err := net.ParseCIDR(test.inferred)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			network, err := Widen(current, inferred)
+
+			testhelper.CompareStrings(t, test.expectedErr, fmt.Sprint(err))
+
+			if err == nil {
+				testhelper.CompareStrings(t, test.expectedNetwork, network.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package podnet
+
+import (
+	"net"
+	"sync"
+)
+
+func New() *Store {
+	return &Store{
+		m: &sync.RWMutex{},
+	}
+}
+
+// Store holds the cluster pod CIDR. It's shared by all controllers, so a discovered change applies without a restart.
+type Store struct {
+	m       *sync.RWMutex
+	network *net.IPNet
+}
+
+// Set stores the cluster pod CIDR. It returns true if it changed.
+func (s *Store) Set(network *net.IPNet) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.network != nil && network != nil && s.network.String() == network.String() {
+		return false
+	}
+
+	s.network = network
+
+	return true
+}
+
+// Get returns the cluster pod CIDR or nil if it's not known yet.
+func (s *Store) Get() *net.IPNet {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.network == nil {
+		return nil
+	}
+
+	// Callers must not be able to modify the stored network
+	return &net.IPNet{
+		IP:   append(net.IP{}, s.network.IP...),
+		Mask: append(net.IPMask{}, s.network.Mask...),
+	}
+}
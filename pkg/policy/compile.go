@@ -0,0 +1,578 @@
+package policy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/nftables"
+)
+
+// Table is the nftables table holding the policy rules. It covers both IP families.
+var Table = nftables.Table{Family: "inet", Name: "wireguard_policy"}
+
+// direction describes which side of a packet belongs to the pod & which one to the peer.
+type direction struct {
+	name string
+	// podField matches the address of the pod the policy applies to
+	podField string
+	// peerField matches the address of the other side
+	peerField string
+}
+
+var (
+	directionIngress = direction{name: "ingress", podField: "daddr", peerField: "saddr"}
+	directionEgress  = direction{name: "egress", podField: "saddr", peerField: "daddr"}
+)
+
+type compiler struct {
+	// pods contains all pods, which have an address from the pod network
+	pods            []*corev1.Pod
+	namespaceLabels map[string]labels.Set
+}
+
+// Compile returns the nft script, which enforces the policies for the pods running on the node.
+// Pods which are not selected by a policy of the direction are not isolated. Replies to allowed connections always pass.
+// The rules get applied when traffic gets forwarded, so traffic from the node itself (e.g. kubelet probes) is always allowed.
+func Compile(nodeName string, policies []networkingv1.NetworkPolicy, pods []corev1.Pod, namespaces []corev1.Namespace) (string, error) {
+	c := &compiler{
+		namespaceLabels: make(map[string]labels.Set, len(namespaces)),
+	}
+
+	for i := range namespaces {
+		c.namespaceLabels[namespaces[i].Name] = labels.Set(namespaces[i].Labels)
+	}
+
+	for i := range pods {
+		if hasPodNetworkAddress(&pods[i]) {
+			c.pods = append(c.pods, &pods[i])
+		}
+	}
+
+	sort.Slice(c.pods, func(i, j int) bool {
+		return podName(c.pods[i]) < podName(c.pods[j])
+	})
+
+	sortedPolicies := make([]*networkingv1.NetworkPolicy, 0, len(policies))
+	for i := range policies {
+		sortedPolicies = append(sortedPolicies, &policies[i])
+	}
+
+	sort.Slice(sortedPolicies, func(i, j int) bool {
+		return sortedPolicies[i].Namespace+"/"+sortedPolicies[i].Name < sortedPolicies[j].Namespace+"/"+sortedPolicies[j].Name
+	})
+
+	var (
+		jumps  []string
+		chains = &bytes.Buffer{}
+	)
+
+	for _, pod := range c.pods {
+		if pod.Spec.NodeName != nodeName {
+			continue
+		}
+
+		ingressPolicies, egressPolicies, err := selectingPolicies(sortedPolicies, pod)
+		if err != nil {
+			return "", err
+		}
+
+		for _, d := range []struct {
+			direction direction
+			policies  []*networkingv1.NetworkPolicy
+		}{
+			{direction: directionEgress, policies: egressPolicies},
+			{direction: directionIngress, policies: ingressPolicies},
+		} {
+			if len(d.policies) == 0 {
+				continue
+			}
+
+			rules, err := c.podRules(d.direction, pod, d.policies)
+			if err != nil {
+				return "", err
+			}
+
+			chain := chainName(d.direction, pod)
+
+			for _, match := range addressMatches(d.direction.podField, podAddresses(pod)) {
+				jumps = append(jumps, fmt.Sprintf("%s jump %s comment %q", match, chain, podName(pod)))
+			}
+
+			fmt.Fprintf(chains, "\n\tchain %s {\n", chain)
+			for _, rule := range rules {
+				fmt.Fprintf(chains, "\t\t%s\n", rule)
+			}
+			fmt.Fprintf(chains, "\t\tdrop\n\t}\n")
+		}
+	}
+
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "\tchain forward {\n")
+	fmt.Fprintf(body, "\t\ttype filter hook forward priority 0; policy accept;\n")
+	fmt.Fprintf(body, "\t\tct state established,related accept\n")
+	for _, jump := range jumps {
+		fmt.Fprintf(body, "\t\t%s\n", jump)
+	}
+	fmt.Fprintf(body, "\t}\n")
+	body.Write(chains.Bytes())
+
+	return nftables.ReplaceTable(Table, body.String()), nil
+}
+
+// selectingPolicies returns the policies, which isolate the pod for ingress & egress.
+func selectingPolicies(policies []*networkingv1.NetworkPolicy, pod *corev1.Pod) (ingress, egress []*networkingv1.NetworkPolicy, err error) {
+	for _, policy := range policies {
+		if policy.Namespace != pod.Namespace {
+			continue
+		}
+
+		selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pod selector in policy %s/%s: %w", policy.Namespace, policy.Name, err)
+		}
+
+		if !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+
+		isIngress, isEgress := policyTypes(policy)
+		if isIngress {
+			ingress = append(ingress, policy)
+		}
+
+		if isEgress {
+			egress = append(egress, policy)
+		}
+	}
+
+	return ingress, egress, nil
+}
+
+// policyTypes returns the directions the policy applies to.
+// Without explicit types, a policy always applies to ingress & to egress only if it has egress rules.
+func policyTypes(policy *networkingv1.NetworkPolicy) (ingress, egress bool) {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return true, len(policy.Spec.Egress) > 0
+	}
+
+	for _, policyType := range policy.Spec.PolicyTypes {
+		switch policyType {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+
+	return ingress, egress
+}
+
+// podRules returns the rules of the pod chain. Allowed traffic returns to the forward chain, everything else gets dropped afterwards.
+func (c *compiler) podRules(d direction, pod *corev1.Pod, policies []*networkingv1.NetworkPolicy) ([]string, error) {
+	var rules []string
+
+	for _, policy := range policies {
+		if d == directionIngress {
+			for _, rule := range policy.Spec.Ingress {
+				ruleSet, err := c.rules(d, policy.Namespace, rule.From, rule.Ports, pod)
+				if err != nil {
+					return nil, fmt.Errorf("invalid ingress rule in policy %s/%s: %w", policy.Namespace, policy.Name, err)
+				}
+
+				rules = append(rules, ruleSet...)
+			}
+
+			continue
+		}
+
+		for _, rule := range policy.Spec.Egress {
+			ruleSet, err := c.rules(d, policy.Namespace, rule.To, rule.Ports, pod)
+			if err != nil {
+				return nil, fmt.Errorf("invalid egress rule in policy %s/%s: %w", policy.Namespace, policy.Name, err)
+			}
+
+			rules = append(rules, ruleSet...)
+		}
+	}
+
+	return unique(rules), nil
+}
+
+// rules returns the nft rules allowing the traffic of a single policy rule.
+// Named ports are resolved using the pod the policy applies to for ingress & using the peer pods for egress.
+func (c *compiler) rules(d direction, namespace string, peers []networkingv1.NetworkPolicyPeer, ports []networkingv1.NetworkPolicyPort, pod *corev1.Pod) ([]string, error) {
+	peerMatches, peerPods, err := c.peers(d, namespace, peers)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ports) == 0 {
+		return combine(peerMatches, []string{""}), nil
+	}
+
+	var (
+		portMatches []string
+		namedPorts  []networkingv1.NetworkPolicyPort
+	)
+
+	for _, port := range ports {
+		if port.Port != nil && port.Port.Type == intstr.String {
+			if d == directionIngress {
+				if match, ok := namedPortMatch(port, pod); ok {
+					portMatches = append(portMatches, match)
+				}
+
+				continue
+			}
+
+			namedPorts = append(namedPorts, port)
+
+			continue
+		}
+
+		portMatches = append(portMatches, portMatch(port))
+	}
+
+	rules := combine(peerMatches, portMatches)
+
+	// The same port name might resolve to different numbers on each peer pod
+	for _, port := range namedPorts {
+		addressesByPort := map[string][]string{}
+
+		for _, peerPod := range peerPods {
+			if match, ok := namedPortMatch(port, peerPod); ok {
+				addressesByPort[match] = append(addressesByPort[match], podAddresses(peerPod)...)
+			}
+		}
+
+		for _, match := range sortedKeys(addressesByPort) {
+			rules = append(rules, combine(addressMatches(d.peerField, addressesByPort[match]), []string{match})...)
+		}
+	}
+
+	return rules, nil
+}
+
+// peers returns the address matches for the peers & the pods they select.
+// No peers means all sources or destinations.
+func (c *compiler) peers(d direction, namespace string, peers []networkingv1.NetworkPolicyPeer) ([]string, []*corev1.Pod, error) {
+	if len(peers) == 0 {
+		return []string{""}, c.pods, nil
+	}
+
+	var (
+		matches  []string
+		allPods  []*corev1.Pod
+		seenPods = map[string]bool{}
+	)
+
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			match, err := ipBlockMatch(d.peerField, peer.IPBlock)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			matches = append(matches, match)
+
+			continue
+		}
+
+		pods, err := c.peerPods(namespace, peer)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var addresses []string
+
+		for _, pod := range pods {
+			addresses = append(addresses, podAddresses(pod)...)
+
+			if !seenPods[podName(pod)] {
+				seenPods[podName(pod)] = true
+				allPods = append(allPods, pod)
+			}
+		}
+
+		matches = append(matches, addressMatches(d.peerField, addresses)...)
+	}
+
+	return matches, allPods, nil
+}
+
+// peerPods returns the pods selected by the pod & namespace selector of the peer.
+func (c *compiler) peerPods(namespace string, peer networkingv1.NetworkPolicyPeer) ([]*corev1.Pod, error) {
+	podSelector := labels.Everything()
+
+	if peer.PodSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(peer.PodSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod selector: %w", err)
+		}
+
+		podSelector = selector
+	}
+
+	var namespaceSelector labels.Selector
+
+	if peer.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(peer.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace selector: %w", err)
+		}
+
+		namespaceSelector = selector
+	}
+
+	var pods []*corev1.Pod
+
+	for _, pod := range c.pods {
+		// Without a namespace selector, only pods of the policy's namespace are selected
+		if namespaceSelector == nil && pod.Namespace != namespace {
+			continue
+		}
+
+		if namespaceSelector != nil && !namespaceSelector.Matches(c.namespaceLabels[pod.Namespace]) {
+			continue
+		}
+
+		if podSelector.Matches(labels.Set(pod.Labels)) {
+			pods = append(pods, pod)
+		}
+	}
+
+	return pods, nil
+}
+
+// ipBlockMatch matches the CIDR of the block without the excepted networks.
+func ipBlockMatch(field string, block *networkingv1.IPBlock) (string, error) {
+	_, network, err := net.ParseCIDR(block.CIDR)
+	if err != nil {
+		return "", fmt.Errorf("invalid ipBlock cidr: %w", err)
+	}
+
+	family := addressFamily(network.IP)
+	match := fmt.Sprintf("%s %s %s", family, field, network.String())
+
+	var excepts []net.IPNet
+
+	for _, except := range block.Except {
+		_, exceptNet, err := net.ParseCIDR(except)
+		if err != nil {
+			return "", fmt.Errorf("invalid ipBlock except: %w", err)
+		}
+
+		excepts = append(excepts, *exceptNet)
+	}
+
+	if len(excepts) == 0 {
+		return match, nil
+	}
+
+	var elements []string
+	for _, except := range withoutContained(excepts) {
+		elements = append(elements, except.String())
+	}
+
+	return fmt.Sprintf("%s %s %s != { %s }", match, family, field, strings.Join(elements, ", ")), nil
+}
+
+// addressMatches returns a match per IP family for the addresses. No addresses result in no matches.
+func addressMatches(field string, addresses []string) []string {
+	var v4, v6 []string
+
+	for _, address := range unique(addresses) {
+		if addressFamily(net.ParseIP(address)) == "ip" {
+			v4 = append(v4, address)
+		} else {
+			v6 = append(v6, address)
+		}
+	}
+
+	var matches []string
+
+	if len(v4) > 0 {
+		matches = append(matches, fmt.Sprintf("ip %s { %s }", field, strings.Join(v4, ", ")))
+	}
+
+	if len(v6) > 0 {
+		matches = append(matches, fmt.Sprintf("ip6 %s { %s }", field, strings.Join(v6, ", ")))
+	}
+
+	return matches
+}
+
+// portMatch matches a numeric port or all ports of the protocol.
+func portMatch(port networkingv1.NetworkPolicyPort) string {
+	protocol := protocolName(port.Protocol)
+
+	if port.Port == nil {
+		return fmt.Sprintf("meta l4proto %s", protocol)
+	}
+
+	return fmt.Sprintf("%s dport %d", protocol, port.Port.IntValue())
+}
+
+// namedPortMatch resolves the named port using the container ports of the pod.
+func namedPortMatch(port networkingv1.NetworkPolicyPort, pod *corev1.Pod) (string, bool) {
+	protocol := corev1.ProtocolTCP
+	if port.Protocol != nil {
+		protocol = *port.Protocol
+	}
+
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			containerProtocol := containerPort.Protocol
+			if containerProtocol == "" {
+				containerProtocol = corev1.ProtocolTCP
+			}
+
+			if containerPort.Name == port.Port.StrVal && containerProtocol == protocol {
+				return fmt.Sprintf("%s dport %d", protocolName(&protocol), containerPort.ContainerPort), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func protocolName(protocol *corev1.Protocol) string {
+	if protocol == nil {
+		return "tcp"
+	}
+
+	return strings.ToLower(string(*protocol))
+}
+
+// combine returns a rule for each pair of peer & port match.
+func combine(peerMatches, portMatches []string) []string {
+	var rules []string
+
+	for _, peer := range peerMatches {
+		for _, port := range portMatches {
+			var parts []string
+
+			for _, part := range []string{peer, port, "return"} {
+				if part != "" {
+					parts = append(parts, part)
+				}
+			}
+
+			rules = append(rules, strings.Join(parts, " "))
+		}
+	}
+
+	return rules
+}
+
+func hasPodNetworkAddress(pod *corev1.Pod) bool {
+	if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+
+	return len(podAddresses(pod)) > 0
+}
+
+func podAddresses(pod *corev1.Pod) []string {
+	var addresses []string
+
+	for _, podIP := range pod.Status.PodIPs {
+		addresses = append(addresses, podIP.IP)
+	}
+
+	if len(addresses) == 0 && pod.Status.PodIP != "" {
+		addresses = append(addresses, pod.Status.PodIP)
+	}
+
+	return addresses
+}
+
+func podName(pod *corev1.Pod) string {
+	return pod.Namespace + "/" + pod.Name
+}
+
+// chainName returns a valid nft identifier, which is stable for the pod.
+func chainName(d direction, pod *corev1.Pod) string {
+	hash := sha1.Sum([]byte(podName(pod)))
+
+	return d.name + "_" + hex.EncodeToString(hash[:])[:12]
+}
+
+func addressFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip"
+	}
+
+	return "ip6"
+}
+
+// withoutContained drops the networks, which are contained in another one. nftables rejects overlapping set elements.
+func withoutContained(networks []net.IPNet) []net.IPNet {
+	sort.Slice(networks, func(i, j int) bool {
+		iOnes, _ := networks[i].Mask.Size()
+		jOnes, _ := networks[j].Mask.Size()
+
+		if iOnes != jOnes {
+			return iOnes < jOnes
+		}
+
+		return bytes.Compare(networks[i].IP.To16(), networks[j].IP.To16()) < 0
+	})
+
+	var result []net.IPNet
+
+	for _, network := range networks {
+		contained := false
+
+		for _, existing := range result {
+			if existing.Contains(network.IP) {
+				contained = true
+
+				break
+			}
+		}
+
+		if !contained {
+			result = append(result, network)
+		}
+	}
+
+	return result
+}
+
+func unique(values []string) []string {
+	seen := make(map[string]bool, len(values))
+
+	var result []string
+
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+
+	return result
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,213 @@
+package policy
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func testPod(namespace, name, nodeName, ip string, podLabels map[string]string, ports ...corev1.ContainerPort) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    podLabels,
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   nodeName,
+			Containers: []corev1.Container{{Name: "app", Ports: ports}},
+		},
+		Status: corev1.PodStatus{
+			Phase:  corev1.PodRunning,
+			PodIP:  ip,
+			PodIPs: []corev1.PodIP{{IP: ip}},
+		},
+	}
+}
+
+func testNamespace(name string, namespaceLabels map[string]string) corev1.Namespace {
+	return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: namespaceLabels}}
+}
+
+func TestCompile(t *testing.T) {
+	udp := corev1.ProtocolUDP
+	httpPort := intstr.FromString("http")
+	dnsPort := intstr.FromInt(53)
+
+	namespaces := []corev1.Namespace{
+		testNamespace("default", map[string]string{"team": "a"}),
+		testNamespace("monitoring", map[string]string{"team": "monitoring"}),
+	}
+
+	hostNetworkPod := testPod("kube-system", "agent", "node1", "192.168.1.1", map[string]string{"app": "web"})
+	hostNetworkPod.Spec.HostNetwork = true
+
+	pods := []corev1.Pod{
+		testPod("default", "web", "node1", "10.244.1.2", map[string]string{"app": "web"}, corev1.ContainerPort{Name: "http", ContainerPort: 8080}),
+		testPod("default", "db", "node1", "10.244.1.3", map[string]string{"app": "db"}),
+		testPod("default", "client", "node2", "10.244.2.2", map[string]string{"app": "client"}),
+		testPod("monitoring", "prometheus", "node2", "10.244.2.3", map[string]string{"app": "prometheus"}),
+		testPod("monitoring", "other-web", "node2", "10.244.2.4", map[string]string{"app": "web"}, corev1.ContainerPort{Name: "http", ContainerPort: 9090}),
+		hostNetworkPod,
+	}
+
+	webIngress := networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-ingress"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From:  []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}}},
+					Ports: []networkingv1.NetworkPolicyPort{{Port: &httpPort}},
+				},
+				{
+					From: []networkingv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "monitoring"}}}},
+				},
+			},
+		},
+	}
+
+	dbEgress := networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db-egress"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{
+					To:    []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.244.0.0/16", "10.244.1.0/24"}}}},
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dnsPort}},
+				},
+				{
+					// Named ports get resolved using the destination pods for egress
+					To: []networkingv1.NetworkPolicyPeer{{
+						PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+						NamespaceSelector: &metav1.LabelSelector{},
+					}},
+					Ports: []networkingv1.NetworkPolicyPort{{Port: &httpPort}},
+				},
+			},
+		},
+	}
+
+	denyAll := networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deny-all"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}
+
+	otherNamespace := networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "deny-all"},
+		Spec:       networkingv1.NetworkPolicySpec{},
+	}
+
+	tests := []struct {
+		name            string
+		policies        []networkingv1.NetworkPolicy
+		expectedRuleset string
+	}{
+		{
+			name:     "no policies",
+			policies: nil,
+			expectedRuleset: `table inet wireguard_policy {}
+delete table inet wireguard_policy
+table inet wireguard_policy {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		ct state established,related accept
+	}
+}
+`,
+		},
+		{
+			name:     "policies of other namespaces and nodes are ignored",
+			policies: []networkingv1.NetworkPolicy{otherNamespace},
+			expectedRuleset: `table inet wireguard_policy {}
+delete table inet wireguard_policy
+table inet wireguard_policy {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		ct state established,related accept
+	}
+}
+`,
+		},
+		{
+			name:     "ingress & egress rules",
+			policies: []networkingv1.NetworkPolicy{webIngress, dbEgress},
+			expectedRuleset: `table inet wireguard_policy {}
+delete table inet wireguard_policy
+table inet wireguard_policy {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		ct state established,related accept
+		ip saddr { 10.244.1.3 } jump egress_3891ad7d405b comment "default/db"
+		ip daddr { 10.244.1.2 } jump ingress_5887b1109c74 comment "default/web"
+	}
+
+	chain egress_3891ad7d405b {
+		ip daddr 10.0.0.0/8 ip daddr != { 10.244.0.0/16 } udp dport 53 return
+		ip daddr { 10.244.1.2 } tcp dport 8080 return
+		ip daddr { 10.244.2.4 } tcp dport 9090 return
+		drop
+	}
+
+	chain ingress_5887b1109c74 {
+		ip saddr { 10.244.2.2 } tcp dport 8080 return
+		ip saddr { 10.244.2.4, 10.244.2.3 } return
+		drop
+	}
+}
+`,
+		},
+		{
+			name:     "deny all",
+			policies: []networkingv1.NetworkPolicy{denyAll},
+			expectedRuleset: `table inet wireguard_policy {}
+delete table inet wireguard_policy
+table inet wireguard_policy {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		ct state established,related accept
+		ip saddr { 10.244.1.3 } jump egress_3891ad7d405b comment "default/db"
+		ip daddr { 10.244.1.3 } jump ingress_3891ad7d405b comment "default/db"
+		ip saddr { 10.244.1.2 } jump egress_5887b1109c74 comment "default/web"
+		ip daddr { 10.244.1.2 } jump ingress_5887b1109c74 comment "default/web"
+	}
+
+	chain egress_3891ad7d405b {
+		drop
+	}
+
+	chain ingress_3891ad7d405b {
+		drop
+	}
+
+	chain egress_5887b1109c74 {
+		drop
+	}
+
+	chain ingress_5887b1109c74 {
+		drop
+	}
+}
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ruleset, err := Compile("node1", test.policies, pods, namespaces)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testhelper.CompareStrings(t, test.expectedRuleset, ruleset)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package readiness
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Checks every mesh reports.
+const (
+	// CheckKey passes once the public key & endpoint are published on the node.
+	CheckKey = "key"
+	// CheckPeers counts the initialized nodes, which are configured as peers on the WireGuard device.
+	CheckPeers = "peers"
+	// CheckRoutes counts the nodes, whose routes are in place.
+	CheckRoutes = "routes"
+)
+
+const (
+	// DefaultInitialThreshold is the default fraction of missing items, up to which a node becomes ready.
+	// A few broken nodes must not keep new nodes from ever becoming ready.
+	DefaultInitialThreshold = 0.1
+	// DefaultDegradedThreshold is the default fraction of missing items, after which a ready node counts as degraded.
+	DefaultDegradedThreshold = 0.5
+)
+
+// New returns a store, which becomes ready once no more than initialThreshold of each check is missing.
+// It turns not ready again once more than degradedThreshold of a check is missing.
+func New(initialThreshold, degradedThreshold float64) *Store {
+	return &Store{
+		m:                 &sync.Mutex{},
+		initialThreshold:  initialThreshold,
+		degradedThreshold: degradedThreshold,
+		checks:            map[string]*progress{},
+	}
+}
+
+// Store collects the progress of all checks, which must pass before pods get scheduled onto the node.
+// The node only becomes ready once every check is complete up to the initial threshold.
+// Afterwards it stays ready until a check degrades past the degraded threshold.
+type Store struct {
+	m                 *sync.Mutex
+	initialThreshold  float64
+	degradedThreshold float64
+	checks            map[string]*progress
+	ready             bool
+	// cniConfigWritten is true if the CNI config got written during the last reconcile of the CNI config controller
+	cniConfigWritten bool
+}
+
+type progress struct {
+	reported bool
+	expected int
+	present  int
+}
+
+func checkName(mesh, check string) string {
+	return mesh + "/" + check
+}
+
+// Register adds a check, which must get reported before the node can become ready.
+func (s *Store) Register(mesh, check string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, exists := s.checks[checkName(mesh, check)]; !exists {
+		s.checks[checkName(mesh, check)] = &progress{}
+	}
+}
+
+// Report stores how many of the expected items of the check are in place.
+func (s *Store) Report(mesh, check string, expected, present int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.checks[checkName(mesh, check)] = &progress{
+		reported: true,
+		expected: expected,
+		present:  present,
+	}
+}
+
+// Ready returns true if the node is ready. Otherwise the failing checks are returned as well.
+func (s *Store) Ready() (bool, []string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.evaluate()
+}
+
+// SetCNIConfigWritten stores whether the CNI config is in place.
+// It's not part of Ready, as the CNI config itself gets gated on it.
+func (s *Store) SetCNIConfigWritten(written bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.cniConfigWritten = written
+}
+
+// Reconciled returns true if the node is ready and the CNI config is in place.
+// Otherwise the failing checks are returned as well.
+func (s *Store) Reconciled() (bool, []string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ready, failing := s.evaluate()
+	if !s.cniConfigWritten {
+		failing = append(failing, "cni-config: not written")
+	}
+
+	return ready && s.cniConfigWritten, failing
+}
+
+// evaluate decides about the state transitions. The lock must be held.
+func (s *Store) evaluate() (bool, []string) {
+	var failing []string
+
+	for name, p := range s.checks {
+		switch {
+		case !p.reported:
+			failing = append(failing, fmt.Sprintf("%s: not reported yet", name))
+		case s.ready && p.degraded(s.degradedThreshold):
+			failing = append(failing, fmt.Sprintf("%s: %d/%d", name, p.present, p.expected))
+		case !s.ready && p.degraded(s.initialThreshold):
+			failing = append(failing, fmt.Sprintf("%s: %d/%d", name, p.present, p.expected))
+		}
+	}
+
+	sort.Strings(failing)
+
+	s.ready = len(failing) == 0
+
+	return s.ready, failing
+}
+
+func (p *progress) degraded(threshold float64) bool {
+	if p.expected == 0 || p.present >= p.expected {
+		return false
+	}
+
+	return float64(p.expected-p.present)/float64(p.expected) > threshold
+}
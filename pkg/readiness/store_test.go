@@ -0,0 +1,139 @@
+package readiness
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+type report struct {
+	check             string
+	expected, present int
+}
+
+func TestStore(t *testing.T) {
+	tests := []struct {
+		name          string
+		reports       [][]report
+		expectedReady string
+	}{
+		{
+			name:          "nothing reported",
+			reports:       [][]report{nil},
+			expectedReady: "false [wg-kube/key: not reported yet wg-kube/peers: not reported yet wg-kube/routes: not reported yet]",
+		},
+		{
+			name: "all checks complete",
+			reports: [][]report{{
+				{check: CheckKey, expected: 1, present: 1},
+				{check: CheckPeers, expected: 4, present: 4},
+				{check: CheckRoutes, expected: 4, present: 4},
+			}},
+			expectedReady: "true []",
+		},
+		{
+			name: "peers missing before becoming ready",
+			reports: [][]report{{
+				{check: CheckKey, expected: 1, present: 1},
+				{check: CheckPeers, expected: 4, present: 3},
+				{check: CheckRoutes, expected: 4, present: 4},
+			}},
+			expectedReady: "false [wg-kube/peers: 3/4]",
+		},
+		{
+			name: "broken peer below the initial threshold",
+			reports: [][]report{{
+				{check: CheckKey, expected: 1, present: 1},
+				{check: CheckPeers, expected: 20, present: 19},
+				{check: CheckRoutes, expected: 20, present: 19},
+			}},
+			expectedReady: "true []",
+		},
+		{
+			name: "ready node below the threshold",
+			reports: [][]report{
+				{
+					{check: CheckKey, expected: 1, present: 1},
+					{check: CheckPeers, expected: 4, present: 4},
+					{check: CheckRoutes, expected: 4, present: 4},
+				},
+				{
+					{check: CheckPeers, expected: 4, present: 2},
+				},
+			},
+			expectedReady: "true []",
+		},
+		{
+			name: "ready node degraded past the threshold",
+			reports: [][]report{
+				{
+					{check: CheckKey, expected: 1, present: 1},
+					{check: CheckPeers, expected: 4, present: 4},
+					{check: CheckRoutes, expected: 4, present: 4},
+				},
+				{
+					{check: CheckRoutes, expected: 4, present: 1},
+				},
+			},
+			expectedReady: "false [wg-kube/routes: 1/4]",
+		},
+		{
+			name: "degraded node must fully recover",
+			reports: [][]report{
+				{
+					{check: CheckKey, expected: 1, present: 1},
+					{check: CheckPeers, expected: 4, present: 4},
+					{check: CheckRoutes, expected: 4, present: 4},
+				},
+				{
+					{check: CheckRoutes, expected: 4, present: 1},
+				},
+				{
+					{check: CheckRoutes, expected: 4, present: 3},
+				},
+			},
+			expectedReady: "false [wg-kube/routes: 3/4]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := New(DefaultInitialThreshold, DefaultDegradedThreshold)
+			for _, check := range []string{CheckKey, CheckPeers, CheckRoutes} {
+				store.Register("wg-kube", check)
+			}
+
+			var (
+				ready   bool
+				failing []string
+			)
+
+			// Ready gets called after every round, as it's the one deciding about state transitions
+			for _, round := range test.reports {
+				for _, r := range round {
+					store.Report("wg-kube", r.check, r.expected, r.present)
+				}
+
+				ready, failing = store.Ready()
+			}
+
+			testhelper.CompareStrings(t, test.expectedReady, fmt.Sprintf("%t [%s]", ready, strings.Join(failing, " ")))
+		})
+	}
+}
+
+func TestStoreReconciled(t *testing.T) {
+	store := New(DefaultInitialThreshold, DefaultDegradedThreshold)
+	store.Register("wg-kube", CheckKey)
+	store.Report("wg-kube", CheckKey, 1, 1)
+
+	reconciled, failing := store.Reconciled()
+	testhelper.CompareStrings(t, "false [cni-config: not written]", fmt.Sprintf("%t %v", reconciled, failing))
+
+	store.SetCNIConfigWritten(true)
+
+	reconciled, failing = store.Reconciled()
+	testhelper.CompareStrings(t, "true []", fmt.Sprintf("%t %v", reconciled, failing))
+}
@@ -0,0 +1,229 @@
+package source
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/mrincompetent/wireguard-controller/pkg/wireguard/namespace"
+)
+
+// resubscribeDelay is the time to wait before subscribing again after a subscription broke.
+const resubscribeDelay = time.Second
+
+var errSubscriptionClosed = errors.New("netlink subscription closed")
+
+// NetlinkSource triggers a reconcile whenever the kernel reports a change to the given link, its addresses or the routes using it.
+// Routes tagged with the given protocol trigger a reconcile as well, no matter which link they use. A protocol of 0 disables this.
+type NetlinkSource struct {
+	log           *zap.Logger
+	namespace     *namespace.Namespace
+	interfaceName string
+	protocol      int
+	stop          <-chan struct{}
+
+	// linkIndex is only accessed by the subscription goroutine
+	linkIndex int
+}
+
+func NewNetlinkSource(log *zap.Logger, ns *namespace.Namespace, interfaceName string, protocol int) *NetlinkSource {
+	return &NetlinkSource{
+		log:           log.With(zap.String("source", "netlink"), zap.String("interface", interfaceName)),
+		namespace:     ns,
+		interfaceName: interfaceName,
+		protocol:      protocol,
+	}
+}
+
+func (n *NetlinkSource) Start(h handler.EventHandler, queue workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+	if n.stop == nil {
+		return ErrStartCalledBeforeDependencyInjection
+	}
+
+	go func() {
+		for {
+			if err := n.subscribe(queue); err != nil {
+				n.log.Info("Netlink subscription failed. Subscribing again", zap.Error(err))
+			}
+
+			select {
+			case <-n.stop:
+				return
+			case <-time.After(resubscribeDelay):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// subscribe blocks until the source gets stopped or one of the subscriptions breaks.
+func (n *NetlinkSource) subscribe(queue workqueue.RateLimitingInterface) error {
+	nsHandle, err := n.namespace.Open()
+	if err != nil {
+		return err
+	}
+	defer nsHandle.Close()
+
+	// Fatal errors close the update channel, so we only log them
+	errorCallback := func(err error) {
+		n.log.Debug("Netlink subscription reported an error", zap.Error(err))
+	}
+
+	links := make(chan netlink.LinkUpdate)
+	addresses := make(chan netlink.AddrUpdate)
+	routes := make(chan netlink.RouteUpdate)
+
+	// Closing done ends all subscriptions.
+	// The remaining updates of each started subscription get drained, so its goroutine does not block forever.
+	done := make(chan struct{})
+	defer close(done)
+
+	if err := netlink.LinkSubscribeWithOptions(links, done, netlink.LinkSubscribeOptions{Namespace: &nsHandle, ErrorCallback: errorCallback}); err != nil {
+		return fmt.Errorf("unable to subscribe to link updates: %w", err)
+	}
+	defer drainLinkUpdates(links)
+
+	if err := netlink.AddrSubscribeWithOptions(addresses, done, netlink.AddrSubscribeOptions{Namespace: &nsHandle, ErrorCallback: errorCallback}); err != nil {
+		return fmt.Errorf("unable to subscribe to address updates: %w", err)
+	}
+	defer drainAddrUpdates(addresses)
+
+	if err := netlink.RouteSubscribeWithOptions(routes, done, netlink.RouteSubscribeOptions{Namespace: &nsHandle, ErrorCallback: errorCallback}); err != nil {
+		return fmt.Errorf("unable to subscribe to route updates: %w", err)
+	}
+	defer drainRouteUpdates(routes)
+
+	// The link might have been recreated while we were not subscribed
+	if err := n.lookupLinkIndex(); err != nil {
+		return err
+	}
+
+	// We might have missed events while not being subscribed
+	queue.Add(staticRequest)
+
+	for {
+		select {
+		case <-n.stop:
+			return nil
+		case update, ok := <-links:
+			if !ok {
+				return errSubscriptionClosed
+			}
+
+			if n.matchesLink(update) {
+				queue.Add(staticRequest)
+			}
+		case update, ok := <-addresses:
+			if !ok {
+				return errSubscriptionClosed
+			}
+
+			if n.matchesAddr(update) {
+				queue.Add(staticRequest)
+			}
+		case update, ok := <-routes:
+			if !ok {
+				return errSubscriptionClosed
+			}
+
+			if n.matchesRoute(update) {
+				queue.Add(staticRequest)
+			}
+		}
+	}
+}
+
+func (n *NetlinkSource) lookupLinkIndex() error {
+	handle, err := n.namespace.Handle()
+	if err != nil {
+		return err
+	}
+	defer handle.Delete()
+
+	link, err := handle.LinkByName(n.interfaceName)
+	if err != nil {
+		var notFoundErr netlink.LinkNotFoundError
+		if errors.As(err, &notFoundErr) {
+			n.linkIndex = 0
+
+			return nil
+		}
+
+		return fmt.Errorf("unable to get link %s: %w", n.interfaceName, err)
+	}
+
+	n.linkIndex = link.Attrs().Index
+
+	return nil
+}
+
+// matchesLink checks if the update affects our link and keeps track of its index, as it changes when the link gets recreated.
+func (n *NetlinkSource) matchesLink(update netlink.LinkUpdate) bool {
+	attrs := update.Link.Attrs()
+	if attrs == nil {
+		return false
+	}
+
+	if attrs.Name == n.interfaceName {
+		n.linkIndex = attrs.Index
+
+		return true
+	}
+
+	// The link got renamed
+	if n.linkIndex != 0 && attrs.Index == n.linkIndex {
+		n.linkIndex = 0
+
+		return true
+	}
+
+	return false
+}
+
+func (n *NetlinkSource) matchesAddr(update netlink.AddrUpdate) bool {
+	return n.linkIndex != 0 && update.LinkIndex == n.linkIndex
+}
+
+func (n *NetlinkSource) matchesRoute(update netlink.RouteUpdate) bool {
+	if n.protocol != 0 && update.Protocol == n.protocol {
+		return true
+	}
+
+	return n.linkIndex != 0 && update.LinkIndex == n.linkIndex
+}
+
+func (n *NetlinkSource) InjectStopChannel(stop <-chan struct{}) error {
+	if n.stop == nil {
+		n.stop = stop
+	}
+
+	return nil
+}
+
+func drainLinkUpdates(updates chan netlink.LinkUpdate) {
+	go func() {
+		for range updates {
+		}
+	}()
+}
+
+func drainAddrUpdates(updates chan netlink.AddrUpdate) {
+	go func() {
+		for range updates {
+		}
+	}()
+}
+
+func drainRouteUpdates(updates chan netlink.RouteUpdate) {
+	go func() {
+		for range updates {
+		}
+	}()
+}
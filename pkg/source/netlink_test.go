@@ -0,0 +1,148 @@
+package source
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestMatchesLink(t *testing.T) {
+	tests := []struct {
+		name              string
+		linkIndex         int
+		link              netlink.Link
+		expected          bool
+		expectedLinkIndex int
+	}{
+		{
+			name:              "created",
+			link:              &netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: "wg0", Index: 5}, LinkType: "wireguard"},
+			expected:          true,
+			expectedLinkIndex: 5,
+		},
+		{
+			name:              "recreated",
+			linkIndex:         5,
+			link:              &netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: "wg0", Index: 7}, LinkType: "wireguard"},
+			expected:          true,
+			expectedLinkIndex: 7,
+		},
+		{
+			name:              "renamed",
+			linkIndex:         5,
+			link:              &netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: "wg1", Index: 5}, LinkType: "wireguard"},
+			expected:          true,
+			expectedLinkIndex: 0,
+		},
+		{
+			name:              "other link",
+			linkIndex:         5,
+			link:              &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}},
+			expectedLinkIndex: 5,
+		},
+		{
+			name:              "other link while ours does not exist",
+			link:              &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}},
+			expectedLinkIndex: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := &NetlinkSource{interfaceName: "wg0", linkIndex: test.linkIndex}
+
+			if matches := n.matchesLink(netlink.LinkUpdate{Link: test.link}); matches != test.expected {
+				t.Errorf("Expected the update to match: %t, got %t", test.expected, matches)
+			}
+
+			if n.linkIndex != test.expectedLinkIndex {
+				t.Errorf("Expected link index %d, got %d", test.expectedLinkIndex, n.linkIndex)
+			}
+		})
+	}
+}
+
+func TestMatchesAddr(t *testing.T) {
+	tests := []struct {
+		name      string
+		linkIndex int
+		update    netlink.AddrUpdate
+		expected  bool
+	}{
+		{
+			name:      "our link",
+			linkIndex: 5,
+			update:    netlink.AddrUpdate{LinkIndex: 5},
+			expected:  true,
+		},
+		{
+			name:      "other link",
+			linkIndex: 5,
+			update:    netlink.AddrUpdate{LinkIndex: 2},
+		},
+		{
+			name:   "link does not exist",
+			update: netlink.AddrUpdate{LinkIndex: 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := &NetlinkSource{interfaceName: "wg0", linkIndex: test.linkIndex}
+
+			if matches := n.matchesAddr(test.update); matches != test.expected {
+				t.Errorf("Expected the update to match: %t, got %t", test.expected, matches)
+			}
+		})
+	}
+}
+
+func TestMatchesRoute(t *testing.T) {
+	tests := []struct {
+		name      string
+		linkIndex int
+		protocol  int
+		update    netlink.RouteUpdate
+		expected  bool
+	}{
+		{
+			name:      "our link",
+			linkIndex: 5,
+			update:    netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: netlink.Route{LinkIndex: 5}},
+			expected:  true,
+		},
+		{
+			name:      "other link",
+			linkIndex: 5,
+			update:    netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: netlink.Route{LinkIndex: 2}},
+		},
+		{
+			name:      "our protocol on another link",
+			linkIndex: 5,
+			protocol:  99,
+			update:    netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: netlink.Route{LinkIndex: 2, Protocol: 99}},
+			expected:  true,
+		},
+		{
+			name:      "other protocol on another link",
+			linkIndex: 5,
+			protocol:  99,
+			update:    netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: netlink.Route{LinkIndex: 2, Protocol: 4}},
+		},
+		{
+			name:   "protocol matching disabled",
+			update: netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: netlink.Route{LinkIndex: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := &NetlinkSource{interfaceName: "wg0", linkIndex: test.linkIndex, protocol: test.protocol}
+
+			if matches := n.matchesRoute(test.update); matches != test.expected {
+				t.Errorf("Expected the update to match: %t, got %t", test.expected, matches)
+			}
+		})
+	}
+}
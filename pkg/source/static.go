@@ -0,0 +1,16 @@
+package source
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// EnqueueStaticRequest maps every event to the request the interval & netlink sources enqueue.
+// It lets controllers, which always reconcile the whole state of the node, get triggered by changes to Kubernetes objects.
+func EnqueueStaticRequest() handler.EventHandler {
+	return &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(handler.MapObject) []reconcile.Request {
+			return []reconcile.Request{staticRequest}
+		}),
+	}
+}
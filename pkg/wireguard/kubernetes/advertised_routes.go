@@ -0,0 +1,147 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AnnotationKeyAdvertisedRoutes contains a comma separated list of CIDRs the node routes to, e.g. an on-prem network.
+const AnnotationKeyAdvertisedRoutes = "wireguard/advertised_routes"
+
+// AdvertisedRoutes returns the networks the node advertises via annotation.
+func AdvertisedRoutes(node *corev1.Node) (Networks, error) {
+	var networks Networks
+
+	for _, cidr := range strings.Split(node.Annotations[AnnotationKeyAdvertisedRoutes], ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse advertised route '%s' found in annotation '%s': %w", cidr, AnnotationKeyAdvertisedRoutes, err)
+		}
+
+		networks = append(networks, *network)
+	}
+
+	return networks, nil
+}
+
+// RejectedRouteError describes an advertised route which collides with another network.
+type RejectedRouteError struct {
+	Node   string
+	Route  string
+	Reason string
+}
+
+func (e RejectedRouteError) Error() string {
+	return fmt.Sprintf("rejected route %s advertised by node %s: %s", e.Route, e.Node, e.Reason)
+}
+
+// ValidateAdvertisedRoutes returns the advertised routes of all nodes, indexed by node name.
+// Routes which overlap with the cluster pod network, a node's pod CIDR or a route advertised by another node get rejected.
+// Colliding routes get rejected on all nodes advertising them, as there's no way to tell which one is right.
+// The returned error contains a RejectedRouteError for each rejected route.
+func ValidateAdvertisedRoutes(nodes []corev1.Node, podNet *net.IPNet) (map[string]Networks, error) {
+	type advertisement struct {
+		node    string
+		network net.IPNet
+	}
+
+	var (
+		combinedErr    error
+		advertisements []advertisement
+		podNetworks    []advertisement
+	)
+
+	for i := range nodes {
+		routes, err := AdvertisedRoutes(&nodes[i])
+		if err != nil {
+			combinedErr = multierr.Append(combinedErr, fmt.Errorf("node %s: %w", nodes[i].Name, err))
+
+			continue
+		}
+
+		for _, route := range routes {
+			advertisements = append(advertisements, advertisement{node: nodes[i].Name, network: route})
+		}
+
+		if PodCIDR(&nodes[i]) != "" {
+			if _, nodePodNet, err := net.ParseCIDR(PodCIDR(&nodes[i])); err == nil {
+				podNetworks = append(podNetworks, advertisement{node: nodes[i].Name, network: *nodePodNet})
+			}
+		}
+	}
+
+	rejected := make([]bool, len(advertisements))
+
+	for i, adv := range advertisements {
+		if podNet != nil && Overlaps(adv.network, *podNet) {
+			rejected[i] = true
+			combinedErr = multierr.Append(combinedErr, RejectedRouteError{Node: adv.node, Route: adv.network.String(), Reason: "overlaps with the cluster pod network " + podNet.String()})
+
+			continue
+		}
+
+		for _, nodePodNet := range podNetworks {
+			if Overlaps(adv.network, nodePodNet.network) {
+				rejected[i] = true
+				combinedErr = multierr.Append(combinedErr, RejectedRouteError{
+					Node:   adv.node,
+					Route:  adv.network.String(),
+					Reason: fmt.Sprintf("overlaps with the pod CIDR %s of node %s", nodePodNet.network.String(), nodePodNet.node),
+				})
+
+				break
+			}
+		}
+
+		if rejected[i] {
+			continue
+		}
+
+		for j, other := range advertisements {
+			if i == j || adv.node == other.node || !Overlaps(adv.network, other.network) {
+				continue
+			}
+
+			rejected[i] = true
+			combinedErr = multierr.Append(combinedErr, RejectedRouteError{
+				Node:   adv.node,
+				Route:  adv.network.String(),
+				Reason: fmt.Sprintf("overlaps with the route %s advertised by node %s", other.network.String(), other.node),
+			})
+
+			break
+		}
+	}
+
+	accepted := map[string]Networks{}
+
+	for i, adv := range advertisements {
+		if !rejected[i] {
+			accepted[adv.node] = append(accepted[adv.node], adv.network)
+		}
+	}
+
+	for nodeName := range accepted {
+		networks := accepted[nodeName]
+		sort.Slice(networks, func(i, j int) bool {
+			return networks[i].String() < networks[j].String()
+		})
+	}
+
+	return accepted, combinedErr
+}
+
+// Overlaps reports whether both networks share at least one address.
+func Overlaps(a, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
@@ -0,0 +1,113 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func nodeWithAdvertisedRoutes(name, podCIDR, routes string) corev1.Node {
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				AnnotationKeyAdvertisedRoutes: routes,
+			},
+		},
+		Spec: corev1.NodeSpec{
+			PodCIDR: podCIDR,
+		},
+	}
+}
+
+func TestValidateAdvertisedRoutes(t *testing.T) {
+	podNet := getNet(t, "10.244.0.0/16")
+
+	tests := []struct {
+		name             string
+		nodes            []corev1.Node
+		expectedRoutes   map[string]string
+		expectedRejected []string
+	}{
+		{
+			name: "valid routes",
+			nodes: []corev1.Node{
+				nodeWithAdvertisedRoutes("node1", "10.244.1.0/24", "192.168.100.0/24, 192.168.0.0/24"),
+				nodeWithAdvertisedRoutes("node2", "10.244.2.0/24", ""),
+				nodeWithAdvertisedRoutes("node3", "10.244.3.0/24", "172.16.0.0/12"),
+			},
+			expectedRoutes: map[string]string{
+				"node1": "192.168.0.0/24,192.168.100.0/24",
+				"node3": "172.16.0.0/12",
+			},
+		},
+		{
+			name: "route overlapping the pod network",
+			nodes: []corev1.Node{
+				nodeWithAdvertisedRoutes("node1", "10.244.1.0/24", "10.0.0.0/8,192.168.100.0/24"),
+			},
+			expectedRoutes: map[string]string{
+				"node1": "192.168.100.0/24",
+			},
+			expectedRejected: []string{
+				"rejected route 10.0.0.0/8 advertised by node node1: overlaps with the cluster pod network 10.244.0.0/16",
+			},
+		},
+		{
+			name: "routes colliding with each other get rejected on all nodes",
+			nodes: []corev1.Node{
+				nodeWithAdvertisedRoutes("node1", "10.244.1.0/24", "192.168.0.0/16"),
+				nodeWithAdvertisedRoutes("node2", "10.244.2.0/24", "192.168.100.0/24,172.16.0.0/12"),
+			},
+			expectedRoutes: map[string]string{
+				"node2": "172.16.0.0/12",
+			},
+			expectedRejected: []string{
+				"rejected route 192.168.0.0/16 advertised by node node1: overlaps with the route 192.168.100.0/24 advertised by node node2",
+				"rejected route 192.168.100.0/24 advertised by node node2: overlaps with the route 192.168.0.0/16 advertised by node node1",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			routes, err := ValidateAdvertisedRoutes(test.nodes, &podNet)
+
+			var rejected []string
+			for _, rejectErr := range multierr.Errors(err) {
+				rejected = append(rejected, rejectErr.Error())
+			}
+
+			sort.Strings(rejected)
+			testhelper.CompareStrings(t, fmt.Sprint(test.expectedRejected), fmt.Sprint(rejected))
+
+			gotRoutes := map[string]string{}
+			for nodeName, networks := range routes {
+				gotRoutes[nodeName] = networks.String()
+			}
+
+			testhelper.CompareStrings(t, fmt.Sprint(test.expectedRoutes), fmt.Sprint(gotRoutes))
+		})
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	_, a, _ := net.ParseCIDR("10.0.0.0/8")
+	_, b, _ := net.ParseCIDR("10.244.0.0/16")
+	_, c, _ := net.ParseCIDR("192.168.0.0/16")
+
+	if !Overlaps(*a, *b) || !Overlaps(*b, *a) {
+		t.Error("expected 10.0.0.0/8 and 10.244.0.0/16 to overlap")
+	}
+
+	if Overlaps(*a, *c) {
+		t.Error("expected 10.0.0.0/8 and 192.168.0.0/16 not to overlap")
+	}
+}
@@ -0,0 +1,122 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// LabelKeyTrustedZone groups nodes, which may talk to each other without encryption, e.g. nodes within the same rack.
+const LabelKeyTrustedZone = "wireguard/trusted-zone"
+
+// Backend is the way a node gets reached.
+type Backend string
+
+const (
+	// BackendWireGuard reaches the node through the WireGuard interface.
+	BackendWireGuard Backend = "wireguard"
+	// BackendDirect routes the node's pod CIDR via its node address.
+	BackendDirect Backend = "direct"
+	// BackendVXLAN reaches the node through the unencrypted VXLAN interface.
+	BackendVXLAN Backend = "vxlan"
+)
+
+// SameTrustedZone returns true if both nodes are in the same trusted zone and none of them forces encryption.
+func SameTrustedZone(a, b *corev1.Node) bool {
+	zone := a.Labels[LabelKeyTrustedZone]
+	if zone == "" || zone != b.Labels[LabelKeyTrustedZone] {
+		return false
+	}
+
+	return !ForcesEncryption(a) && !ForcesEncryption(b)
+}
+
+// BackendSelector picks the backend used to reach a node from the node we're running on.
+// A nil BackendSelector reaches all nodes through WireGuard.
+type BackendSelector struct {
+	ownNode       *corev1.Node
+	directRouting *DirectRouting
+	vxlan         bool
+}
+
+// NewBackendSelector returns a BackendSelector for the own node with the given backends enabled.
+func NewBackendSelector(ownNode *corev1.Node, directRouting, vxlan bool) *BackendSelector {
+	selector := &BackendSelector{
+		ownNode: ownNode,
+		vxlan:   vxlan,
+	}
+
+	if directRouting {
+		selector.directRouting = NewDirectRouting(ownNode)
+	}
+
+	return selector
+}
+
+// Backend returns the backend for the node. Direct routing is preferred over VXLAN as it needs no encapsulation at all.
+func (s *BackendSelector) Backend(node *corev1.Node) Backend {
+	if s == nil || node.Name == s.ownNode.Name {
+		return BackendWireGuard
+	}
+
+	if s.directRouting.Direct(node) {
+		return BackendDirect
+	}
+
+	if s.vxlan && SameTrustedZone(s.ownNode, node) {
+		return BackendVXLAN
+	}
+
+	return BackendWireGuard
+}
+
+// DirectGateway returns the node address to route the node's pod CIDR through. Nil gets returned if the node is not reached directly.
+func (s *BackendSelector) DirectGateway(node *corev1.Node) net.IP {
+	if s == nil {
+		return nil
+	}
+
+	return s.directRouting.Gateway(node)
+}
+
+// VXLANAddress returns the MAC address of the node's VXLAN interface.
+// It is derived from the tunnel address, so nodes do not need to publish it.
+func VXLANAddress(node *corev1.Node) (net.HardwareAddr, error) {
+	ip, err := TunnelAddress(node)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip == nil {
+		return nil, fmt.Errorf("pod CIDR %s is no IPv4 network", PodCIDR(node))
+	}
+
+	// Locally administered unicast address
+	return net.HardwareAddr{0x0a, 0x58, ip[0], ip[1], ip[2], ip[3]}, nil
+}
+
+// UnderlayAddress returns the address VXLAN packets to the node get sent to.
+// It's the address of the published WireGuard endpoint, falling back to the internal address of the node.
+func UnderlayAddress(node *corev1.Node) (net.IP, error) {
+	endpoint, err := EndpointAddress(node, DefaultAnnotations)
+	if err == nil {
+		return endpoint.IP, nil
+	}
+
+	if !IsEndpointNotFound(err) {
+		return nil, err
+	}
+
+	addr := GetPreferredAddress(node, []corev1.NodeAddressType{corev1.NodeInternalIP, corev1.NodeExternalIP})
+	if addr == nil {
+		return nil, fmt.Errorf("node has neither a published endpoint nor an internal or external address")
+	}
+
+	ip := net.ParseIP(addr.Address)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrFailedToParseAddress, addr.Address)
+	}
+
+	return ip, nil
+}
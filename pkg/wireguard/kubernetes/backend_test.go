@@ -0,0 +1,98 @@
+package kubernetes
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func TestBackendSelector(t *testing.T) {
+	zoneA := map[string]string{LabelKeyTrustedZone: "a"}
+	zoneB := map[string]string{LabelKeyTrustedZone: "b"}
+	zoneAForced := map[string]string{LabelKeyTrustedZone: "a", LabelKeyForceEncryption: "true"}
+
+	tests := []struct {
+		name            string
+		ownNode         *corev1.Node
+		node            *corev1.Node
+		directRouting   bool
+		vxlan           bool
+		expectedBackend Backend
+	}{
+		{
+			name:            "everything disabled",
+			ownNode:         nodeWithAddress("node1", "192.168.1.1", zoneA),
+			node:            nodeWithAddress("node2", "192.168.1.2", zoneA),
+			expectedBackend: BackendWireGuard,
+		},
+		{
+			name:            "same zone",
+			ownNode:         nodeWithAddress("node1", "192.168.1.1", zoneA),
+			node:            nodeWithAddress("node2", "192.168.2.2", zoneA),
+			vxlan:           true,
+			expectedBackend: BackendVXLAN,
+		},
+		{
+			name:            "other zone",
+			ownNode:         nodeWithAddress("node1", "192.168.1.1", zoneA),
+			node:            nodeWithAddress("node2", "192.168.2.2", zoneB),
+			vxlan:           true,
+			expectedBackend: BackendWireGuard,
+		},
+		{
+			name:            "no zone",
+			ownNode:         nodeWithAddress("node1", "192.168.1.1", nil),
+			node:            nodeWithAddress("node2", "192.168.2.2", nil),
+			vxlan:           true,
+			expectedBackend: BackendWireGuard,
+		},
+		{
+			name:            "same zone with forced encryption",
+			ownNode:         nodeWithAddress("node1", "192.168.1.1", zoneA),
+			node:            nodeWithAddress("node2", "192.168.2.2", zoneAForced),
+			vxlan:           true,
+			expectedBackend: BackendWireGuard,
+		},
+		{
+			name:            "direct routing is preferred over VXLAN",
+			ownNode:         withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", zoneA), "192.168.1.0/24"),
+			node:            withNetworkSegment(nodeWithAddress("node2", "192.168.1.2", zoneA), "192.168.1.0/24"),
+			directRouting:   true,
+			vxlan:           true,
+			expectedBackend: BackendDirect,
+		},
+		{
+			name:            "own node",
+			ownNode:         nodeWithAddress("node1", "192.168.1.1", zoneA),
+			node:            nodeWithAddress("node1", "192.168.1.1", zoneA),
+			directRouting:   true,
+			vxlan:           true,
+			expectedBackend: BackendWireGuard,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selector := NewBackendSelector(test.ownNode, test.directRouting, test.vxlan)
+
+			testhelper.CompareStrings(t, string(test.expectedBackend), string(selector.Backend(test.node)))
+		})
+	}
+}
+
+func TestVXLANAddress(t *testing.T) {
+	node := &corev1.Node{
+		Spec: corev1.NodeSpec{
+			PodCIDR: "10.244.3.0/24",
+		},
+	}
+
+	mac, err := VXLANAddress(node)
+	if err != nil {
+		t.Fatalf("failed to get the VXLAN address: %v", err)
+	}
+
+	testhelper.CompareStrings(t, "0a:58:0a:f4:03:00", mac.String())
+}
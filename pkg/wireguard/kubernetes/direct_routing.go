@@ -0,0 +1,124 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// LabelKeyForceEncryption forces all traffic from & to the node through WireGuard, even if direct routing would be possible.
+	LabelKeyForceEncryption = "wireguard/force-encryption"
+	// AnnotationKeyNetworkSegment contains the network of the host address the node is reached on.
+	// It's published by agents running with direct routing enabled.
+	AnnotationKeyNetworkSegment = "wireguard/network_segment"
+)
+
+// DirectRouting decides which nodes share a network segment with the node we're running on.
+// Those nodes get reached by routing their pod CIDR via their node address, without going through WireGuard.
+// A nil DirectRouting disables direct routing.
+//
+// The decision is only based on what both nodes published, so both of them come to the same result.
+// Otherwise one node might route directly while the other one expects the traffic to arrive through WireGuard.
+type DirectRouting struct {
+	ownNode *corev1.Node
+}
+
+// NewDirectRouting returns a DirectRouting for the given node.
+func NewDirectRouting(ownNode *corev1.Node) *DirectRouting {
+	return &DirectRouting{
+		ownNode: ownNode,
+	}
+}
+
+// ForcesEncryption returns true if the node requires its traffic to go through WireGuard.
+func ForcesEncryption(node *corev1.Node) bool {
+	return node.Labels[LabelKeyForceEncryption] == "true"
+}
+
+// NodeAddress returns the address the node is reached on. It's the same address the WireGuard endpoint gets published for.
+// Nil gets returned if the node has no usable IPv4 address.
+func NodeAddress(node *corev1.Node) net.IP {
+	addr := GetPreferredAddress(node, []corev1.NodeAddressType{corev1.NodeInternalIP, corev1.NodeExternalIP})
+	if addr == nil {
+		return nil
+	}
+
+	return net.ParseIP(addr.Address).To4()
+}
+
+// NetworkSegment returns the network segment published on the node. Nil gets returned if none got published.
+func NetworkSegment(node *corev1.Node) (*net.IPNet, error) {
+	value := node.Annotations[AnnotationKeyNetworkSegment]
+	if value == "" {
+		return nil, nil
+	}
+
+	_, segment, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse network segment '%s' found in annotation '%s': %w", value, AnnotationKeyNetworkSegment, err)
+	}
+
+	return segment, nil
+}
+
+// SetNetworkSegment publishes the network segment on the node. A nil segment removes it.
+func SetNetworkSegment(node *corev1.Node, segment *net.IPNet) bool {
+	if segment == nil {
+		if _, exists := node.Annotations[AnnotationKeyNetworkSegment]; !exists {
+			return false
+		}
+
+		delete(node.Annotations, AnnotationKeyNetworkSegment)
+
+		return true
+	}
+
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+
+	if node.Annotations[AnnotationKeyNetworkSegment] == segment.String() {
+		return false
+	}
+
+	node.Annotations[AnnotationKeyNetworkSegment] = segment.String()
+
+	return true
+}
+
+// Gateway returns the address the node's pod CIDR can be routed through directly.
+// Both nodes must have published the same network segment, which contains their addresses.
+// Nil gets returned if the node must be reached through WireGuard.
+func (d *DirectRouting) Gateway(node *corev1.Node) net.IP {
+	if d == nil || node.Name == d.ownNode.Name {
+		return nil
+	}
+
+	if ForcesEncryption(d.ownNode) || ForcesEncryption(node) {
+		return nil
+	}
+
+	ownSegment, err := NetworkSegment(d.ownNode)
+	if err != nil || ownSegment == nil {
+		return nil
+	}
+
+	segment, err := NetworkSegment(node)
+	if err != nil || segment == nil || segment.String() != ownSegment.String() {
+		return nil
+	}
+
+	ownIP, ip := NodeAddress(d.ownNode), NodeAddress(node)
+	if ownIP == nil || ip == nil || !segment.Contains(ownIP) || !segment.Contains(ip) {
+		return nil
+	}
+
+	return ip
+}
+
+// Direct returns true if the node is reachable without going through WireGuard.
+func (d *DirectRouting) Direct(node *corev1.Node) bool {
+	return d.Gateway(node) != nil
+}
@@ -0,0 +1,185 @@
+package kubernetes
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func nodeWithAddress(name, address string, labels map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeHostName, Address: name},
+				{Type: corev1.NodeInternalIP, Address: address},
+			},
+		},
+	}
+}
+
+func withNetworkSegment(node *corev1.Node, segment string) *corev1.Node {
+	node.Annotations = map[string]string{AnnotationKeyNetworkSegment: segment}
+
+	return node
+}
+
+func TestDirectRoutingGateway(t *testing.T) {
+	forceEncryption := map[string]string{LabelKeyForceEncryption: "true"}
+
+	tests := []struct {
+		name            string
+		ownNode         *corev1.Node
+		node            *corev1.Node
+		expectedGateway string
+	}{
+		{
+			name:            "same segment",
+			ownNode:         withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", nil), "192.168.1.0/24"),
+			node:            withNetworkSegment(nodeWithAddress("node2", "192.168.1.2", nil), "192.168.1.0/24"),
+			expectedGateway: "192.168.1.2",
+		},
+		{
+			name:            "other segment",
+			ownNode:         withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", nil), "192.168.1.0/24"),
+			node:            withNetworkSegment(nodeWithAddress("node2", "192.168.2.2", nil), "192.168.2.0/24"),
+			expectedGateway: "<nil>",
+		},
+		{
+			name:            "peer did not publish a segment",
+			ownNode:         withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", nil), "192.168.1.0/24"),
+			node:            nodeWithAddress("node2", "192.168.1.2", nil),
+			expectedGateway: "<nil>",
+		},
+		{
+			name:            "own node did not publish a segment",
+			ownNode:         nodeWithAddress("node1", "192.168.1.1", nil),
+			node:            withNetworkSegment(nodeWithAddress("node2", "192.168.1.2", nil), "192.168.1.0/24"),
+			expectedGateway: "<nil>",
+		},
+		{
+			name:            "peer address outside of the segment",
+			ownNode:         withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", nil), "192.168.1.0/24"),
+			node:            withNetworkSegment(nodeWithAddress("node2", "10.0.0.2", nil), "192.168.1.0/24"),
+			expectedGateway: "<nil>",
+		},
+		{
+			name:            "invalid segment",
+			ownNode:         withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", nil), "192.168.1.0/24"),
+			node:            withNetworkSegment(nodeWithAddress("node2", "192.168.1.2", nil), "192.168.1.0"),
+			expectedGateway: "<nil>",
+		},
+		{
+			name:            "own node",
+			ownNode:         withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", nil), "192.168.1.0/24"),
+			node:            withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", nil), "192.168.1.0/24"),
+			expectedGateway: "<nil>",
+		},
+		{
+			name:            "peer forces encryption",
+			ownNode:         withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", nil), "192.168.1.0/24"),
+			node:            withNetworkSegment(nodeWithAddress("node2", "192.168.1.2", forceEncryption), "192.168.1.0/24"),
+			expectedGateway: "<nil>",
+		},
+		{
+			name:            "own node forces encryption",
+			ownNode:         withNetworkSegment(nodeWithAddress("node1", "192.168.1.1", forceEncryption), "192.168.1.0/24"),
+			node:            withNetworkSegment(nodeWithAddress("node2", "192.168.1.2", nil), "192.168.1.0/24"),
+			expectedGateway: "<nil>",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directRouting := NewDirectRouting(test.ownNode)
+
+			testhelper.CompareStrings(t, test.expectedGateway, fmt.Sprint(directRouting.Gateway(test.node)))
+		})
+	}
+}
+
+// A node, whose segment contains the address of a peer on a smaller segment, must not route directly to it,
+// as the peer would keep sending its traffic through WireGuard.
+func TestDirectRoutingSymmetric(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        *corev1.Node
+		b        *corev1.Node
+		expected bool
+	}{
+		{
+			name:     "same segment",
+			a:        withNetworkSegment(nodeWithAddress("node1", "10.0.1.1", nil), "10.0.1.0/24"),
+			b:        withNetworkSegment(nodeWithAddress("node2", "10.0.1.2", nil), "10.0.1.0/24"),
+			expected: true,
+		},
+		{
+			name: "different prefix lengths",
+			a:    withNetworkSegment(nodeWithAddress("node1", "10.0.0.1", nil), "10.0.0.0/16"),
+			b:    withNetworkSegment(nodeWithAddress("node2", "10.0.1.2", nil), "10.0.1.0/24"),
+		},
+		{
+			name: "one node without direct routing",
+			a:    withNetworkSegment(nodeWithAddress("node1", "10.0.1.1", nil), "10.0.1.0/24"),
+			b:    nodeWithAddress("node2", "10.0.1.2", nil),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fromA := NewDirectRouting(test.a).Direct(test.b)
+			fromB := NewDirectRouting(test.b).Direct(test.a)
+
+			if fromA != fromB {
+				t.Fatalf("Expected a symmetric decision, got %t from %s and %t from %s", fromA, test.a.Name, fromB, test.b.Name)
+			}
+
+			if fromA != test.expected {
+				t.Errorf("Expected direct routing: %t, got %t", test.expected, fromA)
+			}
+		})
+	}
+}
+
+func TestSetNetworkSegment(t *testing.T) {
+	node := nodeWithAddress("node1", "192.168.1.1", nil)
+	segment := getNet(t, "192.168.1.0/24")
+
+	if !SetNetworkSegment(node, &segment) {
+		t.Error("Expected the segment to get set")
+	}
+
+	if SetNetworkSegment(node, &segment) {
+		t.Error("Expected an unchanged segment to not update the node")
+	}
+
+	published, err := NetworkSegment(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testhelper.CompareStrings(t, "192.168.1.0/24", published.String())
+
+	if !SetNetworkSegment(node, nil) {
+		t.Error("Expected the segment to get removed")
+	}
+
+	if SetNetworkSegment(node, nil) {
+		t.Error("Expected a missing segment to not update the node")
+	}
+}
+
+func TestDirectRoutingDisabled(t *testing.T) {
+	var directRouting *DirectRouting
+
+	if directRouting.Direct(nodeWithAddress("node2", "192.168.1.2", nil)) {
+		t.Error("expected a nil DirectRouting to never route directly")
+	}
+}
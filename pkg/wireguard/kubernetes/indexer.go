@@ -19,26 +19,37 @@ const (
 
 var ErrGotMultipleNodesWithPublicKey = errors.New("got more than 1 node with the public key. This must not happen")
 
-func publicKeyIndexFunc(o runtime.Object) []string {
-	node, ok := o.(*corev1.Node)
-	if !ok {
+func publicKeyIndexFunc(annotations Annotations) client.IndexerFunc {
+	return func(o runtime.Object) []string {
+		node, ok := o.(*corev1.Node)
+		if !ok {
+			return nil
+		}
+
+		if key := node.Annotations[annotations.PublicKey]; key != "" {
+			return []string{key}
+		}
+
 		return nil
 	}
+}
 
-	if key := node.Annotations[AnnotationKeyPublicKey]; key != "" {
-		return []string{key}
+// publicKeyIndexField returns the name of the index field. Each mesh publishes its keys in a different annotation and thus needs its own index.
+func publicKeyIndexField(annotations Annotations) string {
+	if annotations == DefaultAnnotations {
+		return indexFieldPublicKey
 	}
 
-	return nil
+	return indexFieldPublicKey + "/" + annotations.PublicKey
 }
 
-func RegisterPublicKeyIndexer(ctx context.Context, indexer client.FieldIndexer) error {
-	return indexer.IndexField(ctx, &corev1.Node{}, indexFieldPublicKey, publicKeyIndexFunc)
+func RegisterPublicKeyIndexer(ctx context.Context, indexer client.FieldIndexer, annotations Annotations) error {
+	return indexer.IndexField(ctx, &corev1.Node{}, publicKeyIndexField(annotations), publicKeyIndexFunc(annotations))
 }
 
-func GetNodeByPublicKey(ctx context.Context, c client.Reader, publicKey string) (*corev1.Node, error) {
+func GetNodeByPublicKey(ctx context.Context, c client.Reader, annotations Annotations, publicKey string) (*corev1.Node, error) {
 	nodeList := &corev1.NodeList{}
-	if err := c.List(ctx, nodeList, client.MatchingFields{indexFieldPublicKey: publicKey}); err != nil {
+	if err := c.List(ctx, nodeList, client.MatchingFields{publicKeyIndexField(annotations): publicKey}); err != nil {
 		return nil, fmt.Errorf("unable to list nodes: %w", err)
 	}
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	corev1 "k8s.io/api/core/v1"
@@ -13,40 +14,105 @@ import (
 const (
 	AnnotationKeyPublicKey = "wireguard/public_key"
 	AnnotationKeyEndpoint  = "wireguard/endpoint"
+	// AnnotationKeyPersistentKeepalive lets a node ask its peers to send keepalive packets in the given interval.
+	AnnotationKeyPersistentKeepalive = "wireguard/persistent_keepalive"
+	// AnnotationKeyUnmanagedPeers contains a comma separated list of public keys, the agent on the node must never touch.
+	AnnotationKeyUnmanagedPeers = "wireguard/unmanaged_peers"
+	// AnnotationKeyPodCIDR contains the pod CIDR allocated by the IPAM controller on clusters, where Kubernetes does not allocate them.
+	AnnotationKeyPodCIDR = "wireguard/pod_cidr"
 )
 
-type PublicKeyNotFoundError struct{}
+// PodCIDR returns the pod CIDR of the node. The one allocated by Kubernetes takes precedence over the annotation.
+func PodCIDR(node *corev1.Node) string {
+	if node.Spec.PodCIDR != "" {
+		return node.Spec.PodCIDR
+	}
+
+	return node.Annotations[AnnotationKeyPodCIDR]
+}
+
+// PodCIDRs returns all pod CIDRs of the node. It contains one network per IP family on dual-stack clusters.
+func PodCIDRs(node *corev1.Node) []string {
+	if len(node.Spec.PodCIDRs) > 0 {
+		return node.Spec.PodCIDRs
+	}
+
+	if podCIDR := PodCIDR(node); podCIDR != "" {
+		return []string{podCIDR}
+	}
+
+	return nil
+}
+
+// SetPodCIDR stores the allocated pod CIDR on the node. An existing allocation never gets changed.
+func SetPodCIDR(node *corev1.Node, podCIDR string) bool {
+	if PodCIDR(node) != "" {
+		return false
+	}
+
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+
+	node.Annotations[AnnotationKeyPodCIDR] = podCIDR
+
+	return true
+}
+
+// Annotations contains the annotation keys a mesh uses to publish the WireGuard settings of a node.
+type Annotations struct {
+	PublicKey string
+	Endpoint  string
+}
+
+// DefaultAnnotations are used by the primary mesh.
+var DefaultAnnotations = Annotations{
+	PublicKey: AnnotationKeyPublicKey,
+	Endpoint:  AnnotationKeyEndpoint,
+}
+
+// AnnotationsForInterface returns the annotation keys for an additional mesh, scoped by its interface name.
+func AnnotationsForInterface(interfaceName string) Annotations {
+	return Annotations{
+		PublicKey: fmt.Sprintf("wireguard/%s.public_key", interfaceName),
+		Endpoint:  fmt.Sprintf("wireguard/%s.endpoint", interfaceName),
+	}
+}
+
+type PublicKeyNotFoundError struct {
+	Annotation string
+}
 
 func (e PublicKeyNotFoundError) Error() string {
-	return fmt.Sprintf("No public key could be found in the node's annotation %s", AnnotationKeyPublicKey)
+	return fmt.Sprintf("No public key could be found in the node's annotation %s", e.Annotation)
 }
 
 func IsPublicKeyNotFound(err error) bool {
 	return errors.As(err, &PublicKeyNotFoundError{})
 }
 
-func PublicKey(node *corev1.Node) (key wgtypes.Key, err error) {
-	sKey := node.Annotations[AnnotationKeyPublicKey]
+func PublicKey(node *corev1.Node, annotations Annotations) (key wgtypes.Key, err error) {
+	sKey := node.Annotations[annotations.PublicKey]
 	if sKey == "" {
-		return wgtypes.Key{}, PublicKeyNotFoundError{}
+		return wgtypes.Key{}, PublicKeyNotFoundError{Annotation: annotations.PublicKey}
 	}
 
 	key, err = wgtypes.ParseKey(sKey)
 	if err != nil {
-		return wgtypes.Key{}, fmt.Errorf("could not parse public key '%s' found in annotation '%s': %w", sKey, AnnotationKeyPublicKey, err)
+		return wgtypes.Key{}, fmt.Errorf("could not parse public key '%s' found in annotation '%s': %w", sKey, annotations.PublicKey, err)
 	}
 
 	return key, nil
 }
 
-func SetPublicKey(node *corev1.Node, publicKey wgtypes.Key) bool {
+func SetPublicKey(node *corev1.Node, annotations Annotations, publicKey wgtypes.Key) bool {
 	if node.Annotations == nil {
 		node.Annotations = map[string]string{}
 	}
 
 	// We cannot validate public keys :/
-	if node.Annotations[AnnotationKeyPublicKey] == "" {
-		node.Annotations[AnnotationKeyPublicKey] = publicKey.String()
+	if node.Annotations[annotations.PublicKey] == "" {
+		node.Annotations[annotations.PublicKey] = publicKey.String()
 
 		return true
 	}
@@ -54,22 +120,24 @@ func SetPublicKey(node *corev1.Node, publicKey wgtypes.Key) bool {
 	return false
 }
 
-type EndpointNotFoundError struct{}
+type EndpointNotFoundError struct {
+	Annotation string
+}
 
 func (e EndpointNotFoundError) Error() string {
-	return fmt.Sprintf("No WireGuard endpoint could be found in the node's annotation %s", AnnotationKeyPublicKey)
+	return fmt.Sprintf("No WireGuard endpoint could be found in the node's annotation %s", e.Annotation)
 }
 
 func IsEndpointNotFound(err error) bool {
 	return errors.As(err, &EndpointNotFoundError{})
 }
 
-func EndpointAddress(node *corev1.Node) (addr *net.UDPAddr, err error) {
-	if node.Annotations[AnnotationKeyEndpoint] == "" {
-		return nil, EndpointNotFoundError{}
+func EndpointAddress(node *corev1.Node, annotations Annotations) (addr *net.UDPAddr, err error) {
+	if node.Annotations[annotations.Endpoint] == "" {
+		return nil, EndpointNotFoundError{Annotation: annotations.Endpoint}
 	}
 
-	addr, err = net.ResolveUDPAddr("udp", node.Annotations[AnnotationKeyEndpoint])
+	addr, err = net.ResolveUDPAddr("udp", node.Annotations[annotations.Endpoint])
 	if err != nil {
 		return nil, fmt.Errorf("unable to resolve UDP address: %w", err)
 	}
@@ -77,13 +145,13 @@ func EndpointAddress(node *corev1.Node) (addr *net.UDPAddr, err error) {
 	return addr, nil
 }
 
-func SetEndpointAddress(node *corev1.Node, address string) bool {
+func SetEndpointAddress(node *corev1.Node, annotations Annotations, address string) bool {
 	if node.Annotations == nil {
 		node.Annotations = map[string]string{}
 	}
 
-	if node.Annotations[AnnotationKeyEndpoint] != address {
-		node.Annotations[AnnotationKeyEndpoint] = address
+	if node.Annotations[annotations.Endpoint] != address {
+		node.Annotations[annotations.Endpoint] = address
 
 		return true
 	}
@@ -91,6 +159,57 @@ func SetEndpointAddress(node *corev1.Node, address string) bool {
 	return false
 }
 
+// PersistentKeepalive returns the keepalive interval the node requested from its peers.
+// The bool return value is false if the node did not request a specific interval.
+func PersistentKeepalive(node *corev1.Node) (interval time.Duration, requested bool, err error) {
+	value := node.Annotations[AnnotationKeyPersistentKeepalive]
+	if value == "" {
+		return 0, false, nil
+	}
+
+	interval, err = time.ParseDuration(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("could not parse persistent keepalive '%s' found in annotation '%s': %w", value, AnnotationKeyPersistentKeepalive, err)
+	}
+
+	if interval < 0 {
+		return 0, false, fmt.Errorf("persistent keepalive '%s' found in annotation '%s' must not be negative", value, AnnotationKeyPersistentKeepalive)
+	}
+
+	return interval, true, nil
+}
+
+// ParsePublicKeys parses a comma separated list of public keys.
+func ParsePublicKeys(s string) ([]wgtypes.Key, error) {
+	var keys []wgtypes.Key
+
+	for _, sKey := range strings.Split(s, ",") {
+		sKey = strings.TrimSpace(sKey)
+		if sKey == "" {
+			continue
+		}
+
+		key, err := wgtypes.ParseKey(sKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse public key '%s': %w", sKey, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// UnmanagedPeers returns the public keys of the peers which got excluded from management via annotation.
+func UnmanagedPeers(node *corev1.Node) ([]wgtypes.Key, error) {
+	keys, err := ParsePublicKeys(node.Annotations[AnnotationKeyUnmanagedPeers])
+	if err != nil {
+		return nil, fmt.Errorf("invalid annotation '%s': %w", AnnotationKeyUnmanagedPeers, err)
+	}
+
+	return keys, nil
+}
+
 type PodCIDRIsEmptyError struct{}
 
 func (e PodCIDRIsEmptyError) Error() string {
@@ -122,11 +241,11 @@ func AllowedNetworks(node *corev1.Node) (networks Networks, err error) {
 		}
 	}
 
-	if node.Spec.PodCIDR == "" {
+	if PodCIDR(node) == "" {
 		return nil, PodCIDRIsEmptyError{}
 	}
 
-	_, podNet, err := net.ParseCIDR(node.Spec.PodCIDR)
+	_, podNet, err := net.ParseCIDR(PodCIDR(node))
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse pod CIDR: %w", err)
 	}
@@ -136,6 +255,37 @@ func AllowedNetworks(node *corev1.Node) (networks Networks, err error) {
 	return networks, nil
 }
 
+var ErrPodCIDRNotIPv4 = errors.New("pod CIDR is not an IPv4 network")
+
+// TunnelAddress returns the address of the node's tunnel interface, which is the first address of its pod CIDR.
+func TunnelAddress(node *corev1.Node) (net.IP, error) {
+	ip, _, err := net.ParseCIDR(PodCIDR(node))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse node pod cidr: %w", err)
+	}
+
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("%w: %s", ErrPodCIDRNotIPv4, PodCIDR(node))
+	}
+
+	return ip.To4(), nil
+}
+
+// GatewayAddress returns the address of the pod gateway on the node, which is the first usable address of its pod CIDR.
+// This matches the gateway the host-local IPAM plugin assigns to the bridge by default.
+func GatewayAddress(node *corev1.Node) (net.IP, error) {
+	ip, err := TunnelAddress(node)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway := make(net.IP, len(ip))
+	copy(gateway, ip)
+	gateway[len(gateway)-1]++
+
+	return gateway, nil
+}
+
 func GetPreferredAddress(node *corev1.Node, preferred []corev1.NodeAddressType) *corev1.NodeAddress {
 	addresses := map[corev1.NodeAddressType]*corev1.NodeAddress{}
 
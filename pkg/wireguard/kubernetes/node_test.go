@@ -83,6 +83,19 @@ func TestAllowedNetworks(t *testing.T) {
 				getNet(t, "10.244.0.0/24"),
 			},
 		},
+		{
+			name: "pod CIDR allocated by the IPAM controller",
+			node: func() *corev1.Node {
+				node := nodeWithNetworks([]corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "192.168.1.3"}}, "")
+				node.Annotations = map[string]string{AnnotationKeyPodCIDR: "10.244.1.0/24"}
+
+				return node
+			}(),
+			expectedNetworks: []net.IPNet{
+				getNet(t, "192.168.1.3/32"),
+				getNet(t, "10.244.1.0/24"),
+			},
+		},
 		{
 			name: "no pod CIDR",
 			node: nodeWithNetworks(
@@ -111,6 +124,48 @@ func TestAllowedNetworks(t *testing.T) {
 	}
 }
 
+func TestSetPodCIDR(t *testing.T) {
+	tests := []struct {
+		name             string
+		node             *corev1.Node
+		expectedChanged  bool
+		expectedPodCIDRs string
+	}{
+		{
+			name:             "no pod CIDR",
+			node:             nodeWithNetworks(nil, ""),
+			expectedChanged:  true,
+			expectedPodCIDRs: "[10.244.1.0/24]",
+		},
+		{
+			name:             "pod CIDR allocated by Kubernetes",
+			node:             nodeWithNetworks(nil, "10.244.0.0/24"),
+			expectedPodCIDRs: "[10.244.0.0/24]",
+		},
+		{
+			name: "pod CIDR already allocated",
+			node: func() *corev1.Node {
+				node := nodeWithNetworks(nil, "")
+				node.Annotations = map[string]string{AnnotationKeyPodCIDR: "10.244.2.0/24"}
+
+				return node
+			}(),
+			expectedPodCIDRs: "[10.244.2.0/24]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changed := SetPodCIDR(test.node, "10.244.1.0/24")
+			if changed != test.expectedChanged {
+				t.Errorf("expected changed to be %t, got %t", test.expectedChanged, changed)
+			}
+
+			testhelper.CompareStrings(t, test.expectedPodCIDRs, fmt.Sprint(PodCIDRs(test.node)))
+		})
+	}
+}
+
 func nodeWithPublicKey(key string) *corev1.Node {
 	return &corev1.Node{
 		ObjectMeta: metav1.ObjectMeta{
@@ -152,13 +207,13 @@ func TestPublicKey(t *testing.T) {
 		{
 			name:        "no key",
 			node:        nodeWithPublicKey(""),
-			expectedErr: PublicKeyNotFoundError{},
+			expectedErr: PublicKeyNotFoundError{Annotation: AnnotationKeyPublicKey},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			key, err := PublicKey(test.node)
+			key, err := PublicKey(test.node, DefaultAnnotations)
 			testhelper.CompareStrings(t, fmt.Sprint(test.expectedErr), fmt.Sprint(err))
 			if err != nil {
 				return
@@ -202,13 +257,13 @@ func TestEndpointAddress(t *testing.T) {
 		{
 			name:        "no endpoint",
 			node:        nodeWithEndpoint(""),
-			expectedErr: EndpointNotFoundError{},
+			expectedErr: EndpointNotFoundError{Annotation: AnnotationKeyEndpoint},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			address, err := EndpointAddress(test.node)
+			address, err := EndpointAddress(test.node, DefaultAnnotations)
 			testhelper.CompareStrings(t, fmt.Sprint(test.expectedErr), fmt.Sprint(err))
 			if err != nil {
 				return
@@ -218,3 +273,103 @@ func TestEndpointAddress(t *testing.T) {
 		})
 	}
 }
+
+func TestUnmanagedPeers(t *testing.T) {
+	tests := []struct {
+		name         string
+		annotation   string
+		expectedKeys []string
+		expectedErr  error
+	}{
+		{
+			name:       "multiple keys",
+			annotation: "4Uz+l6VDzs4LCwPv4eCuPg2DTROOqjgHF/Ic3lPeYgw=, oLt6cnpBIvAyUG4U0DbAvBQHpBUSJr0ht0A5eXZH0EM=,",
+			expectedKeys: []string{
+				"4Uz+l6VDzs4LCwPv4eCuPg2DTROOqjgHF/Ic3lPeYgw=",
+				"oLt6cnpBIvAyUG4U0DbAvBQHpBUSJr0ht0A5eXZH0EM=",
+			},
+		},
+		{
+			name:       "no annotation",
+			annotation: "",
+		},
+		{
+			name:        "invalid key",
+			annotation:  "not-valid",
+			expectedErr: errors.New("invalid annotation 'wireguard/unmanaged_peers': could not parse public key 'not-valid': wgtypes: failed to parse base64-encoded key: illegal base64 data at input byte 3"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test-node",
+					Annotations: map[string]string{
+						AnnotationKeyUnmanagedPeers: test.annotation,
+					},
+				},
+			}
+
+			keys, err := UnmanagedPeers(node)
+			testhelper.CompareStrings(t, fmt.Sprint(test.expectedErr), fmt.Sprint(err))
+			if err != nil {
+				return
+			}
+
+			var gotKeys []string
+			for _, key := range keys {
+				gotKeys = append(gotKeys, key.String())
+			}
+
+			testhelper.CompareStrings(t, fmt.Sprint(test.expectedKeys), fmt.Sprint(gotKeys))
+		})
+	}
+}
+
+func TestTunnelAndGatewayAddress(t *testing.T) {
+	tests := []struct {
+		name            string
+		podCIDR         string
+		expectedTunnel  string
+		expectedGateway string
+		expectedErr     error
+	}{
+		{
+			name:            "IPv4 pod CIDR",
+			podCIDR:         "10.244.3.0/24",
+			expectedTunnel:  "10.244.3.0",
+			expectedGateway: "10.244.3.1",
+		},
+		{
+			name:        "IPv6 pod CIDR",
+			podCIDR:     "fd00:10:244::/64",
+			expectedErr: errors.New("pod CIDR is not an IPv4 network: fd00:10:244::/64"),
+		},
+		{
+			name:        "invalid pod CIDR",
+			podCIDR:     "AAA",
+			expectedErr: errors.New("unable to parse node pod cidr: invalid CIDR address: AAA"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := nodeWithNetworks(nil, test.podCIDR)
+
+			tunnelIP, err := TunnelAddress(node)
+			testhelper.CompareStrings(t, fmt.Sprint(test.expectedErr), fmt.Sprint(err))
+
+			gatewayIP, err := GatewayAddress(node)
+			testhelper.CompareStrings(t, fmt.Sprint(test.expectedErr), fmt.Sprint(err))
+
+			if test.expectedErr != nil {
+				return
+			}
+
+			testhelper.CompareStrings(t, test.expectedGateway, gatewayIP.String())
+			// Make sure the tunnel address did not get modified
+			testhelper.CompareStrings(t, test.expectedTunnel, tunnelIP.String())
+		})
+	}
+}
@@ -5,8 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
-	"github.com/go-test/deep"
 	"go.uber.org/zap"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	corev1 "k8s.io/api/core/v1"
@@ -26,12 +26,54 @@ func IsNodeNotInitializedError(err error) bool {
 	return errors.As(err, &NodeNotInitializedError{})
 }
 
-func PeerConfigForNode(log *zap.Logger, node *corev1.Node) (*wgtypes.PeerConfig, error) {
+// UnknownPeerError gets returned if no node exists for a configured peer.
+type UnknownPeerError struct {
+	PublicKey wgtypes.Key
+}
+
+func (e UnknownPeerError) Error() string {
+	return fmt.Sprintf("no node exists for the peer with the public key '%s'", e.PublicKey.String())
+}
+
+func IsUnknownPeerError(err error) bool {
+	return errors.As(err, &UnknownPeerError{})
+}
+
+// PeerOptions contains the settings which apply to all peers.
+type PeerOptions struct {
+	// Annotations are used to read the WireGuard settings of the peers from their node objects.
+	Annotations Annotations
+	// NodeFilter returns false for nodes which must not be configured as peer. Nil allows all nodes.
+	NodeFilter func(node *corev1.Node) bool
+	// AdvertisedRoutes contains the validated routes advertised by the nodes, indexed by node name.
+	// They get added to the allowed IPs of the corresponding peer.
+	AdvertisedRoutes map[string]Networks
+	// PersistentKeepalive is used for all peers which do not request an interval via annotation. 0 disables it.
+	PersistentKeepalive time.Duration
+	// NATKeepalive is used for peers which got detected as being behind a NAT and have no other interval configured.
+	NATKeepalive time.Duration
+}
+
+// persistentKeepalive returns the keepalive interval for the node and whether it got configured explicitly.
+func (o PeerOptions) persistentKeepalive(node *corev1.Node) (time.Duration, bool, error) {
+	interval, requested, err := PersistentKeepalive(node)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if requested {
+		return interval, true, nil
+	}
+
+	return o.PersistentKeepalive, o.PersistentKeepalive != 0, nil
+}
+
+func PeerConfigForNode(log *zap.Logger, node *corev1.Node, opts PeerOptions) (*wgtypes.PeerConfig, error) {
 	log = log.Named("peer_config").With(
-		zap.String("pod_cidr", node.Spec.PodCIDR),
+		zap.String("pod_cidr", PodCIDR(node)),
 	)
 
-	key, err := PublicKey(node)
+	key, err := PublicKey(node, opts.Annotations)
 	if err != nil {
 		if IsPublicKeyNotFound(err) {
 			return nil, NodeNotInitializedError{err: err}
@@ -43,7 +85,7 @@ func PeerConfigForNode(log *zap.Logger, node *corev1.Node) (*wgtypes.PeerConfig,
 	log = log.With(zap.String("node_public_key", key.String()))
 	log.Debug("Parsed the node's WireGuard public key")
 
-	endpoint, err := EndpointAddress(node)
+	endpoint, err := EndpointAddress(node, opts.Annotations)
 	if err != nil {
 		if IsEndpointNotFound(err) {
 			return nil, NodeNotInitializedError{err: err}
@@ -60,6 +102,8 @@ func PeerConfigForNode(log *zap.Logger, node *corev1.Node) (*wgtypes.PeerConfig,
 		return nil, err
 	}
 
+	allowedNetworks = append(allowedNetworks, opts.AdvertisedRoutes[node.Name]...)
+
 	log = log.With(zap.Stringer("allowed_networks", allowedNetworks))
 	log.Debug("Determined allowed node networks")
 
@@ -69,56 +113,152 @@ func PeerConfigForNode(log *zap.Logger, node *corev1.Node) (*wgtypes.PeerConfig,
 		AllowedIPs: allowedNetworks,
 	}
 
+	keepalive, _, err := opts.persistentKeepalive(node)
+	if err != nil {
+		return nil, err
+	}
+
+	if keepalive != 0 {
+		log.Debug("Configuring persistent keepalive", zap.Duration("persistent_keepalive", keepalive))
+
+		cfg.PersistentKeepaliveInterval = &keepalive
+	}
+
 	return &cfg, nil
 }
 
-func PeerConfigForExistingPeer(ctx context.Context, log *zap.Logger, r client.Reader, peer *wgtypes.Peer) (*wgtypes.PeerConfig, error) {
+// PeerConfigForExistingPeer returns the changes which need to be applied to an already configured peer.
+// The returned config is nil if the peer is up to date.
+// If no node exists for the peer, an UnknownPeerError gets returned. It's up to the caller to decide what to do with such peers.
+func PeerConfigForExistingPeer(
+	ctx context.Context,
+	log *zap.Logger,
+	r client.Reader,
+	peer *wgtypes.Peer,
+	opts PeerOptions,
+) (*wgtypes.PeerConfig, error) {
 	pubKey := peer.PublicKey.String()
-	cfg := &wgtypes.PeerConfig{
-		PublicKey:  peer.PublicKey,
-		Endpoint:   peer.Endpoint,
-		AllowedIPs: peer.AllowedIPs,
-	}
 
-	node, err := GetNodeByPublicKey(ctx, r, pubKey)
+	node, err := GetNodeByPublicKey(ctx, r, opts.Annotations, pubKey)
 	if err != nil {
 		if kerrors.IsNotFound(err) {
-			// If the node does not exist anymore, delete the peer
-			log.Info("Marking peer for removal as the corresponding nodes does not exist anymore")
-
-			cfg.Remove = true
-
-			return cfg, nil
+			return nil, UnknownPeerError{PublicKey: peer.PublicKey}
 		}
 
 		return nil, fmt.Errorf("unable to get node by public key: %s: %w", pubKey, err)
 	}
 
-	allowedNetworks, err := AllowedNetworks(node)
+	if opts.NodeFilter != nil && !opts.NodeFilter(node) {
+		log.Info("Marking peer for removal as the corresponding node is not selected anymore", zap.String("node", node.Name))
+
+		return &wgtypes.PeerConfig{
+			PublicKey: peer.PublicKey,
+			Remove:    true,
+		}, nil
+	}
+
+	desired, err := PeerConfigForNode(log, node, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	log = log.With(zap.Stringer("allowed_networks", allowedNetworks))
+	_, explicit, err := opts.persistentKeepalive(node)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.NATKeepalive != 0 && natDetected(peer, desired.Endpoint) {
+		log.Debug("Peer seems to be behind a NAT", zap.Stringer("observed_endpoint", peer.Endpoint))
 
-	if diff := deep.Equal(cfg.AllowedIPs, []net.IPNet(allowedNetworks)); diff != nil {
-		log.Info("Updating the peers allowed networks")
+		// The observed endpoint is the one which works. Resetting it would break the connection until the peer sends again.
+		desired.Endpoint = peer.Endpoint
 
-		cfg.AllowedIPs = allowedNetworks
+		if !explicit {
+			keepalive := opts.NATKeepalive
+			desired.PersistentKeepaliveInterval = &keepalive
+		}
 	}
 
-	endpoint, err := EndpointAddress(node)
-	if err != nil {
-		return nil, err
+	return DiffPeerConfig(log, peer, desired), nil
+}
+
+// natHandshakeTimeout is the age after which a handshake is considered stale. It matches WireGuard's REJECT_AFTER_TIME.
+const natHandshakeTimeout = 180 * time.Second
+
+// natDetected reports whether the peer is behind a NAT.
+// WireGuard updates the endpoint of a peer to the address it received the last packet from.
+// If that address differs from the one the node published and the handshake is recent, the traffic got translated on its way.
+// Once the peer sends from the published address again or the handshake got stale, the NAT is considered gone.
+func natDetected(peer *wgtypes.Peer, published *net.UDPAddr) bool {
+	if peer.Endpoint == nil || published == nil || peer.Endpoint.String() == published.String() {
+		return false
 	}
 
-	log = log.With(zap.String("endpoint", endpoint.String()))
+	return !peer.LastHandshakeTime.IsZero() && time.Since(peer.LastHandshakeTime) < natHandshakeTimeout
+}
+
+// DiffPeerConfig compares the current state of a peer with its desired config.
+// It returns a config which only contains the fields that need to be updated, or nil if the peer is up to date.
+func DiffPeerConfig(log *zap.Logger, peer *wgtypes.Peer, desired *wgtypes.PeerConfig) *wgtypes.PeerConfig {
+	cfg := &wgtypes.PeerConfig{
+		PublicKey:  peer.PublicKey,
+		UpdateOnly: true,
+	}
+	changed := false
+
+	if !EqualNetworks(peer.AllowedIPs, desired.AllowedIPs) {
+		log.Info("Updating the peers allowed networks", zap.Stringer("allowed_networks", Networks(desired.AllowedIPs)))
+
+		cfg.ReplaceAllowedIPs = true
+		cfg.AllowedIPs = desired.AllowedIPs
+		changed = true
+	}
 
-	if cfg.Endpoint.String() != endpoint.String() {
-		log.Info("Updating the peers endpoint")
+	if desired.Endpoint != nil && peer.Endpoint.String() != desired.Endpoint.String() {
+		log.Info("Updating the peers endpoint", zap.Stringer("endpoint", desired.Endpoint))
+
+		cfg.Endpoint = desired.Endpoint
+		changed = true
+	}
+
+	var keepalive time.Duration
+	if desired.PersistentKeepaliveInterval != nil {
+		keepalive = *desired.PersistentKeepaliveInterval
+	}
+
+	if peer.PersistentKeepaliveInterval != keepalive {
+		log.Info("Updating the peers persistent keepalive", zap.Duration("persistent_keepalive", keepalive))
+
+		cfg.PersistentKeepaliveInterval = &keepalive
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return cfg
+}
+
+// EqualNetworks reports whether both lists contain the same networks, regardless of their order.
+func EqualNetworks(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[string]int, len(a))
+	for i := range a {
+		counts[a[i].String()]++
+	}
+
+	for i := range b {
+		key := b[i].String()
+		if counts[key] == 0 {
+			return false
+		}
 
-		cfg.Endpoint = endpoint
+		counts[key]--
 	}
 
-	return cfg, nil
+	return true
 }
@@ -1,16 +1,21 @@
 package kubernetes
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
 )
@@ -24,6 +29,7 @@ func TestGetPeerConfigForNode(t *testing.T) {
 	tests := []struct {
 		name            string
 		node            *corev1.Node
+		opts            PeerOptions
 		expectedPeerCfg *wgtypes.PeerConfig
 		expectedErr     error
 	}{
@@ -143,11 +149,116 @@ func TestGetPeerConfigForNode(t *testing.T) {
 			},
 			expectedErr: errors.New("unable to resolve UDP address: address AAAA: missing port in address"),
 		},
+		{
+			name: "global persistent keepalive",
+			node: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "node5",
+					Annotations: map[string]string{
+						AnnotationKeyEndpoint:  "192.168.1.5:51820",
+						AnnotationKeyPublicKey: testPublicKey.String(),
+					},
+				},
+				Spec: corev1.NodeSpec{
+					PodCIDR: "10.244.5.0/24",
+				},
+				Status: corev1.NodeStatus{
+					Addresses: []corev1.NodeAddress{
+						{
+							Type:    corev1.NodeInternalIP,
+							Address: "192.168.1.5",
+						},
+					},
+				},
+			},
+			opts: PeerOptions{
+				PersistentKeepalive: 25 * time.Second,
+			},
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey: testPublicKey,
+				Endpoint: &net.UDPAddr{
+					IP:   net.ParseIP("192.168.1.5"),
+					Port: 51820,
+				},
+				AllowedIPs: []net.IPNet{
+					getNet(t, "192.168.1.5/32"),
+					getNet(t, "10.244.5.0/24"),
+				},
+				PersistentKeepaliveInterval: durationPtr(25 * time.Second),
+			},
+		},
+		{
+			name: "persistent keepalive requested by the node overrides the global setting",
+			node: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "node6",
+					Annotations: map[string]string{
+						AnnotationKeyEndpoint:            "192.168.1.6:51820",
+						AnnotationKeyPublicKey:           testPublicKey.String(),
+						AnnotationKeyPersistentKeepalive: "10s",
+					},
+				},
+				Spec: corev1.NodeSpec{
+					PodCIDR: "10.244.6.0/24",
+				},
+				Status: corev1.NodeStatus{
+					Addresses: []corev1.NodeAddress{
+						{
+							Type:    corev1.NodeInternalIP,
+							Address: "192.168.1.6",
+						},
+					},
+				},
+			},
+			opts: PeerOptions{
+				PersistentKeepalive: 25 * time.Second,
+			},
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey: testPublicKey,
+				Endpoint: &net.UDPAddr{
+					IP:   net.ParseIP("192.168.1.6"),
+					Port: 51820,
+				},
+				AllowedIPs: []net.IPNet{
+					getNet(t, "192.168.1.6/32"),
+					getNet(t, "10.244.6.0/24"),
+				},
+				PersistentKeepaliveInterval: durationPtr(10 * time.Second),
+			},
+		},
+		{
+			name: "invalid persistent keepalive",
+			node: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "node7",
+					Annotations: map[string]string{
+						AnnotationKeyEndpoint:            "192.168.1.7:51820",
+						AnnotationKeyPublicKey:           testPublicKey.String(),
+						AnnotationKeyPersistentKeepalive: "often",
+					},
+				},
+				Spec: corev1.NodeSpec{
+					PodCIDR: "10.244.7.0/24",
+				},
+				Status: corev1.NodeStatus{
+					Addresses: []corev1.NodeAddress{
+						{
+							Type:    corev1.NodeInternalIP,
+							Address: "192.168.1.7",
+						},
+					},
+				},
+			},
+			expectedErr: errors.New(`could not parse persistent keepalive 'often' found in annotation 'wireguard/persistent_keepalive': time: invalid duration "often"`),
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			peerCfg, err := PeerConfigForNode(zaptest.NewLogger(t), test.node)
+			opts := test.opts
+			opts.Annotations = DefaultAnnotations
+
+			peerCfg, err := PeerConfigForNode(zaptest.NewLogger(t), test.node, opts)
 			testhelper.CompareStrings(t, fmt.Sprint(test.expectedErr), fmt.Sprint(err))
 			if test.expectedErr != nil {
 				return
@@ -167,3 +278,319 @@ func getNet(t *testing.T, cidr string) net.IPNet {
 	}
 	return *n
 }
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+// nodeReader serves nodes for the public key index lookups.
+type nodeReader struct {
+	client.Reader
+	nodes []corev1.Node
+}
+
+func (r *nodeReader) List(_ context.Context, list runtime.Object, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+
+	publicKey, _ := listOpts.FieldSelector.RequiresExactMatch(indexFieldPublicKey)
+
+	nodeList := list.(*corev1.NodeList)
+	for i := range r.nodes {
+		if r.nodes[i].Annotations[AnnotationKeyPublicKey] == publicKey {
+			nodeList.Items = append(nodeList.Items, r.nodes[i])
+		}
+	}
+
+	return nil
+}
+
+func TestPeerConfigForExistingPeer(t *testing.T) {
+	testPublicKey, err := wgtypes.ParseKey("4Uz+l6VDzs4LCwPv4eCuPg2DTROOqjgHF/Ic3lPeYgw=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := func(keepalive string) corev1.Node {
+		n := corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "node1",
+				Annotations: map[string]string{
+					AnnotationKeyEndpoint:  "192.168.1.1:51820",
+					AnnotationKeyPublicKey: testPublicKey.String(),
+				},
+			},
+			Spec: corev1.NodeSpec{PodCIDR: "10.244.0.0/24"},
+		}
+
+		if keepalive != "" {
+			n.Annotations[AnnotationKeyPersistentKeepalive] = keepalive
+		}
+
+		return n
+	}
+
+	published := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 51820}
+	translated := &net.UDPAddr{IP: net.ParseIP("88.99.100.110"), Port: 34567}
+	allowedIPs := []net.IPNet{getNet(t, "10.244.0.0/24")}
+
+	peer := func(endpoint *net.UDPAddr, keepalive time.Duration, handshakeAge time.Duration) *wgtypes.Peer {
+		return &wgtypes.Peer{
+			PublicKey:                   testPublicKey,
+			Endpoint:                    endpoint,
+			AllowedIPs:                  allowedIPs,
+			PersistentKeepaliveInterval: keepalive,
+			LastHandshakeTime:           time.Now().Add(-handshakeAge),
+		}
+	}
+
+	opts := PeerOptions{Annotations: DefaultAnnotations, NATKeepalive: 25 * time.Second}
+
+	tests := []struct {
+		name            string
+		node            corev1.Node
+		peer            *wgtypes.Peer
+		opts            PeerOptions
+		expectedPeerCfg *wgtypes.PeerConfig
+	}{
+		{
+			name: "up to date peer",
+			node: node(""),
+			peer: peer(published, 0, time.Minute),
+			opts: opts,
+		},
+		{
+			name: "NAT detected keeps the observed endpoint",
+			node: node(""),
+			peer: peer(translated, 0, time.Minute),
+			opts: opts,
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey:                   testPublicKey,
+				UpdateOnly:                  true,
+				PersistentKeepaliveInterval: durationPtr(25 * time.Second),
+			},
+		},
+		{
+			name: "NAT keepalive stays while the NAT exists",
+			node: node(""),
+			peer: peer(translated, 25*time.Second, time.Minute),
+			opts: opts,
+		},
+		{
+			name: "NAT keepalive gets cleared once the published endpoint is used again",
+			node: node(""),
+			peer: peer(published, 25*time.Second, time.Minute),
+			opts: opts,
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey:                   testPublicKey,
+				UpdateOnly:                  true,
+				PersistentKeepaliveInterval: durationPtr(0),
+			},
+		},
+		{
+			name: "stale handshake resets the endpoint and the keepalive",
+			node: node(""),
+			peer: peer(translated, 25*time.Second, 10*time.Minute),
+			opts: opts,
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey:                   testPublicKey,
+				UpdateOnly:                  true,
+				Endpoint:                    published,
+				PersistentKeepaliveInterval: durationPtr(0),
+			},
+		},
+		{
+			name: "NAT detection disabled resets the endpoint",
+			node: node(""),
+			peer: peer(translated, 0, time.Minute),
+			opts: PeerOptions{Annotations: DefaultAnnotations},
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey:  testPublicKey,
+				UpdateOnly: true,
+				Endpoint:   published,
+			},
+		},
+		{
+			name: "keepalive annotation takes precedence over the NAT keepalive",
+			node: node("10s"),
+			peer: peer(translated, 25*time.Second, time.Minute),
+			opts: opts,
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey:                   testPublicKey,
+				UpdateOnly:                  true,
+				PersistentKeepaliveInterval: durationPtr(10 * time.Second),
+			},
+		},
+		{
+			name: "keepalive annotation without NAT",
+			node: node("10s"),
+			peer: peer(published, 0, time.Minute),
+			opts: opts,
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey:                   testPublicKey,
+				UpdateOnly:                  true,
+				PersistentKeepaliveInterval: durationPtr(10 * time.Second),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := &nodeReader{nodes: []corev1.Node{test.node}}
+
+			peerCfg, err := PeerConfigForExistingPeer(context.Background(), zaptest.NewLogger(t), reader, test.peer, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := deep.Equal(test.expectedPeerCfg, peerCfg); diff != nil {
+				t.Errorf("got peerCfg does not match the expectedPeerCfg. Diff: \n%v", diff)
+			}
+		})
+	}
+}
+
+func TestDiffPeerConfig(t *testing.T) {
+	testPublicKey, err := wgtypes.ParseKey("4Uz+l6VDzs4LCwPv4eCuPg2DTROOqjgHF/Ic3lPeYgw=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := &net.UDPAddr{
+		IP:   net.ParseIP("192.168.1.1"),
+		Port: 51820,
+	}
+
+	tests := []struct {
+		name            string
+		peer            *wgtypes.Peer
+		desired         *wgtypes.PeerConfig
+		expectedPeerCfg *wgtypes.PeerConfig
+	}{
+		{
+			name: "up to date peer with allowed IPs in a different order",
+			peer: &wgtypes.Peer{
+				PublicKey: testPublicKey,
+				Endpoint:  endpoint,
+				AllowedIPs: []net.IPNet{
+					getNet(t, "10.244.0.0/24"),
+					getNet(t, "192.168.1.1/32"),
+				},
+			},
+			desired: &wgtypes.PeerConfig{
+				PublicKey: testPublicKey,
+				Endpoint:  endpoint,
+				AllowedIPs: []net.IPNet{
+					getNet(t, "192.168.1.1/32"),
+					getNet(t, "10.244.0.0/24"),
+				},
+			},
+		},
+		{
+			name: "changed allowed IPs",
+			peer: &wgtypes.Peer{
+				PublicKey: testPublicKey,
+				Endpoint:  endpoint,
+				AllowedIPs: []net.IPNet{
+					getNet(t, "192.168.1.1/32"),
+				},
+			},
+			desired: &wgtypes.PeerConfig{
+				PublicKey: testPublicKey,
+				Endpoint:  endpoint,
+				AllowedIPs: []net.IPNet{
+					getNet(t, "192.168.1.1/32"),
+					getNet(t, "10.244.0.0/24"),
+				},
+			},
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey:         testPublicKey,
+				UpdateOnly:        true,
+				ReplaceAllowedIPs: true,
+				AllowedIPs: []net.IPNet{
+					getNet(t, "192.168.1.1/32"),
+					getNet(t, "10.244.0.0/24"),
+				},
+			},
+		},
+		{
+			name: "changed endpoint and keepalive",
+			peer: &wgtypes.Peer{
+				PublicKey: testPublicKey,
+				Endpoint: &net.UDPAddr{
+					IP:   net.ParseIP("192.168.1.1"),
+					Port: 51821,
+				},
+				AllowedIPs: []net.IPNet{
+					getNet(t, "192.168.1.1/32"),
+				},
+				PersistentKeepaliveInterval: 25 * time.Second,
+			},
+			desired: &wgtypes.PeerConfig{
+				PublicKey: testPublicKey,
+				Endpoint:  endpoint,
+				AllowedIPs: []net.IPNet{
+					getNet(t, "192.168.1.1/32"),
+				},
+			},
+			expectedPeerCfg: &wgtypes.PeerConfig{
+				PublicKey:                   testPublicKey,
+				UpdateOnly:                  true,
+				Endpoint:                    endpoint,
+				PersistentKeepaliveInterval: durationPtr(0),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peerCfg := DiffPeerConfig(zaptest.NewLogger(t), test.peer, test.desired)
+			if diff := deep.Equal(test.expectedPeerCfg, peerCfg); diff != nil {
+				t.Errorf("got peerCfg does not match the expectedPeerCfg. Diff: \n%v", diff)
+			}
+		})
+	}
+}
+
+func BenchmarkDiffPeerConfig(b *testing.B) {
+	const peerCount = 1000
+
+	peers := make([]wgtypes.Peer, peerCount)
+	desired := make([]wgtypes.PeerConfig, peerCount)
+
+	for i := 0; i < peerCount; i++ {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		endpoint := &net.UDPAddr{IP: net.IPv4(192, 168, byte(i/256), byte(i%256)), Port: 51820}
+		allowedIPs := []net.IPNet{
+			{IP: net.IPv4(192, 168, byte(i/256), byte(i%256)).To4(), Mask: net.CIDRMask(32, 32)},
+			{IP: net.IPv4(10, byte(i/256), byte(i%256), 0).To4(), Mask: net.CIDRMask(24, 32)},
+		}
+
+		peers[i] = wgtypes.Peer{
+			PublicKey:  key.PublicKey(),
+			Endpoint:   endpoint,
+			AllowedIPs: []net.IPNet{allowedIPs[1], allowedIPs[0]},
+		}
+		desired[i] = wgtypes.PeerConfig{
+			PublicKey:  key.PublicKey(),
+			Endpoint:   endpoint,
+			AllowedIPs: allowedIPs,
+		}
+	}
+
+	log := zap.NewNop()
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for i := range peers {
+			if cfg := DiffPeerConfig(log, &peers[i], &desired[i]); cfg != nil {
+				b.Fatalf("expected peer %d to be up to date", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ConflictingPodCIDRError describes a node pod CIDR which is invalid or collides with another network.
+type ConflictingPodCIDRError struct {
+	Node    string
+	PodCIDR string
+	Reason  string
+}
+
+func (e ConflictingPodCIDRError) Error() string {
+	return fmt.Sprintf("conflicting pod CIDR %s of node %s: %s", e.PodCIDR, e.Node, e.Reason)
+}
+
+// ValidatePodCIDRs returns the names of the nodes whose pod CIDR must not be used.
+// A pod CIDR gets rejected if it can't be parsed, lies outside of the cluster pod network or contains the address of a node.
+// If the pod CIDRs of two nodes overlap, the one of the newer node gets rejected, so running nodes keep working.
+// Routes colliding with a pod CIDR are rejected by ValidateAdvertisedRoutes instead.
+// The returned error contains a ConflictingPodCIDRError for each rejected node.
+func ValidatePodCIDRs(nodes []corev1.Node, podNet *net.IPNet) (map[string]bool, error) {
+	type allocation struct {
+		node    *corev1.Node
+		network net.IPNet
+	}
+
+	var (
+		combinedErr   error
+		allocations   []allocation
+		nodeAddresses []net.IP
+		rejected      = map[string]bool{}
+	)
+
+	reject := func(node *corev1.Node, reason string) {
+		rejected[node.Name] = true
+		combinedErr = multierr.Append(combinedErr, ConflictingPodCIDRError{Node: node.Name, PodCIDR: PodCIDR(node), Reason: reason})
+	}
+
+	for i := range nodes {
+		for _, address := range nodes[i].Status.Addresses {
+			if address.Type != corev1.NodeInternalIP && address.Type != corev1.NodeExternalIP {
+				continue
+			}
+
+			if ip := net.ParseIP(address.Address); ip != nil {
+				nodeAddresses = append(nodeAddresses, ip)
+			}
+		}
+	}
+
+	// Older nodes come first, so they keep their pod CIDR on overlaps
+	sorted := make([]*corev1.Node, 0, len(nodes))
+	for i := range nodes {
+		sorted = append(sorted, &nodes[i])
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].CreationTimestamp.Equal(&sorted[j].CreationTimestamp) {
+			return sorted[i].CreationTimestamp.Before(&sorted[j].CreationTimestamp)
+		}
+
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	for _, node := range sorted {
+		if PodCIDR(node) == "" {
+			continue
+		}
+
+		_, nodePodNet, err := net.ParseCIDR(PodCIDR(node))
+		if err != nil {
+			reject(node, err.Error())
+
+			continue
+		}
+
+		if podNet != nil && !subnetOf(*nodePodNet, *podNet) {
+			reject(node, "outside of the cluster pod network "+podNet.String())
+
+			continue
+		}
+
+		if ip := containedAddress(*nodePodNet, nodeAddresses); ip != nil {
+			reject(node, "contains the node address "+ip.String())
+
+			continue
+		}
+
+		conflict := false
+
+		for _, other := range allocations {
+			if Overlaps(*nodePodNet, other.network) {
+				reject(node, fmt.Sprintf("overlaps with the pod CIDR %s of node %s", other.network.String(), other.node.Name))
+				conflict = true
+
+				break
+			}
+		}
+
+		if !conflict {
+			allocations = append(allocations, allocation{node: node, network: *nodePodNet})
+		}
+	}
+
+	return rejected, combinedErr
+}
+
+// subnetOf reports whether the network lies completely within the parent network.
+func subnetOf(network, parent net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	parentOnes, parentBits := parent.Mask.Size()
+
+	return bits == parentBits && ones >= parentOnes && parent.Contains(network.IP)
+}
+
+func containedAddress(network net.IPNet, addresses []net.IP) net.IP {
+	for _, ip := range addresses {
+		if network.Contains(ip) {
+			return ip
+		}
+	}
+
+	return nil
+}
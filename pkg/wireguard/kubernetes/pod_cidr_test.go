@@ -0,0 +1,117 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func nodeWithPodCIDR(name, podCIDR, address string, age time.Duration) corev1.Node {
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(-age)),
+		},
+		Spec: corev1.NodeSpec{
+			PodCIDR: podCIDR,
+		},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: address}},
+		},
+	}
+}
+
+func TestValidatePodCIDRs(t *testing.T) {
+	podNet := getNet(t, "10.244.0.0/16")
+
+	tests := []struct {
+		name             string
+		nodes            []corev1.Node
+		expectedRejected []string
+	}{
+		{
+			name: "valid pod CIDRs",
+			nodes: []corev1.Node{
+				nodeWithPodCIDR("node1", "10.244.1.0/24", "192.168.1.1", time.Hour),
+				nodeWithPodCIDR("node2", "10.244.2.0/24", "192.168.1.2", time.Hour),
+				nodeWithPodCIDR("node3", "", "192.168.1.3", time.Hour),
+			},
+		},
+		{
+			name: "outside of the cluster pod network",
+			nodes: []corev1.Node{
+				nodeWithPodCIDR("node1", "10.245.1.0/24", "192.168.1.1", time.Hour),
+				nodeWithPodCIDR("node2", "10.0.0.0/8", "192.168.1.2", time.Hour),
+			},
+			expectedRejected: []string{
+				"conflicting pod CIDR 10.0.0.0/8 of node node2: outside of the cluster pod network 10.244.0.0/16",
+				"conflicting pod CIDR 10.245.1.0/24 of node node1: outside of the cluster pod network 10.244.0.0/16",
+			},
+		},
+		{
+			name: "newer node loses on overlaps",
+			nodes: []corev1.Node{
+				nodeWithPodCIDR("node1", "10.244.1.0/24", "192.168.1.1", time.Minute),
+				nodeWithPodCIDR("node2", "10.244.0.0/23", "192.168.1.2", time.Hour),
+				nodeWithPodCIDR("node3", "10.244.3.0/24", "192.168.1.3", time.Hour),
+			},
+			expectedRejected: []string{
+				"conflicting pod CIDR 10.244.1.0/24 of node node1: overlaps with the pod CIDR 10.244.0.0/23 of node node2",
+			},
+		},
+		{
+			name: "same age gets decided by name",
+			nodes: []corev1.Node{
+				nodeWithPodCIDR("node2", "10.244.1.0/24", "192.168.1.2", time.Hour),
+				nodeWithPodCIDR("node1", "10.244.1.0/24", "192.168.1.1", time.Hour),
+			},
+			expectedRejected: []string{
+				"conflicting pod CIDR 10.244.1.0/24 of node node2: overlaps with the pod CIDR 10.244.1.0/24 of node node1",
+			},
+		},
+		{
+			name: "node address inside of a pod CIDR",
+			nodes: []corev1.Node{
+				nodeWithPodCIDR("node1", "10.244.1.0/24", "10.244.2.10", time.Hour),
+				nodeWithPodCIDR("node2", "10.244.2.0/24", "192.168.1.2", time.Hour),
+			},
+			expectedRejected: []string{
+				"conflicting pod CIDR 10.244.2.0/24 of node node2: contains the node address 10.244.2.10",
+			},
+		},
+		{
+			name: "invalid pod CIDR",
+			nodes: []corev1.Node{
+				nodeWithPodCIDR("node1", "10.244.1.0", "192.168.1.1", time.Hour),
+			},
+			expectedRejected: []string{
+				"conflicting pod CIDR 10.244.1.0 of node node1: invalid CIDR address: 10.244.1.0",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rejectedNodes, err := ValidatePodCIDRs(test.nodes, &podNet)
+
+			var rejected []string
+			for _, rejectErr := range multierr.Errors(err) {
+				rejected = append(rejected, rejectErr.Error())
+			}
+
+			sort.Strings(rejected)
+			testhelper.CompareStrings(t, fmt.Sprint(test.expectedRejected), fmt.Sprint(rejected))
+
+			if len(rejectedNodes) != len(test.expectedRejected) {
+				t.Errorf("expected %d rejected nodes, got %v", len(test.expectedRejected), rejectedNodes)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package kubernetes
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TaintKeyAgentNotReady keeps pods off the node until the agent configured the node network.
+const TaintKeyAgentNotReady = "wireguard/agent-not-ready"
+
+// AgentNotReadyTaint returns the taint the agent sets on its node until it reconciled successfully.
+func AgentNotReadyTaint() corev1.Taint {
+	return corev1.Taint{
+		Key:    TaintKeyAgentNotReady,
+		Effect: corev1.TaintEffectNoSchedule,
+	}
+}
+
+// SetTaint adds the taint to the node. Returns false if the node already had it.
+func SetTaint(node *corev1.Node, taint corev1.Taint) bool {
+	for _, existing := range node.Spec.Taints {
+		if existing.MatchTaint(&taint) {
+			return false
+		}
+	}
+
+	node.Spec.Taints = append(node.Spec.Taints, taint)
+
+	return true
+}
+
+// RemoveTaint removes the taint from the node. Returns false if the node did not have it.
+func RemoveTaint(node *corev1.Node, taint corev1.Taint) bool {
+	var (
+		taints  []corev1.Taint
+		removed bool
+	)
+
+	for _, existing := range node.Spec.Taints {
+		if existing.MatchTaint(&taint) {
+			removed = true
+
+			continue
+		}
+
+		taints = append(taints, existing)
+	}
+
+	node.Spec.Taints = taints
+
+	return removed
+}
@@ -0,0 +1,81 @@
+package kubernetes
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	testhelper "github.com/mrincompetent/wireguard-controller/pkg/test"
+)
+
+func TestTaints(t *testing.T) {
+	otherTaint := corev1.Taint{Key: "example.com/dedicated", Value: "edge", Effect: corev1.TaintEffectNoSchedule}
+	// MatchTaint ignores the value. A taint with the same key & effect counts as ours.
+	ownTaintWithValue := corev1.Taint{Key: TaintKeyAgentNotReady, Value: "true", Effect: corev1.TaintEffectNoSchedule}
+
+	tests := []struct {
+		name            string
+		taints          []corev1.Taint
+		remove          bool
+		expectedChanged bool
+		expectedTaints  string
+	}{
+		{
+			name:            "set on untainted node",
+			taints:          nil,
+			expectedChanged: true,
+			expectedTaints:  "[wireguard/agent-not-ready:NoSchedule]",
+		},
+		{
+			name:            "set keeps other taints",
+			taints:          []corev1.Taint{otherTaint},
+			expectedChanged: true,
+			expectedTaints:  "[example.com/dedicated=edge:NoSchedule wireguard/agent-not-ready:NoSchedule]",
+		},
+		{
+			name:            "set on already tainted node",
+			taints:          []corev1.Taint{ownTaintWithValue},
+			expectedChanged: false,
+			expectedTaints:  "[wireguard/agent-not-ready=true:NoSchedule]",
+		},
+		{
+			name:            "remove keeps other taints",
+			taints:          []corev1.Taint{otherTaint, ownTaintWithValue},
+			remove:          true,
+			expectedChanged: true,
+			expectedTaints:  "[example.com/dedicated=edge:NoSchedule]",
+		},
+		{
+			name:            "remove from untainted node",
+			taints:          []corev1.Taint{otherTaint},
+			remove:          true,
+			expectedChanged: false,
+			expectedTaints:  "[example.com/dedicated=edge:NoSchedule]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := &corev1.Node{Spec: corev1.NodeSpec{Taints: test.taints}}
+
+			var changed bool
+			if test.remove {
+				changed = RemoveTaint(node, AgentNotReadyTaint())
+			} else {
+				changed = SetTaint(node, AgentNotReadyTaint())
+			}
+
+			if changed != test.expectedChanged {
+				t.Errorf("expected changed to be %t, got %t", test.expectedChanged, changed)
+			}
+
+			var taints []string
+			for i := range node.Spec.Taints {
+				taints = append(taints, node.Spec.Taints[i].ToString())
+			}
+
+			testhelper.CompareStrings(t, test.expectedTaints, fmt.Sprint(taints))
+		})
+	}
+}
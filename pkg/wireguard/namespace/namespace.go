@@ -0,0 +1,135 @@
+package namespace
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go.uber.org/multierr"
+)
+
+// Namespace describes the network namespace the WireGuard interface and the pod routes live in.
+// A Namespace with an empty path refers to the namespace of the agent, which is the host namespace.
+type Namespace struct {
+	path string
+}
+
+func New(path string) *Namespace {
+	return &Namespace{
+		path: path,
+	}
+}
+
+func (n *Namespace) IsHost() bool {
+	return n.path == ""
+}
+
+func (n *Namespace) Path() string {
+	return n.path
+}
+
+func (n *Namespace) String() string {
+	if n.IsHost() {
+		return "host"
+	}
+
+	return n.path
+}
+
+// Open returns a handle to the network namespace. The caller must close the handle.
+func (n *Namespace) Open() (netns.NsHandle, error) {
+	if n.IsHost() {
+		return netns.Get()
+	}
+
+	handle, err := netns.GetFromPath(n.path)
+	if err != nil {
+		return netns.None(), fmt.Errorf("unable to open network namespace '%s': %w", n.path, err)
+	}
+
+	return handle, nil
+}
+
+// Handle returns a netlink handle which operates inside the network namespace.
+// The caller must call Delete on the handle once done.
+func (n *Namespace) Handle() (*netlink.Handle, error) {
+	if n.IsHost() {
+		return netlink.NewHandle()
+	}
+
+	nsHandle, err := n.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer nsHandle.Close()
+
+	h, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a netlink handle in network namespace '%s': %w", n.path, err)
+	}
+
+	return h, nil
+}
+
+// Do executes fn inside the network namespace.
+// This is required for libraries which do not support netlink handles, like wgctrl.
+// fn runs on a dedicated goroutine, whose OS thread is discarded if it can't switch back to the original namespace.
+func (n *Namespace) Do(fn func() error) error {
+	if n.IsHost() {
+		return fn()
+	}
+
+	errChan := make(chan error, 1)
+
+	go func() {
+		errChan <- n.do(fn)
+	}()
+
+	return <-errChan
+}
+
+// ErrRestoreNamespace gets returned if the thread could not switch back to its original network namespace.
+var ErrRestoreNamespace = errors.New("unable to switch back to the original network namespace")
+
+// do must run on its own goroutine. It only unlocks the OS thread once it's back in the original namespace.
+// Otherwise the thread stays locked, so the runtime terminates it once the goroutine exits.
+func (n *Namespace) do(fn func() error) error {
+	// Namespaces are set per thread. We must not get moved to another thread while being inside the namespace.
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+
+		return fmt.Errorf("unable to get the current network namespace: %w", err)
+	}
+	defer origin.Close()
+
+	target, err := n.Open()
+	if err != nil {
+		runtime.UnlockOSThread()
+
+		return err
+	}
+	defer target.Close()
+
+	if err := netns.Set(target); err != nil {
+		// Setns failed, so the thread is still in the original namespace
+		runtime.UnlockOSThread()
+
+		return fmt.Errorf("unable to enter network namespace '%s': %w", n.path, err)
+	}
+
+	fnErr := fn()
+
+	if err := netns.Set(origin); err != nil {
+		// The thread is in an unknown state. It stays locked, so it does not get reused.
+		return multierr.Append(fnErr, fmt.Errorf("%w: %v", ErrRestoreNamespace, err))
+	}
+
+	runtime.UnlockOSThread()
+
+	return fnErr
+}
@@ -0,0 +1,38 @@
+package netlink
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// LocalNetworks returns the IPv4 networks of all addresses with global scope configured on the host.
+// Networks within exclude (e.g. the cluster pod network) are skipped, as well as host routes, which do not span a segment.
+func LocalNetworks(handle *netlink.Handle, exclude *net.IPNet) ([]net.IPNet, error) {
+	addresses, err := handle.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list addresses: %w", err)
+	}
+
+	var networks []net.IPNet
+
+	for _, addr := range addresses {
+		if addr.Scope != unix.RT_SCOPE_UNIVERSE || addr.IPNet == nil {
+			continue
+		}
+
+		if ones, bits := addr.Mask.Size(); ones == bits {
+			continue
+		}
+
+		if exclude != nil && exclude.Contains(addr.IP) {
+			continue
+		}
+
+		networks = append(networks, net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask})
+	}
+
+	return networks, nil
+}